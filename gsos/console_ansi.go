@@ -29,7 +29,12 @@ func TerminalWidth() int {
 	return 0
 }
 
+// IsTerminal is true if fh is a terminal, rather than a file or pipe.
+func IsTerminal(fh *os.File) bool {
+	_, err := unix.IoctlGetWinsize(int(fh.Fd()), unix.TIOCGWINSZ)
+	return err == nil
+}
+
 // TBD supposedly SIGWINCH is sent when the terminal is resized. We could
 // catch that and then do something. Bash and other shells do this.
 // For now, I just assume that it's implausible that the terminal size changes.
-// TBD put the code for Isatty here, it could come in handy.
@@ -6,7 +6,7 @@
 package gsos
 
 import (
-	"log"
+	"os"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -39,13 +39,28 @@ type consoleScreenBufferInfo struct {
 	dwMaximumWindowSize coordinates
 }
 
-// TerminalWidth returns the width of the terminal (uses 0 as error return value)
+// IsTerminal is true if fh is a console, rather than a file or pipe.
+func IsTerminal(fh *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(fh.Fd()), &mode) == nil
+}
+
+// TerminalWidth returns the width of the terminal (uses 0 as error return value).
+// This is the width of the visible window, not of the screen buffer, which
+// can be much wider and scroll sideways.
 func TerminalWidth() int {
-	var info consoleScreenBufferInfo
-	r1, r2, err := procGetConsoleScreenBufferInfo.Call(uintptr(windows.Stderr), uintptr(unsafe.Pointer(&info)))
-	if r1 == 0 {
-		log.Fatalf("Unexpected: %d, %d, %s", r1, r2, err)
-		return 0 // something went wrong
+
+	// Try in this order: stderr, stdout. Hopefully at least one of them
+	// hasn't been redirected
+	handles := []windows.Handle{windows.Stderr, windows.Stdout}
+	for _, h := range handles {
+		var info consoleScreenBufferInfo
+		r1, _, _ := procGetConsoleScreenBufferInfo.Call(uintptr(h), uintptr(unsafe.Pointer(&info)))
+		if r1 != 0 {
+			return int(info.srWindow.Right - info.srWindow.Left + 1)
+		}
 	}
-	return int(info.dwSize.X)
+
+	// There's no console, so we can't get any information about it
+	return 0
 }
@@ -0,0 +1,64 @@
+// vcsloc/gsos/exit.go
+
+package gsos
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// fatalHooks are run by Fatalf before the program exits.
+var fatalHooks []func()
+
+// OnFatal registers fn to be run by Fatalf before it exits the program,
+// for cleanup that would otherwise be skipped (deferred calls don't run
+// on os.Exit). Hooks run in reverse order of registration.
+func OnFatal(fn func()) {
+	fatalHooks = append(fatalHooks, fn)
+}
+
+// Fatalf runs the OnFatal hooks and then calls log.Fatalf. Inside CatchFatal,
+// it panics instead, and the hooks aren't run.
+func Fatalf(format string, a ...interface{}) {
+	if atomic.LoadInt32(&catchingFatal) > 0 {
+		panic(fatalError{strings.TrimSpace(fmt.Sprintf(format, a...))})
+	}
+	hooks := fatalHooks
+	fatalHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	log.Fatalf(format, a...)
+}
+
+// catchingFatal is how many CatchFatal calls are running.
+var catchingFatal int32
+
+// fatalError is the panic from a Fatalf inside CatchFatal.
+type fatalError struct {
+	msg string
+}
+
+// CatchFatal runs fn, returning the message of a Fatalf that it calls as an
+// error rather than exiting the program, so that code written for the
+// command-line tool can be used as a library. Only a Fatalf on fn's own
+// goroutine can be caught; one on another goroutine crashes the program
+// while a CatchFatal is running, instead of exiting it.
+func CatchFatal(fn func()) (err error) {
+	atomic.AddInt32(&catchingFatal, 1)
+	defer atomic.AddInt32(&catchingFatal, -1)
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(fe.msg)
+		}
+	}()
+	fn()
+	return nil
+}
@@ -4,12 +4,31 @@ package gsos
 
 import (
 	"bufio"
+	"io"
 )
 
 
+// MaxLineLength is the longest line ScanLines accepts. bufio.Scanner's
+// default of 64KB is too small for some git output, e.g. huge commit messages.
+const MaxLineLength = 64 * 1024 * 1024
+
+// ScanLines reads r a line at a time, calling cb with each line, without the
+// [CR]LF. It stops at the first error from cb or from reading, and returns it.
+// Unlike BytesToLines, the input is never all in memory at once.
+func ScanLines(r io.Reader, cb func(string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineLength)
+	for scanner.Scan() {
+		if err := cb(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
 // BytesToLines takes a []byte slice and turns it into a sequence
 // of lines, splitting on CRLF or LF.
-// TBD preserve the iteration ability of bufio.ScanLines
+// To go through lines without holding them all, use ScanLines.
 func BytesToLines(data []byte) []string {
 
 	// Turn into lines split on [CR]LF
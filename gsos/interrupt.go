@@ -0,0 +1,35 @@
+// vcsloc/gsos/interrupt.go
+
+package gsos
+
+import (
+	"sync"
+)
+
+// interrupted is closed by Interrupt.
+var (
+	interrupted = make(chan struct{})
+	interruptOnce sync.Once
+)
+
+// Interrupt asks long-running work to stop at the next safe point, e.g. on
+// Ctrl-C, so that what was done so far can be saved. It can be called more
+// than once.
+func Interrupt() {
+	interruptOnce.Do(func() { close(interrupted) })
+}
+
+// Interrupted returns a channel that's closed once Interrupt is called.
+func Interrupted() <-chan struct{} {
+	return interrupted
+}
+
+// IsInterrupted is true once Interrupt has been called.
+func IsInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
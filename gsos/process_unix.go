@@ -0,0 +1,19 @@
+// vcsloc/gsos/process_unix.go
+
+// +build !windows
+
+package gsos
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ProcessExists is true if there's a running process with this pid. A
+// process we aren't allowed to signal still exists.
+func ProcessExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
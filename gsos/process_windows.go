@@ -0,0 +1,30 @@
+// vcsloc/gsos/process_windows.go
+
+// +build windows
+
+package gsos
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code GetExitCodeProcess gives a running process.
+const stillActive = 259
+
+// ProcessExists is true if there's a running process with this pid.
+func ProcessExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// A process we can't look at still exists
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
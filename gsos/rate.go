@@ -0,0 +1,91 @@
+// vcsloc/gsos/rate.go
+
+package gsos
+
+import (
+	"time"
+)
+
+// RateMeter is a moving average of how fast a count goes up, over the last
+// few seconds (the window), for estimating how long the rest of the work
+// will take. A rate from the start of the work would be thrown off by a slow
+// start, and one from the last step alone jumps around too much.
+type RateMeter struct {
+	window time.Duration
+	samples []rateSample // oldest first; the first is the one just outside the window
+}
+
+// rateSample is the count at a point in time.
+type rateSample struct {
+	at time.Time
+	n int
+}
+
+// rateSamples is about how many samples a RateMeter keeps over its window;
+// counts observed closer together than that replace the newest sample.
+const rateSamples = 20
+
+// minRateSpan is the least time a RateMeter has to have watched the count
+// before it estimates, since the first moments are the least steady.
+const minRateSpan = time.Second
+
+func NewRateMeter(window time.Duration) *RateMeter {
+	return &RateMeter{window: window}
+}
+
+// Observe records that the count was n at now. A count lower than the last
+// one starts the average over.
+func (m *RateMeter) Observe(n int, now time.Time) {
+	last := len(m.samples) - 1
+	if last >= 0 && n < m.samples[last].n {
+		m.samples = m.samples[:0]
+		last = -1
+	}
+	sample := rateSample{at: now, n: n}
+	if last >= 1 && now.Sub(m.samples[last-1].at) < m.window/rateSamples {
+		m.samples[last] = sample
+	} else {
+		m.samples = append(m.samples, sample)
+	}
+
+	// Keep one sample from before the window, so the average covers all of it
+	drop := 0
+	for drop+1 < len(m.samples) && now.Sub(m.samples[drop+1].at) >= m.window {
+		drop += 1
+	}
+	if drop > 0 {
+		m.samples = append(m.samples[:0], m.samples[drop:]...)
+	}
+}
+
+// Rate is the count per second over the window; 0 until there are two
+// samples.
+func (m *RateMeter) Rate() float64 {
+	if len(m.samples) < 2 {
+		return 0
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.n-first.n) / elapsed
+}
+
+// ETA estimates how long until the count gets to total at the current rate.
+// It's false if there's no estimate yet: the count hasn't been watched for
+// long enough, or isn't going up.
+func (m *RateMeter) ETA(total int) (time.Duration, bool) {
+	if len(m.samples) < 2 || m.samples[len(m.samples)-1].at.Sub(m.samples[0].at) < minRateSpan {
+		return 0, false
+	}
+	rate := m.Rate()
+	if rate <= 0 {
+		return 0, false
+	}
+	remaining := total - m.samples[len(m.samples)-1].n
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
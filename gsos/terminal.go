@@ -4,9 +4,10 @@ package gsos
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,11 +15,29 @@ type Terminal interface {
 	// Output that can be throttled and won't advance the line
 	Progressf(format string, a ...interface{}) (n int, err error)
 
+	// Structured progress; it's called for every step, not just when Ready,
+	// and a Terminal that shows it throttles it like Progressf
+	Report(p Progress)
+
+	// Busyf shows a progress message for a phase of the work that may go
+	// quiet for a while, e.g. one that reports no counts, or a command that
+	// takes a while to start its output. Until the returned function is
+	// called, a Terminal can show that the phase is still going; Progressf
+	// and Report update the message
+	Busyf(format string, a ...interface{}) func()
+
 	// Non-status output that is line-position savvy
 	Printf(format string, a ...interface{}) (n int, err error)
 
+	// Warning output that is line-position savvy; warnings are counted and
+	// kept so they can be summarized at the end
+	Warnf(format string, a ...interface{})
+
+	// The warnings issued so far
+	Warnings() []string
+
 	// Fatal output that is line-position savvy
-	// (currently calls log.Fatalf)
+	// (currently calls Fatalf, which calls log.Fatalf)
 	Fatalf(format string, a ...interface{})
 
 	// True if Progressf will result in output
@@ -31,6 +50,38 @@ type Terminal interface {
 	Len() int
 }
 
+// Progress is how far a phase of the work has got, for consumers that want
+// the numbers rather than a message.
+type Progress struct {
+	Phase string // what's being fetched, e.g. "hashes" or "commits"
+	Current int
+	Total int // 0 if it isn't known
+	ETA time.Duration // estimated time left, 0 if there's no estimate; see RateMeter
+}
+
+// String formats p as a progress message, e.g. "Getting commits (10/25 40%)...",
+// or with an estimate, "Getting commits (10/25 40%, ETA 3m10s)...".
+func (p Progress) String() string {
+	if p.Total > 0 && p.ETA > 0 {
+		return fmt.Sprintf("Getting %s (%d/%d %d%%, ETA %s)...", p.Phase, p.Current, p.Total, p.Percent(), p.ETA.Round(time.Second))
+	}
+	if p.Total > 0 {
+		return fmt.Sprintf("Getting %s (%d/%d %d%%)...", p.Phase, p.Current, p.Total, p.Percent())
+	}
+	return fmt.Sprintf("Getting %s (%d)...", p.Phase, p.Current)
+}
+
+// Percent is how far along p is, 0 to 100; 0 if the total isn't known.
+func (p Progress) Percent() int {
+	if p.Total <= 0 {
+		return 0
+	}
+	if p.Current >= p.Total {
+		return 100
+	}
+	return p.Current * 100 / p.Total
+}
+
 // StringFillToExact is a helper function that produces a line of exactly lineLen
 // characters, truncating or padding with trailing spaces as needed.
 func StringFillToExact(out string, lineLen int) string {
@@ -44,40 +95,167 @@ func StringFillToExact(out string, lineLen int) string {
 
 // ----------------------------------------------------------------------------------------------
 
+// NullTerminal is a Terminal that shows nothing, for running quietly or
+// in tests. Warnings are still kept, and Fatalf still exits.
+type NullTerminal struct {
+	warnings []string
+}
+
+func NewNullTerminal() *NullTerminal {
+	return &NullTerminal{}
+}
+
+func (t *NullTerminal) Progressf(format string, a ...interface{}) (n int, err error) {
+	return 0, nil
+}
+
+func (t *NullTerminal) Report(p Progress) {
+}
+
+func (t *NullTerminal) Busyf(format string, a ...interface{}) func() {
+	return func() {}
+}
+
+func (t *NullTerminal) Printf(format string, a ...interface{}) (n int, err error) {
+	return 0, nil
+}
+
+func (t *NullTerminal) Warnf(format string, a ...interface{}) {
+	t.warnings = append(t.warnings, strings.TrimRight(fmt.Sprintf(format, a...), "\n"))
+}
+
+func (t *NullTerminal) Warnings() []string {
+	return t.warnings
+}
+
+func (t *NullTerminal) Fatalf(format string, a ...interface{}) {
+	Fatalf(format, a...)
+}
+
+// Ready is always false, so callers skip building progress messages.
+func (t *NullTerminal) Ready() bool {
+	return false
+}
+
+func (t *NullTerminal) Force() Terminal {
+	return t
+}
+
+func (t *NullTerminal) Len() int {
+	return 80
+}
+
+// ----------------------------------------------------------------------------------------------
+
 // ThrottleTerminal is a simple kind of Terminal, one that throttles the output rate
-// to a user-specified value.
+// to a user-specified value. It's safe for concurrent use, since the
+// heartbeat (see SetHeartbeat) draws from a goroutine of its own.
 type ThrottleTerminal struct {
+	mu sync.Mutex
 	unterminatedLine bool
 	lastStatus time.Time
 	period time.Duration
 
 	startTime time.Time
 	lineMax int
+
+	plain bool // not a terminal: no rewound lines, and less progress
+	color bool // color warnings and errors with ANSI escapes
+
+	warnings []string
+
+	heartbeat time.Duration // see SetHeartbeat; 0 for none
+	busy string // the message of the Busyf phase going on, if any
+	busyPhase int // counts Busyf calls, so an old phase's done func does nothing
+	spin int // the spinner's position
+
+	rate *RateMeter // how fast the Report phase with a total is going
+	ratePhase string // the phase rate is for
 }
 
+// rateWindow is how far back ThrottleTerminal averages the rate of a phase
+// for its ETA.
+const rateWindow = 5*time.Second
+
+// plainPeriod is the least time between Progressf lines in plain mode, where
+// every one is a new line in a log.
+const plainPeriod = 10*time.Second
+
+// ANSI escapes used when color is on
+const (
+	ansiYellow = "\x1b[33m"
+	ansiRed = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// maxShownWarnings is how many warnings ThrottleTerminal prints before it
+// just keeps them quietly.
+const maxShownWarnings = 20
+
 // NewThrottleTerminal creates a new ThrottleTerminal that
-// throttles at the rate of msg/period.
+// throttles at the rate of msg/period. If stderr isn't a terminal, it's in
+// plain mode (see SetPlain); if it is, warnings and errors are in color
+// unless NO_COLOR is set.
 func NewThrottleTerminal(period time.Duration) *ThrottleTerminal {
+	isTTY := IsTerminal(os.Stderr)
 	t := &ThrottleTerminal{
 		lastStatus: time.Now(),
 		period: period,
 		startTime: time.Now(),
+		plain: !isTTY,
+		color: isTTY && os.Getenv("NO_COLOR") == "",
 	}
 	t.Len()
 	return t
 }
 
+// SetPlain turns plain mode on or off. In plain mode, progress lines are
+// ordinary newline-terminated lines, and only come every plainPeriod (or
+// when forced), so that output to a file or pipe stays readable.
+func (t *ThrottleTerminal) SetPlain(plain bool) *ThrottleTerminal {
+	t.plain = plain
+	return t
+}
+
+// SetColor turns ANSI color for warnings and errors on or off.
+func (t *ThrottleTerminal) SetColor(color bool) *ThrottleTerminal {
+	t.color = color
+	return t
+}
+
+// colorize wraps s in an ANSI color if color is on.
+func (t *ThrottleTerminal) colorize(ansi string, s string) string {
+	if !t.color {
+		return s
+	}
+	return ansi + s + ansiReset
+}
+
 // Progressf shows a progress message which will not advance past the
 // current terminal line; output rate is throttled by Ready().
 func (t *ThrottleTerminal) Progressf(format string, a ...interface{}) (n int, err error) {
-	if !t.Ready() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.ready() {
 		return 0, nil
 	}
+	msg := fmt.Sprintf(format, a...)
+	if t.busy != "" {
+		t.busy = msg
+	}
+	return t.progress(msg, "")
+}
 
+// progress draws a progress line, with suffix after the message (for the
+// heartbeat's spinner).
+func (t *ThrottleTerminal) progress(msg string, suffix string) (n int, err error) {
 	// Create a line of exactly the terminal length - this is so that progress messages
 	// don't leave garbage at their right-hand edge.
-	out := fmt.Sprintf(format, a...)
-	out = fmt.Sprintf("T+%.2f: %s", time.Since(t.startTime).Seconds(), out)
+	out := fmt.Sprintf("T+%.2f: %s%s", time.Since(t.startTime).Seconds(), msg, suffix)
+	if t.plain {
+		t.lastStatus = time.Now()
+		return fmt.Fprintf(os.Stderr, "%s\n", strings.TrimRight(out, " "))
+	}
 	out = StringFillToExact(out, t.lineMax)
 
 	// Reset Ready() timer and do unterminated line output (we rely on the user
@@ -87,9 +265,103 @@ func (t *ThrottleTerminal) Progressf(format string, a ...interface{}) (n int, er
 	return fmt.Fprintf(os.Stderr, "\r%s", out)
 }
 
+// Report shows p as a Progressf message, throttled the same way. A phase
+// with a total gets an ETA, from its rate over the last rateWindow.
+func (t *ThrottleTerminal) Report(p Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p.Total > 0 {
+		if t.rate == nil || t.ratePhase != p.Phase {
+			t.rate = NewRateMeter(rateWindow)
+			t.ratePhase = p.Phase
+		}
+		t.rate.Observe(p.Current, time.Now())
+	}
+	if !t.ready() {
+		return
+	}
+	if p.Total > 0 && p.ETA == 0 {
+		if eta, ok := t.rate.ETA(p.Total); ok {
+			p.ETA = eta
+		}
+	}
+	msg := p.String()
+	if t.busy != "" {
+		t.busy = msg
+	}
+	t.progress(msg, "")
+}
+
+// Busyf shows the message right away. If there's a heartbeat, it's redrawn
+// with a spinner while nothing else is shown, until done is called.
+func (t *ThrottleTerminal) Busyf(format string, a ...interface{}) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.busy = fmt.Sprintf(format, a...)
+	t.busyPhase += 1
+	phase := t.busyPhase
+	t.force()
+	t.progress(t.busy, "")
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.busyPhase == phase {
+			t.busy = ""
+		}
+	}
+}
+
+// spinner is the frames of the heartbeat's spinner.
+const spinner = `|/-\`
+
+// SetHeartbeat starts a heartbeat: during a Busyf phase, once nothing has
+// been shown for the period, the phase's message is shown again with a
+// spinner and the time so far, so that a phase that goes quiet doesn't look
+// hung. In plain mode it's a line every plainPeriod instead. The heartbeat
+// goes on until the program exits.
+func (t *ThrottleTerminal) SetHeartbeat(period time.Duration) *ThrottleTerminal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if period <= 0 || t.heartbeat > 0 {
+		return t
+	}
+	t.heartbeat = period
+	go func() {
+		for range time.Tick(period) {
+			t.beat()
+		}
+	}()
+	return t
+}
+
+// beat is one tick of the heartbeat.
+func (t *ThrottleTerminal) beat() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy == "" {
+		return
+	}
+	if t.plain {
+		if time.Since(t.lastStatus) >= plainPeriod {
+			t.progress(t.busy, " (still working)")
+		}
+		return
+	}
+	if time.Since(t.lastStatus) >= t.heartbeat {
+		t.spin = (t.spin + 1) % len(spinner)
+		t.progress(t.busy, " "+spinner[t.spin:t.spin+1])
+	}
+}
+
 // Printf unconditionally prints to the terminal, handling potential unterminated
 // lines by previous Progressf messages.
 func (t *ThrottleTerminal) Printf(format string, a ...interface{}) (n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.printf(format, a...)
+}
+
+func (t *ThrottleTerminal) printf(format string, a ...interface{}) (n int, err error) {
 	if t.unterminatedLine {
 		fmt.Fprintf(os.Stderr, "\n")
 		t.unterminatedLine = false
@@ -98,19 +370,57 @@ func (t *ThrottleTerminal) Printf(format string, a ...interface{}) (n int, err e
 	return fmt.Fprintf(os.Stderr, format, a...)
 }
 
-// Printf unconditionally prints to the terminal, handling potential unterminated
+// Warnf records a warning. The first few warnings are printed like Printf
+// does; after that they are only kept, so that a flood of warnings doesn't
+// bury the progress output.
+func (t *ThrottleTerminal) Warnf(format string, a ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	msg := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+	t.warnings = append(t.warnings, msg)
+	if len(t.warnings) <= maxShownWarnings {
+		t.printf("%s %s\n", t.colorize(ansiYellow, "warning:"), msg)
+	} else if len(t.warnings) == maxShownWarnings+1 {
+		t.printf("%s more warnings not shown\n", t.colorize(ansiYellow, "warning:"))
+	}
+}
+
+// Warnings returns the warnings issued so far.
+func (t *ThrottleTerminal) Warnings() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.warnings...)
+}
+
+// Fatalf unconditionally prints to the terminal, handling potential unterminated
 // lines by previous Progressf messages, and then exits the program
 func (t *ThrottleTerminal) Fatalf(format string, a ...interface{}) {
+	// Unlocked before Fatalf, which panics inside gsos.CatchFatal
+	t.mu.Lock()
 	if t.unterminatedLine {
 		fmt.Fprintf(os.Stderr, "\n")
 		t.unterminatedLine = false
 	}
-	log.Fatalf(format, a...)
+	t.busy = ""
+	t.mu.Unlock()
+	if t.color {
+		Fatalf("%s\n", t.colorize(ansiRed, strings.TrimRight(fmt.Sprintf(format, a...), "\n")))
+	}
+	Fatalf(format, a...)
 }
 
 // Ready returns true if Progressf will result in terminal output; this is controlled
 // by a duration set up at ThrottleTerminal creation.
 func (t *ThrottleTerminal) Ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ready()
+}
+
+func (t *ThrottleTerminal) ready() bool {
+	if t.plain {
+		return time.Since(t.lastStatus) >= plainPeriod
+	}
 	return time.Since(t.lastStatus) >= t.period
 }
 
@@ -118,14 +428,37 @@ func (t *ThrottleTerminal) Ready() bool {
 // the Terminal so that it can be used in a chain fashion, e.g.
 // "t.Force().Statusf(...)"
 func (t *ThrottleTerminal) Force() Terminal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.force()
+	return t
+}
+
+func (t *ThrottleTerminal) force() {
 	t.lastStatus = time.Now().Add(-t.period)
+	if t.plain {
+		t.lastStatus = time.Now().Add(-plainPeriod)
+	}
+}
+
+// SetWidth overrides the terminal width used for Progressf output; it takes
+// precedence over COLUMNS and the width of the tty. A width of 0 is ignored.
+func (t *ThrottleTerminal) SetWidth(width int) *ThrottleTerminal {
+	if width > 0 {
+		t.lineMax = width - 1
+	}
 	return t
 }
 
-// Len returns the allowed width of Progressf output.
+// Len returns the allowed width of Progressf output. In order of precedence,
+// the width is what was passed to SetWidth, the COLUMNS environment variable,
+// the width of the tty, or 80.
 func (t *ThrottleTerminal) Len() int {
 	if t.lineMax == 0 {
-		lineLen := TerminalWidth()
+		lineLen := EnvWidth()
+		if lineLen < 2 {
+			lineLen = TerminalWidth()
+		}
 		if lineLen < 2 {
 			lineLen = 80 // we don't expect this to fail, but let's not create a nightmare
 		}
@@ -133,3 +466,13 @@ func (t *ThrottleTerminal) Len() int {
 	}
 	return t.lineMax + 1
 }
+
+// EnvWidth returns the terminal width from the COLUMNS environment variable
+// (uses 0 as error return value).
+func EnvWidth() int {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 0 {
+		return 0
+	}
+	return width
+}
@@ -22,17 +22,20 @@ import (
 // Get rid of this code once the Go library supports nanosecond-level timing for all
 // relevant operating systems.
 
-// hiresTimestamp is a high-resolution time counter. On Windows 10, this has a resolution of
-// 1 to 20 nanoseconds.
+// HighresTimestamp is a high-resolution time counter, in Mach absolute time units.
+// On Intel Macs a unit is 1 nanosecond; on Apple silicon it's 125/3 nanoseconds.
 type HighresTimestamp uint64
 
-// getHiresTimestamp returns the current time as a HighresTimestamp
+// HighresTime returns the current time as a HighresTimestamp
 func HighresTime() HighresTimestamp {
 	return HighresTimestamp(C.mach_absolute_time())
 }
 
 // HighresTimestamp.Duration() converts a HighresTimestamp into a time.Duration value
-// (this looks horrible, but matches the Mach library code)
+// (this looks horrible, but matches the Mach library code). numer/denom scales
+// absolute time units to nanoseconds, which is what Linux timestamps already are.
+// Multiplying first keeps the precision, and only overflows for intervals of
+// well over a century.
 func (t HighresTimestamp) Duration() time.Duration {
 	return time.Duration(uint64(t) * uint64(tbinfo.numer) / uint64(tbinfo.denom))
 }
@@ -1,4 +1,4 @@
-// vcs-torture/gsos/os_linux.go
+// vcsloc/gsos/timing_linux.go
 // -- Linux-specific high-resolution timer
 
 // +build linux
@@ -9,25 +9,23 @@ import (
 	"time"
 )
 
-//go:noescape
-//go:linkname nanotime runtime.nanotime
-func nanotime() int64
-
 // ----------------------------------------------------------------------------------------------
 // Linux timing code (adapted from https://github.com/ScaleFT/monotime)
-// Linux Go has a nanosecond timer, so use it.
+// Linux Go has a nanosecond monotonic clock, so use it. Timestamps are nanoseconds
+// since the process started, so the scale factor that Mach and Windows need is 1.
+
+// timeBase is the zero point for HighresTimestamp values.
+var timeBase = time.Now()
 
-// hiresTimestamp is a high-resolution time counter. On Windows 10, this has a resolution of
-// 1 to 20 nanoseconds.
+// HighresTimestamp is a high-resolution time counter in nanoseconds.
 type HighresTimestamp uint64
 
-// getHiresTimestamp returns the current time as a HighresTimestamp
+// HighresTime returns the current time as a HighresTimestamp
 func HighresTime() HighresTimestamp {
-	return HighresTimestamp(nanotime())
+	return HighresTimestamp(time.Since(timeBase))
 }
 
 // HighresTimestamp.Duration() converts a HighresTimestamp into a time.Duration value
-// (this looks horrible, but matches the Mach library code)
 func (t HighresTimestamp) Duration() time.Duration {
-	return time.Duration(uint64(t) * uint64(tbinfo.numer) / uint64(tbinfo.denom)))
+	return time.Duration(t)
 }
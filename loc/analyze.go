@@ -0,0 +1,227 @@
+// vcsloc/loc/analyze.go
+
+package loc
+
+import (
+	"io"
+	"time"
+
+	"vcsloc/gsos"
+	"vcsloc/vcs"
+)
+
+// Options sets up an analysis: the repo, where the database goes, and the
+// same choices as the command line's options.
+type Options struct {
+	Repo string // path to the repository
+	Vcs string // "git" or "hg"
+	Db string // database directory, to carry the analysis over to the next run; "" keeps it in memory
+
+	Scope Scope // the part of the history to analyze; the zero Scope is all of it
+	NoStats bool // skip the per-file change stats, which is much faster
+	FirstParentStats bool // gather the change stats along the first-parent mainline only
+	NoStoreStats bool // don't keep the change stats in the database
+	StatStream io.Writer // if set, stats are streamed to it as JSON Lines while they're fetched
+	CommitStream io.Writer // if set, commits are streamed to it as JSON Lines while they're fetched, see SetCommitStream
+	ExcludePaths []string // globs for paths to leave out of the change stats, see PathFilter
+	Mailmap *Mailmap // canonicalizes authors, if set
+	Jobs int // how many external commands to run at once; 0 is one per CPU
+	Compress bool // gzip the database's large files; see SetCompressed
+	MaxObjects int // objects to take on without asking ConfirmLarge; 0 for no limit, see SetMaxObjects
+	ConfirmLarge func(objects int) bool
+
+	Terminal gsos.Terminal // progress and messages; nil for none
+	Verbose bool
+}
+
+// Result is what an analysis found, as plain data.
+type Result struct {
+	Fingerprint string // see (*VcsDb2).Fingerprint
+	Scope Scope
+	Commits []CommitInfo // in log order, newest first
+	Refs []vcs.Ref
+	Roots []vcs.Hash // commits with no parents
+	Tips []vcs.Hash // commits with no children, where each line of history ends
+	Authors []AuthorStat
+	Committers []AuthorStat
+	Warnings []string // from this run
+}
+
+// CommitInfo is one commit of a Result.
+type CommitInfo struct {
+	Hash vcs.Hash
+	Parents []vcs.Hash
+	Children []vcs.Hash
+	AuthorName string
+	AuthorEmail string
+	AuthorTime time.Time // in the author's timezone
+	NoAuthor bool // logged without an author; AuthorName and AuthorEmail are "(unknown)" and "unknown"
+	CommitterName string
+	CommitterEmail string
+	CommitterTime time.Time // in UTC
+	Subject string
+	Body string
+	Changes []ChangeInfo // nil without change stats
+}
+
+// ChangeInfo is one file changed by a commit.
+type ChangeInfo struct {
+	Path string
+	OldPath string // the path before a rename or copy
+	Add int
+	Remove int
+	Binary bool
+	Kind string // add, delete, rename, copy or modify
+}
+
+// Analyze brings the database in opts up to date with the repo, as the
+// analyze verb does, and returns what's in it. Errors that would end the
+// command-line tool are returned instead, as long as they happen on the
+// calling goroutine (see gsos.CatchFatal).
+func Analyze(opts Options) (*Result, error) {
+	var db *VcsDb2
+	var err error
+	if opts.Db != "" {
+		db, err = OpenDb(opts.Db, opts.Repo, opts.Vcs)
+	} else {
+		db, err = NewMemDb(opts.Repo, opts.Vcs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Unlock() // if it fails, without saving
+
+	terminal := opts.Terminal
+	if terminal == nil {
+		terminal = gsos.NewNullTerminal()
+	}
+	work := NewAnalyzer(time.Now(), opts.Verbose, terminal, db)
+	if err := work.SetOptions(opts); err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	var innerErr error
+	err = gsos.CatchFatal(func() {
+		work.UpdateRepo()
+		if innerErr = db.Save(); innerErr != nil {
+			return
+		}
+		result, innerErr = db.Result()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if innerErr != nil {
+		return nil, innerErr
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	result.Warnings = terminal.Warnings()
+	return result, nil
+}
+
+// SetOptions sets up the analyzer from opts; the repo and database options
+// are for Analyze, and are ignored, except that Compress turns on the
+// database's compression.
+func (work *Analyzer) SetOptions(opts Options) error {
+	exclude, err := NewPathFilter(opts.ExcludePaths)
+	if err != nil {
+		return err
+	}
+	if opts.Compress {
+		if err := work.db.SetCompressed(true); err != nil {
+			return err
+		}
+	}
+	work.SetScope(opts.Scope)
+	work.SetStats(!opts.NoStats)
+	work.SetFirstParentStats(opts.FirstParentStats)
+	work.SetStoreStats(!opts.NoStoreStats)
+	work.SetJobs(opts.Jobs)
+	work.SetMaxObjects(opts.MaxObjects, opts.ConfirmLarge)
+	work.SetExcludePaths(exclude)
+	if opts.StatStream != nil {
+		work.SetStatStream(opts.StatStream)
+	}
+	if opts.CommitStream != nil {
+		work.SetCommitStream(opts.CommitStream)
+	}
+	if opts.Mailmap != nil {
+		work.SetMailmap(opts.Mailmap)
+	}
+	return nil
+}
+
+// Result returns everything in the database as a Result. The commits are all
+// loaded at once, with their change stats, so this takes memory in
+// proportion to the repo; the reports stream through the commits instead.
+func (db *VcsDb2) Result() (*Result, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.refs.Load(db); err != nil {
+		return nil, err
+	}
+	roots, err := db.Roots()
+	if err != nil {
+		return nil, err
+	}
+	authors, err := db.AuthorStats(ByAuthor)
+	if err != nil {
+		return nil, err
+	}
+	committers, err := db.AuthorStats(ByCommitter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Fingerprint: db.Fingerprint(),
+		Scope: db.Scope(),
+		Refs: db.refs.refs,
+		Roots: roots,
+		Authors: authors,
+		Committers: committers,
+	}
+	err = db.commits.ScanCommits(db, func(c *Commit) error {
+		children := db.graph.graph[c.hash].children
+		info := CommitInfo{
+			Hash: c.hash,
+			Parents: c.parents,
+			Children: children,
+			AuthorName: c.authorName,
+			AuthorEmail: c.authorEmail,
+			AuthorTime: c.AuthorTime(),
+			NoAuthor: c.noAuthor,
+			CommitterName: c.committerName,
+			CommitterEmail: c.committerEmail,
+			CommitterTime: c.CommitterTime(),
+			Subject: c.subject,
+			Body: c.body,
+		}
+		for i := range c.changes {
+			ch := &c.changes[i]
+			info.Changes = append(info.Changes, ChangeInfo{
+				Path: ch.path,
+				OldPath: ch.oldPath,
+				Add: ch.add,
+				Remove: ch.remove,
+				Binary: ch.binary,
+				Kind: ch.kind(),
+			})
+		}
+		result.Commits = append(result.Commits, info)
+		if len(children) == 0 {
+			result.Tips = append(result.Tips, c.hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,102 @@
+// vcsloc/loc/analyze_test.go
+
+package loc
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"vcsloc/gsos"
+	"vcsloc/vcs"
+)
+
+// A database that can't be saved has to give Analyze an error, not a nil
+// result. The roots file can't be written over a directory in its way, even
+// by root.
+func TestAnalyzeSaveFails(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	repo := t.TempDir()
+	if err := vcs.GenerateGitRepo(repo, vcs.GenOpts{Commits: 10}); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "db")
+	db, err := OpenDb(dbPath, repo, "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dbPath, "roots.tmp", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Analyze(Options{Repo: repo, Vcs: "git", Db: dbPath})
+	if err == nil {
+		t.Fatalf("no error from a database that can't be saved (result %v)", result)
+	}
+	if result != nil {
+		t.Errorf("result with an error: %v", result)
+	}
+}
+
+// A database from before the refs list signature gets one on the next run,
+// with the fingerprint of its refs, not of none.
+func TestAnalyzeBackfillsRefsSignature(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	repo := t.TempDir()
+	if err := vcs.GenerateGitRepo(repo, vcs.GenOpts{Commits: 10, Branches: 2}); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Repo: repo, Vcs: "git", Db: filepath.Join(t.TempDir(), "db")}
+	want, err := Analyze(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoPath := filepath.Join(opts.Db, ".info")
+	info, err := os.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(info), "\n") {
+		if !strings.HasPrefix(line, "refsListSignature=") {
+			lines = append(lines, line)
+		}
+	}
+	if err := os.WriteFile(infoPath, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The info is saved while finding the database up to date, which
+	// doesn't need the refs for itself
+	db, err := OpenDb(opts.Db, repo, "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	work := NewAnalyzer(time.Now(), false, gsos.NewNullTerminal(), db)
+	if err := work.SetOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	work.UpdateRepo()
+	info, err = os.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig := work.Backend().RefsSignature(); !strings.Contains(string(info), "refsListSignature="+sig+"\n") {
+		t.Errorf("refs list signature isn't %s:\n%s", sig, info)
+	}
+	if !strings.Contains(string(info), "fingerprint="+want.Fingerprint+"\n") {
+		t.Errorf("fingerprint isn't %s:\n%s", want.Fingerprint, info)
+	}
+}
@@ -0,0 +1,297 @@
+// vcsloc/loc/authors.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Role picks which identity of a commit the author reports go by: the
+// author, who wrote the change, or the committer, who landed it. The two
+// differ for cherry-picks, rebases and patches applied by a maintainer.
+type Role int
+
+const (
+	ByAuthor Role = iota
+	ByCommitter
+)
+
+// identity returns the name, email and unix time of c's author or committer.
+func (c *Commit) identity(role Role) (string, string, int) {
+	if role == ByCommitter {
+		return c.committerName, c.committerEmail, c.committerTimestamp
+	}
+	return c.authorName, c.authorEmail, c.timestamp
+}
+
+// The author of a commit logged with no author name or email, as happens in
+// histories imported from other systems. Those commits would otherwise all
+// be one author with an empty identity.
+const (
+	unknownAuthorName = "(unknown)"
+	unknownAuthorEmail = "unknown"
+)
+
+// markNoAuthor gives c the unknown author if it has no author name or
+// email, and flags it. A commit from the database already has the unknown
+// author, or from databases before there was one, an empty identity.
+func (c *Commit) markNoAuthor() {
+	name, email := c.RawAuthor()
+	switch {
+	case name == "" && email == "":
+		c.authorName, c.authorEmail = unknownAuthorName, unknownAuthorEmail
+	case name != unknownAuthorName || email != unknownAuthorEmail:
+		return
+	}
+	c.noAuthor = true
+}
+
+// NoAuthor is true if c was logged without an author; its author is
+// "(unknown) <unknown>" instead.
+func (c *Commit) NoAuthor() bool {
+	return c.noAuthor
+}
+
+// AuthorIdentity is one distinct name/email pair seen in the commits.
+type AuthorIdentity struct {
+	Name string
+	Email string
+	Commits int
+}
+
+// String formats the identity the way git and mailmap files do.
+func (a AuthorIdentity) String() string {
+	return fmt.Sprintf("%s <%s>", a.Name, a.Email)
+}
+
+// AuthorIdentities returns each distinct author (or committer) name/email
+// pair with its commit count, sorted by commit count (descending) and then by
+// identity.
+func (db *VcsDb2) AuthorIdentities(role Role) ([]AuthorIdentity, error) {
+	if err := db.commits.Load(db); err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	var idents []AuthorIdentity
+	for i := range db.commits.commits {
+		name, email, _ := db.commits.commits[i].identity(role)
+		key := name + "\x00" + email
+		n, ok := index[key]
+		if !ok {
+			n = len(idents)
+			index[key] = n
+			idents = append(idents, AuthorIdentity{Name: name, Email: email})
+		}
+		idents[n].Commits += 1
+	}
+
+	sort.Slice(idents, func(i, j int) bool {
+		if idents[i].Commits != idents[j].Commits {
+			return idents[i].Commits > idents[j].Commits
+		}
+		return idents[i].String() < idents[j].String()
+	})
+	return idents, nil
+}
+
+// AuthorStat is the activity of one author, identified by email.
+type AuthorStat struct {
+	Name string // the name used most with the email
+	Email string
+	Commits int
+	First int // unix time of the first commit
+	Last int // unix time of the last commit
+	ActiveDays int // number of days (UTC) with a commit
+}
+
+// AuthorStats sums up each author's commits. Identities are coalesced by
+// email, ignoring case, so a name spelled two ways is one author; use a
+// mailmap for people with more than one email. Commits with no author
+// aren't anyone's (see Commit.NoAuthor). With ByCommitter, it's the
+// committers' commits, by when they were committed. The stats are sorted by
+// commit count (descending), then by name and email.
+func (db *VcsDb2) AuthorStats(role Role) ([]AuthorStat, error) {
+	stats, _, err := db.authorStats(role)
+	return stats, err
+}
+
+// authorStats does the work of AuthorStats, and also returns how many
+// commits had no author.
+func (db *VcsDb2) authorStats(role Role) ([]AuthorStat, int, error) {
+	type author struct {
+		AuthorStat
+		names map[string]int
+		days map[string]bool
+	}
+	byEmail := make(map[string]*author)
+	var noAuthor int
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		if role == ByAuthor && c.noAuthor {
+			noAuthor += 1
+			return nil
+		}
+		name, email, timestamp := c.identity(role)
+		key := strings.ToLower(email)
+		a, ok := byEmail[key]
+		if !ok {
+			a = &author{names: make(map[string]int), days: make(map[string]bool)}
+			a.Email = email
+			a.First, a.Last = timestamp, timestamp
+			byEmail[key] = a
+		}
+		a.Commits += 1
+		a.names[name] += 1
+		a.days[time.Unix(int64(timestamp), 0).UTC().Format("2006-01-02")] = true
+		if timestamp < a.First {
+			a.First = timestamp
+		}
+		if timestamp > a.Last {
+			a.Last = timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stats := make([]AuthorStat, 0, len(byEmail))
+	for _, a := range byEmail {
+		for name, n := range a.names {
+			if n > a.names[a.Name] || (n == a.names[a.Name] && name < a.Name) {
+				a.Name = name
+			}
+		}
+		a.ActiveDays = len(a.days)
+		stats = append(stats, a.AuthorStat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Commits != stats[j].Commits {
+			return stats[i].Commits > stats[j].Commits
+		}
+		if stats[i].Name != stats[j].Name {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].Email < stats[j].Email
+	})
+	return stats, noAuthor, nil
+}
+
+// WriteAuthorStats writes the author stats, one author per line: commits,
+// active days, first and last commit dates, and the author (or committer).
+// The commits with no author, if any, are counted on a line of their own at
+// the end.
+func (db *VcsDb2) WriteAuthorStats(w io.Writer, role Role) error {
+	stats, noAuthor, err := db.authorStats(role)
+	if err != nil {
+		return err
+	}
+	for _, a := range stats {
+		first := time.Unix(int64(a.First), 0).UTC().Format("2006-01-02")
+		last := time.Unix(int64(a.Last), 0).UTC().Format("2006-01-02")
+		if _, err := fmt.Fprintf(w, "%7d commits %5d days  %s to %s  %s <%s>\n", a.Commits, a.ActiveDays, first, last, a.Name, a.Email); err != nil {
+			return err
+		}
+	}
+	if noAuthor > 0 {
+		if _, err := fmt.Fprintf(w, "%7d commits with no author\n", noAuthor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SuggestMailmap clusters author identities that are probably the same person and
+// writes a suggested mailmap to w. Two identities are clustered if they have the
+// same normalized name (case, punctuation and spacing ignored) or the same email
+// local-part (case and "+tag" suffix ignored). Each cluster maps onto its most
+// frequent identity. Nothing is applied; the output is meant to be reviewed and
+// then fed back with --mailmap.
+func (db *VcsDb2) SuggestMailmap(w io.Writer) error {
+	idents, err := db.AuthorIdentities(ByAuthor)
+	if err != nil {
+		return err
+	}
+
+	// Union-find over identity indexes, joined on shared keys
+	parent := make([]int, len(idents))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owner := make(map[string]int)
+	join := func(key string, i int) {
+		if key == "" {
+			return
+		}
+		if j, ok := owner[key]; ok {
+			// idents is sorted most-frequent first, so the lower index wins
+			ri, rj := find(i), find(j)
+			if ri < rj {
+				parent[rj] = ri
+			} else {
+				parent[ri] = rj
+			}
+			return
+		}
+		owner[key] = i
+	}
+
+	for i, id := range idents {
+		if id.Name == unknownAuthorName && id.Email == unknownAuthorEmail {
+			continue // commits with no author, not someone
+		}
+		join("name:"+normalizeAuthorName(id.Name), i)
+		join("email:"+emailLocalPart(id.Email), i)
+	}
+
+	// Emit a mailmap line for each non-canonical identity, in frequency order
+	for i, id := range idents {
+		root := find(i)
+		if root == i {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", idents[root], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeAuthorName lowercases a name and keeps only letters and digits,
+// so "Jane Doe", "jane.doe" and "JANE  DOE" all compare equal.
+func normalizeAuthorName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// emailLocalPart returns the lowercased part of an email before the "@",
+// without any "+tag" suffix.
+func emailLocalPart(email string) string {
+	local := strings.ToLower(email)
+	if pos := strings.Index(local, "@"); pos != -1 {
+		local = local[:pos]
+	}
+	if pos := strings.Index(local, "+"); pos != -1 {
+		local = local[:pos]
+	}
+	return local
+}
@@ -0,0 +1,186 @@
+// vcsloc/loc/binary.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// BinaryStats is how the binary files changed, in a commit or over the
+// history. Line counts don't see binary files at all, so these are what show
+// a commit that dumps images or jars into the repo.
+type BinaryStats struct {
+	BinaryFilesAdded int
+	BinaryFilesDeleted int
+	BinaryFilesModified int // changed or renamed
+	BinaryBytesDelta int64 // how many bytes bigger the binary files got; negative if they shrank
+}
+
+// Add adds in the counts of other.
+func (s *BinaryStats) Add(other BinaryStats) {
+	s.BinaryFilesAdded += other.BinaryFilesAdded
+	s.BinaryFilesDeleted += other.BinaryFilesDeleted
+	s.BinaryFilesModified += other.BinaryFilesModified
+	s.BinaryBytesDelta += other.BinaryBytesDelta
+}
+
+// CommitBinaryStats is the binary changes of one commit.
+type CommitBinaryStats struct {
+	Hash vcs.Hash
+	Subject string
+	BinaryStats
+}
+
+// rawBlobs is the blobs at a path before and after a commit, from "git
+// diff-tree --raw"; a blob that isn't there is all zeros.
+type rawBlobs struct {
+	old vcs.Hash
+	new vcs.Hash
+}
+
+// BinaryChanges returns the binary changes of each commit that has them, in
+// log order. The change stats only say a file is binary, so the sizes come
+// from the repo: one "git diff-tree --stdin" finds the blobs of the binary
+// files, and one "git cat-file --batch-check" their sizes. Merges are left
+// out, since their changes were already counted in the commits that were
+// merged. The database needs change stats (see ErrNoStats).
+func (work *Analyzer) BinaryChanges() ([]CommitBinaryStats, error) {
+	if work.Backend().Name() != "git" {
+		return nil, fmt.Errorf("binary sizes are only supported for git repos")
+	}
+	db := work.db
+	if haveStats, err := db.HaveStats(); err != nil {
+		return nil, err
+	} else if !haveStats {
+		return nil, ErrNoStats
+	}
+	if haveLines, err := db.HaveLineCounts(); err != nil {
+		return nil, err
+	} else if !haveLines {
+		return nil, ErrNoLineCounts
+	}
+
+	type binaryCommit struct {
+		hash vcs.Hash
+		subject string
+		changes []Change
+	}
+	var commits []binaryCommit
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		if len(c.parents) > 1 {
+			return nil
+		}
+		var changes []Change
+		for _, ch := range c.changes {
+			if ch.binary {
+				changes = append(changes, ch)
+			}
+		}
+		if len(changes) > 0 {
+			commits = append(commits, binaryCommit{c.hash, c.subject, changes})
+		}
+		return nil
+	})
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+
+	// Each commit is its own hash, then a line for each file it changed:
+	// ":<old mode> <new mode> <old blob> <new blob> <status>\t<path>"
+	defer work.terminal.Busyf("Finding binary blobs...")()
+	var input strings.Builder
+	for _, c := range commits {
+		input.WriteString(string(c.hash))
+		input.WriteString("\n")
+	}
+	blobs := make(map[vcs.Hash]map[string]rawBlobs, len(commits))
+	var current map[string]rawBlobs
+	outCb := func(line string) {
+		if !strings.HasPrefix(line, ":") {
+			current = make(map[string]rawBlobs)
+			blobs[vcs.Hash(line)] = current
+			return
+		}
+		tab := strings.Index(line, "\t")
+		if tab == -1 || current == nil {
+			return
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 5 {
+			return
+		}
+		current[vcs.GitUnquotePath(line[tab+1:])] = rawBlobs{old: vcs.Hash(fields[2]), new: vcs.Hash(fields[3])}
+	}
+	vcs.RunGitCommandIncrementalStdin(strings.NewReader(input.String()), outCb, nil, db.hdr.repoPath, nil,
+		"diff-tree", "--stdin", "-r", "--raw", "--no-renames", "--root", "--no-abbrev")
+
+	var hashes []vcs.Hash
+	for _, files := range blobs {
+		for _, b := range files {
+			hashes = append(hashes, b.old, b.new)
+		}
+	}
+	sizes, _, err := vcs.GitObjectSizes(db.hdr.repoPath, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("binary sizes: %w", err)
+	}
+
+	stats := make([]CommitBinaryStats, 0, len(commits))
+	for _, c := range commits {
+		cs := CommitBinaryStats{Hash: c.hash, Subject: c.subject}
+		files := blobs[c.hash]
+		for _, ch := range c.changes {
+			oldPath := ch.path
+			if ch.rename {
+				oldPath = ch.oldPath
+			}
+			switch {
+			case ch.create:
+				cs.BinaryFilesAdded += 1
+			case ch.delete:
+				cs.BinaryFilesDeleted += 1
+			default:
+				cs.BinaryFilesModified += 1
+			}
+			// A blob that's all zeros (not there) isn't in sizes, so it's 0
+			cs.BinaryBytesDelta += sizes[files[ch.path].new] - sizes[files[oldPath].old]
+		}
+		stats = append(stats, cs)
+	}
+	return stats, nil
+}
+
+// WriteBinaryReport writes the commits with binary changes, the most bytes
+// added first, one per line: the bytes delta, the binary files added,
+// deleted and modified, the commit and its subject. It's only the top
+// commits, unless top is 0. The last line is the totals over every commit.
+func (work *Analyzer) WriteBinaryReport(w io.Writer, top int) error {
+	stats, err := work.BinaryChanges()
+	if err != nil {
+		return err
+	}
+	var total BinaryStats
+	for _, cs := range stats {
+		total.Add(cs.BinaryStats)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].BinaryBytesDelta > stats[j].BinaryBytesDelta })
+	if top > 0 && len(stats) > top {
+		stats = stats[:top]
+	}
+	prefixLen := work.db.AbbrevLen()
+	for _, cs := range stats {
+		if _, err := fmt.Fprintf(w, "%+14d bytes %5d added %5d deleted %5d modified  %s %s\n", cs.BinaryBytesDelta,
+			cs.BinaryFilesAdded, cs.BinaryFilesDeleted, cs.BinaryFilesModified, cs.Hash.Abbrev(prefixLen), cs.Subject); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%+14d bytes %5d added %5d deleted %5d modified  total\n", total.BinaryBytesDelta,
+		total.BinaryFilesAdded, total.BinaryFilesDeleted, total.BinaryFilesModified)
+	return err
+}
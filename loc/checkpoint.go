@@ -0,0 +1,140 @@
+// vcsloc/loc/checkpoint.go
+
+package loc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// checkpointBatch is how many commits a full fetch gets between checkpoints.
+const checkpointBatch = 5000
+
+// VcsCheckpoint records how far a full fetch of the commits got, so that an
+// interrupted fetch (of a huge repo, or over a flaky connection) carries on
+// where it stopped rather than starting over. The commits fetched so far are
+// kept in batch files, in log order, until the fetch finishes and they're
+// saved with the rest of the commits.
+type VcsCheckpoint struct {
+	signature string // the fetch this is for, see checkpointSignature
+	fetched int // number of commits in the batch files
+	lastHash vcs.Hash // the last of them
+	files []string // the batch files, in order
+
+	name string // filename data is persisted under
+}
+
+func NewVcsCheckpoint() *VcsCheckpoint {
+	return &VcsCheckpoint{name: ".checkpoint"}
+}
+
+func (h *VcsCheckpoint) Load(db *VcsDb2) error {
+	*h = VcsCheckpoint{name: h.name}
+	return db.doLoadData(h.name, func(line string) error {
+		if !getkvstr(line, &h.signature, "signature=") &&
+			!getkvint(line, &h.fetched, "fetched=") &&
+			!getkvhash(line, &h.lastHash, "lastHash=") &&
+			!getkvstrlist(line, &h.files, "files=") {
+				return fmt.Errorf("invalid data in VcsCheckpoint: %s", line)
+			}
+		return nil
+	})
+}
+
+func (h *VcsCheckpoint) Save(db *VcsDb2) error {
+	return db.doSaveDataLines(h.name, []string{
+		fmt.Sprintf("signature=%s\n", h.signature),
+		fmt.Sprintf("fetched=%d\n", h.fetched),
+		fmt.Sprintf("lastHash=%s\n", h.lastHash),
+		fmt.Sprintf("files=%s\n", strings.Join(h.files, ", ")),
+	})
+}
+
+// (*VcsCheckpoint).Clear removes the checkpoint and its batch files. The
+// checkpoint goes first, so it never names files that are gone.
+func (h *VcsCheckpoint) Clear(db *VcsDb2) error {
+	err := db.removeData(h.name)
+	for _, file := range h.files {
+		if rerr := db.removeData(file); err == nil {
+			err = rerr
+		}
+	}
+	*h = VcsCheckpoint{name: h.name}
+	return err
+}
+
+// (*VcsCheckpoint).AddBatch writes the commits fetched since the last batch
+// to a new batch file, and then records them in the checkpoint.
+func (h *VcsCheckpoint) AddBatch(db *VcsDb2, signature string, commits []Commit) error {
+	if h.signature != signature {
+		if err := h.Clear(db); err != nil {
+			return err
+		}
+		h.signature = signature
+	}
+
+	file := fmt.Sprintf("checkpoint.%d", len(h.files))
+	start := h.fetched
+	var sb strings.Builder
+	err := db.doSaveDataN(file, len(commits)-start, func(i int) string {
+		formatCommit(&sb, start+i, &commits[start+i])
+		joined := sb.String()
+		sb.Reset()
+		return joined
+	})
+	if err != nil {
+		return err
+	}
+
+	h.files = append(h.files, file)
+	h.fetched = len(commits)
+	h.lastHash = commits[len(commits)-1].hash
+	return h.Save(db)
+}
+
+// (*VcsCheckpoint).Resume loads the checkpoint and returns the commits it
+// has, if it's for the same fetch: the same signature, and the same commits
+// at the start of hashes (which are in log order). Otherwise the checkpoint
+// is cleared, and there's nothing to resume.
+func (h *VcsCheckpoint) Resume(db *VcsDb2, signature string, hashes []vcs.Hash) []Commit {
+	if err := h.Load(db); err != nil || h.fetched == 0 {
+		h.Clear(db)
+		return nil
+	}
+	if h.signature != signature || h.fetched > len(hashes) || hashes[h.fetched-1] != h.lastHash {
+		h.Clear(db)
+		return nil
+	}
+
+	var commits []Commit
+	batches := &VcsCommits{commitFiles: h.files}
+	err := batches.scanCommitFiles(db, func(c *Commit) error {
+		commits = append(commits, *c)
+		return nil
+	})
+	if err != nil || len(commits) != h.fetched || commits[len(commits)-1].hash != h.lastHash {
+		h.Clear(db)
+		return nil
+	}
+	return commits
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// checkpointSignature identifies a full fetch of the commits: which commits
+// it gets, and what it gets for each of them.
+func (work *Analyzer) checkpointSignature() string {
+	sum := sha256.New()
+	for _, hash := range work.db.commits.hashes {
+		fmt.Fprintf(sum, "%s\n", hash)
+	}
+	fmt.Fprintf(sum, "stats=%t\n", work.stats)
+	fmt.Fprintf(sum, "firstParentStats=%t\n", work.firstParentStats)
+	fmt.Fprintf(sum, "excludePaths=%s\n", strings.Join(work.exclude.Patterns(), ", "))
+	fmt.Fprintf(sum, "mailmap=%s\n", work.mailmapSignature())
+	return hex.EncodeToString(sum.Sum(nil))[:16]
+}
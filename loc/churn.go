@@ -0,0 +1,120 @@
+// vcsloc/loc/churn.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Churn is the lines added and removed in a file over the analyzed history,
+// and the number of commits that changed it.
+type Churn struct {
+	Add int
+	Remove int
+	Commits int
+}
+
+// Total is the lines added and removed.
+func (ch Churn) Total() int {
+	return ch.Add + ch.Remove
+}
+
+// FileChurn totals the changes to each file, keyed by the file's last path:
+// changes made before a rename are counted under the name it was renamed to.
+// Merges are left out, since their changes were already counted in the
+// commits that were merged. Copies start a new file.
+func (db *VcsDb2) FileChurn() (map[string]Churn, error) {
+	if haveStats, err := db.HaveStats(); err != nil {
+		return nil, err
+	} else if !haveStats {
+		return nil, ErrNoStats
+	}
+	if haveLines, err := db.HaveLineCounts(); err != nil {
+		return nil, err
+	} else if !haveLines {
+		return nil, ErrNoLineCounts
+	}
+
+	type commitChanges struct {
+		timestamp int
+		changes []Change
+	}
+	var commits []commitChanges
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		if len(c.parents) <= 1 && len(c.changes) > 0 {
+			commits = append(commits, commitChanges{c.timestamp, c.changes})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first, so that a rename is seen before the changes to the file
+	// under its old name. A path that's reused after a rename is seen before
+	// the rename, so its changes stay with it.
+	sort.SliceStable(commits, func(i, j int) bool { return commits[i].timestamp > commits[j].timestamp })
+
+	renamedTo := make(map[string]string) // old path to last path
+	lastPath := func(path string) string {
+		if to, ok := renamedTo[path]; ok {
+			return to
+		}
+		return path
+	}
+
+	churn := make(map[string]Churn)
+	for _, c := range commits {
+		for i := range c.changes {
+			ch := &c.changes[i]
+			path := lastPath(ch.path)
+			total := churn[path]
+			total.Add += ch.add
+			total.Remove += ch.remove
+			total.Commits += 1
+			churn[path] = total
+		}
+
+		// Renames apply to older commits, not to the rest of this one
+		for i := range c.changes {
+			if ch := &c.changes[i]; ch.rename {
+				renamedTo[ch.oldPath] = lastPath(ch.path)
+			}
+		}
+	}
+	return churn, nil
+}
+
+// WriteChurnReport writes the top files by churn (lines added plus removed),
+// or all of them if top is 0.
+func (db *VcsDb2) WriteChurnReport(w io.Writer, top int) error {
+	churn, err := db.FileChurn()
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(churn))
+	for path := range churn {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := churn[paths[i]], churn[paths[j]]
+		if a.Total() != b.Total() {
+			return a.Total() > b.Total()
+		}
+		return paths[i] < paths[j]
+	})
+	if top > 0 && len(paths) > top {
+		paths = paths[:top]
+	}
+
+	for _, path := range paths {
+		ch := churn[path]
+		if _, err := fmt.Fprintf(w, "%10d  +%-8d -%-8d %6d commits  %s\n", ch.Total(), ch.Add, ch.Remove, ch.Commits, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// vcsloc/loc/classify.go
+
+package loc
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+)
+
+// LineStats is the lines of a file, or of a whole tree, by kind. A line
+// with code and a comment on it is code.
+type LineStats struct {
+	Code int
+	Comment int
+	Blank int
+}
+
+// Add adds in the counts of other.
+func (s *LineStats) Add(other LineStats) {
+	s.Code += other.Code
+	s.Comment += other.Comment
+	s.Blank += other.Blank
+}
+
+// LineClassifier sorts the lines of a source file in one language into
+// code, comments and blank lines.
+type LineClassifier interface {
+	Classify(r io.Reader) LineStats
+}
+
+// classifiers is the LineClassifier for each language, and languages is the
+// language of each file extension; see RegisterClassifier.
+var (
+	classifiers = make(map[string]LineClassifier)
+	languages = make(map[string]string)
+)
+
+// RegisterClassifier makes c the classifier for lang, and lang the language
+// of files with the extensions exts (e.g. ".go"). It replaces what was
+// there before, so the built-in languages can be changed too.
+func RegisterClassifier(lang string, exts []string, c LineClassifier) {
+	classifiers[lang] = c
+	for _, ext := range exts {
+		languages[strings.ToLower(ext)] = lang
+	}
+}
+
+// LanguageOf returns the language of a file from its extension, or "" if
+// it's not one with a classifier.
+func LanguageOf(p string) string {
+	return languages[strings.ToLower(path.Ext(p))]
+}
+
+// CountFile counts the lines of a file in lang by kind. A language without
+// a classifier has only code and blank lines.
+func CountFile(r io.Reader, lang string) LineStats {
+	if c, ok := classifiers[lang]; ok {
+		return c.Classify(r)
+	}
+	var stats LineStats
+	forEachLine(r, func(line string) {
+		if strings.TrimSpace(line) == "" {
+			stats.Blank += 1
+		} else {
+			stats.Code += 1
+		}
+	})
+	return stats
+}
+
+// forEachLine calls fn with each line of r, without its line ending. Lines
+// can be any length, as in minified files.
+func forEachLine(r io.Reader, fn func(line string)) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			fn(strings.TrimRight(line, "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func init() {
+	RegisterClassifier("go", []string{".go"}, goSyntax)
+	RegisterClassifier("c", []string{".c", ".h"}, cSyntax)
+	RegisterClassifier("c++", []string{".cc", ".cpp", ".cxx", ".c++", ".hh", ".hpp", ".hxx", ".h++"}, cSyntax)
+	RegisterClassifier("python", []string{".py", ".pyw"}, pythonSyntax)
+	RegisterClassifier("shell", []string{".sh", ".bash", ".zsh", ".ksh"}, shellSyntax)
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// syntax is a LineClassifier for a language whose comments and strings are
+// set off by fixed markers. Markers inside strings and comments are skipped
+// over, so a "//" in a string isn't a comment, and a "*/" in one doesn't end
+// a comment.
+type syntax struct {
+	lineComments []string
+	blockComments []delims
+	strings []delims // longest opening first, e.g. `"""` before `"`
+	wordComments bool // a line comment only starts a word, as "#" in shell, where "$#" isn't one
+}
+
+// delims are the markers around a block comment or a string.
+type delims struct {
+	open string
+	close string
+	escapes bool // a backslash escapes the next character
+	multiline bool // it can go on over more than one line
+}
+
+var (
+	goSyntax = &syntax{
+		lineComments: []string{"//"},
+		blockComments: []delims{{open: "/*", close: "*/", multiline: true}},
+		strings: []delims{
+			{open: "`", close: "`", multiline: true},
+			{open: `"`, close: `"`, escapes: true},
+			{open: "'", close: "'", escapes: true},
+		},
+	}
+	cSyntax = &syntax{
+		lineComments: []string{"//"},
+		blockComments: []delims{{open: "/*", close: "*/", multiline: true}},
+		strings: []delims{
+			{open: `"`, close: `"`, escapes: true},
+			{open: "'", close: "'", escapes: true},
+		},
+	}
+	pythonSyntax = &syntax{
+		lineComments: []string{"#"},
+		strings: []delims{
+			{open: `"""`, close: `"""`, escapes: true, multiline: true},
+			{open: "'''", close: "'''", escapes: true, multiline: true},
+			{open: `"`, close: `"`, escapes: true},
+			{open: "'", close: "'", escapes: true},
+		},
+	}
+	shellSyntax = &syntax{
+		lineComments: []string{"#"},
+		strings: []delims{
+			{open: `"`, close: `"`, escapes: true, multiline: true},
+			{open: "'", close: "'", multiline: true},
+		},
+		wordComments: true,
+	}
+)
+
+// Classify goes through the file a character at a time, keeping track of
+// the comment or string that's open, so that it carries over to the next
+// line. Docstrings are strings, and so are code.
+func (s *syntax) Classify(r io.Reader) LineStats {
+	var stats LineStats
+	var open *delims // the comment or string that's open, if any
+	var openComment bool
+
+	forEachLine(r, func(line string) {
+		if strings.TrimSpace(line) == "" {
+			stats.Blank += 1
+			return
+		}
+
+		var code, comment bool
+		for i := 0; i < len(line); {
+			if open != nil {
+				if openComment {
+					comment = true
+				} else {
+					code = true
+				}
+				switch {
+				case open.escapes && line[i] == '\\':
+					i += 2
+				case strings.HasPrefix(line[i:], open.close):
+					i += len(open.close)
+					open = nil
+				default:
+					i += 1
+				}
+				continue
+			}
+
+			if isSpace(line[i]) {
+				i += 1
+				continue
+			}
+			if d := matchDelims(line[i:], s.blockComments); d != nil {
+				open, openComment = d, true
+				comment = true
+				i += len(d.open)
+				continue
+			}
+			if s.isLineComment(line, i) {
+				comment = true
+				break
+			}
+			if d := matchDelims(line[i:], s.strings); d != nil {
+				open, openComment = d, false
+				code = true
+				i += len(d.open)
+				continue
+			}
+			code = true
+			i += 1
+		}
+		if open != nil && !open.multiline {
+			open = nil // unterminated, or continued with a backslash; either way it's done
+		}
+
+		switch {
+		case code:
+			stats.Code += 1
+		case comment:
+			stats.Comment += 1
+		default:
+			stats.Blank += 1
+		}
+	})
+	return stats
+}
+
+// isLineComment is true if a line comment starts at line[i].
+func (s *syntax) isLineComment(line string, i int) bool {
+	if s.wordComments && i > 0 && !isSpace(line[i-1]) && line[i-1] != ';' {
+		return false
+	}
+	for _, marker := range s.lineComments {
+		if strings.HasPrefix(line[i:], marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDelims returns the delims that text starts with, or nil.
+func matchDelims(text string, all []delims) *delims {
+	for i := range all {
+		if strings.HasPrefix(text, all[i].open) {
+			return &all[i]
+		}
+	}
+	return nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v'
+}
@@ -0,0 +1,127 @@
+// vcsloc/loc/components.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"vcsloc/vcs"
+)
+
+// ConnectedComponents partitions the commit graph into its independent
+// histories: commits are in the same component if a chain of parent and
+// child links joins them, whichever way the links go. Most repos are one
+// component; a subtree import that was never merged, or a ref to an
+// unrelated history, is another. A scope can split a history too, since the
+// parents outside it aren't in the graph. The components are largest first
+// (then by newest commit), and each is newest first, as in
+// UnreachableCommits.
+func (db *VcsDb2) ConnectedComponents() ([][]vcs.Hash, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return nil, err
+		}
+	}
+	graph := db.graph.graph
+
+	// Union-find over commit indexes, joined along every parent link
+	hashes := make([]vcs.Hash, 0, len(graph))
+	index := make(map[vcs.Hash]int, len(graph))
+	for hash := range graph {
+		index[hash] = len(hashes)
+		hashes = append(hashes, hash)
+	}
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i, hash := range hashes {
+		for _, p := range graph[hash].parents {
+			if j, ok := index[p]; ok {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[ri] = rj
+				}
+			}
+		}
+	}
+
+	byRoot := make(map[int][]vcs.Hash)
+	for i, hash := range hashes {
+		root := find(i)
+		byRoot[root] = append(byRoot[root], hash)
+	}
+	components := make([][]vcs.Hash, 0, len(byRoot))
+	for _, component := range byRoot {
+		sort.Slice(component, func(i, j int) bool {
+			a, b := graph[component[i]], graph[component[j]]
+			if a.timestamp != b.timestamp {
+				return a.timestamp > b.timestamp
+			}
+			return component[i] < component[j]
+		})
+		components = append(components, component)
+	}
+	sort.Slice(components, func(i, j int) bool {
+		a, b := components[i], components[j]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		if ta, tb := graph[a[0]].timestamp, graph[b[0]].timestamp; ta != tb {
+			return ta > tb
+		}
+		return a[0] < b[0]
+	})
+	return components, nil
+}
+
+// WriteComponentsReport writes the number of components (see
+// ConnectedComponents), then a line for each: its commits, the dates of its
+// oldest and newest commits, and its root commits (the ones whose parents
+// aren't in the graph).
+func (db *VcsDb2) WriteComponentsReport(w io.Writer) error {
+	components, err := db.ConnectedComponents()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%d components\n", len(components)); err != nil {
+		return err
+	}
+
+	graph := db.graph.graph
+	prefixLen := db.AbbrevLen()
+	date := func(hash vcs.Hash) string {
+		return time.Unix(int64(graph[hash].timestamp), 0).UTC().Format("2006-01-02")
+	}
+	for _, component := range components {
+		var roots []string
+		for _, hash := range component {
+			isRoot := true
+			for _, p := range graph[hash].parents {
+				if _, ok := graph[p]; ok {
+					isRoot = false
+					break
+				}
+			}
+			if isRoot {
+				roots = append(roots, hash.Abbrev(prefixLen))
+			}
+		}
+		newest, oldest := component[0], component[len(component)-1]
+		if _, err := fmt.Fprintf(w, "%8d commits  %s to %s  roots %s\n", len(component), date(oldest), date(newest), strings.Join(roots, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
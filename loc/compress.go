@@ -0,0 +1,128 @@
+// vcsloc/loc/compress.go
+
+package loc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// isLargeFile is true for the data files that grow with the repo: the
+// commits and their hashes, the text graph, the counts, and the checkpoint
+// batches. These are gzipped in a compressed database. The rest are small
+// and stay text, so they can still be read by hand; graph.bin is read at
+// random, and isn't compressed either.
+func isLargeFile(name string) bool {
+	if name == "graph" || name == "count" {
+		return true
+	}
+	return strings.HasPrefix(name, "commits.") || strings.HasPrefix(name, "checkpoint.")
+}
+
+// Compressed is true if the database's large files are written gzipped.
+func (db *VcsDb2) Compressed() bool {
+	return db.hdr.compressed
+}
+
+// SetCompressed turns compression of the large data files on or off, and
+// rewrites the ones already there to match, so the space is saved (or the
+// files are readable) right away. It's recorded in the header, and sticks
+// until it's changed again.
+func (db *VcsDb2) SetCompressed(on bool) error {
+	if db.hdr.compressed == on {
+		return nil
+	}
+	db.hdr.compressed = on
+	if err := db.hdr.Save(db); err != nil {
+		return err
+	}
+
+	// Files are read by what's in them, not by the header, so one that
+	// isn't rewritten yet (if this is interrupted) still reads fine
+	var files []string
+	base := NewVcsCommits()
+	if err := base.LoadBase(db).err; err != nil {
+		return err
+	}
+	files = append(files, base.hashFile)
+	files = append(files, base.commitFiles...)
+	checkpoint := NewVcsCheckpoint()
+	if err := checkpoint.Load(db); err != nil {
+		return err
+	}
+	files = append(files, checkpoint.files...)
+	files = append(files, db.graph.name, db.count.name)
+
+	for _, name := range files {
+		if err := db.rewriteData(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteData writes a data file again, compressed or not as the database
+// is now. It's not an error if there isn't one.
+func (db *VcsDb2) rewriteData(name string) error {
+	r, err := db.openData(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return db.doSaveDataWorker(name, func(w *bufio.Writer) error {
+		_, err := io.Copy(w, r)
+		r.Close() // before the new file replaces it
+		return err
+	})
+}
+
+// openData opens a data file for reading. A gzipped file is told by its
+// magic number, and decompressed; so databases from before compression, and
+// files written before it was turned on or off, read as they always did.
+func (db *VcsDb2) openData(name string) (io.ReadCloser, error) {
+	f, err := db.store.Reader(name)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return dataReader{br, f}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dataReader{zr, f}, nil
+}
+
+// dataReader reads a data file through a decompressor or a buffer, and
+// closes the file.
+type dataReader struct {
+	io.Reader
+	f io.Closer
+}
+
+func (r dataReader) Close() error {
+	return r.f.Close()
+}
+
+// compressWriter wraps the writer of a large data file with a gzip writer if
+// the database is compressed. The returned close function finishes the gzip
+// stream; it doesn't close w.
+func (db *VcsDb2) compressWriter(name string, w io.Writer) (io.Writer, func() error) {
+	if !db.hdr.compressed || !isLargeFile(name) {
+		return w, func() error { return nil }
+	}
+	// These are rewritten on every save, so speed matters more than the
+	// last few percent; the text is repetitive enough to shrink a lot anyway
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return zw, zw.Close
+}
@@ -0,0 +1,396 @@
+// vcsloc/loc/count.go
+
+package loc
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"vcsloc/vcs"
+)
+
+// LocCount is the line count of the tree at one ref's tip.
+type LocCount struct {
+	Refname string
+	Hash vcs.Hash // commit the ref pointed to when counted
+	Files int // text files
+	BinaryFiles int // binary files, which aren't counted
+	Lines int // total lines in text files
+	Stats LineStats // lines by kind, of the files in languages with a LineClassifier
+
+	files []FileLoc
+	classified bool // Stats was counted; counts from before there were classifiers don't have it
+}
+
+// FileLoc is the line count of one file.
+type FileLoc struct {
+	Path string
+	Lines int
+	Binary bool
+}
+
+// VcsLocCount is the lines of code at the tip of each ref, persisted
+// alongside the commits and refs.
+type VcsLocCount struct {
+	counts []LocCount
+
+	dirty bool // true if data needs to be written to disk
+	name string // filename data is persisted under
+}
+
+func NewVcsLocCount() *VcsLocCount {
+	return &VcsLocCount{name: "count"}
+}
+
+// (*VcsLocCount).Load reads the counts from the database. Each ref is a
+// "ref" line, a "stats" line, and a line for each of its files.
+func (h *VcsLocCount) Load(db *VcsDb2) error {
+	h.counts = nil
+	h.dirty = false
+
+	return db.doLoadData(h.name, func(line string) error {
+		if strings.HasPrefix(line, "\t") {
+			if len(h.counts) == 0 {
+				return fmt.Errorf("invalid VcsLocCount: %s", line)
+			}
+			f, err := parseFileLoc(line[1:])
+			if err != nil {
+				return err
+			}
+			lc := &h.counts[len(h.counts)-1]
+			lc.files = append(lc.files, f)
+			return nil
+		}
+
+		// stats <code> <comment> <blank>
+		if strings.HasPrefix(line, "stats ") {
+			if len(h.counts) == 0 {
+				return fmt.Errorf("invalid VcsLocCount: %s", line)
+			}
+			lc := &h.counts[len(h.counts)-1]
+			if _, err := fmt.Sscanf(line, "stats %d %d %d", &lc.Stats.Code, &lc.Stats.Comment, &lc.Stats.Blank); err != nil {
+				return fmt.Errorf("invalid VcsLocCount: %s", line)
+			}
+			lc.classified = true
+			return nil
+		}
+
+		// ref <hash> <files> <binaryFiles> <lines> <refname>
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 || fields[0] != "ref" {
+			return fmt.Errorf("invalid VcsLocCount: %s", line)
+		}
+		lc := LocCount{Hash: vcs.Hash(fields[1]), Refname: fields[5]}
+		var err error
+		if lc.Files, err = strconv.Atoi(fields[2]); err == nil {
+			if lc.BinaryFiles, err = strconv.Atoi(fields[3]); err == nil {
+				lc.Lines, err = strconv.Atoi(fields[4])
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid VcsLocCount: %s", line)
+		}
+		h.counts = append(h.counts, lc)
+		return nil
+	})
+}
+
+// (*VcsLocCount).Save writes the counts to the database.
+func (h *VcsLocCount) Save(db *VcsDb2) error {
+	var lines []string
+	for _, lc := range h.counts {
+		lines = append(lines, fmt.Sprintf("ref %s %d %d %d %s\n", lc.Hash, lc.Files, lc.BinaryFiles, lc.Lines, lc.Refname))
+		if lc.classified {
+			lines = append(lines, fmt.Sprintf("stats %d %d %d\n", lc.Stats.Code, lc.Stats.Comment, lc.Stats.Blank))
+		}
+		for _, f := range lc.files {
+			if f.Binary {
+				lines = append(lines, fmt.Sprintf("\t-\t%s\n", formatPath(f.Path)))
+			} else {
+				lines = append(lines, fmt.Sprintf("\t%d\t%s\n", f.Lines, formatPath(f.Path)))
+			}
+		}
+	}
+	err := db.doSaveDataLines(h.name, lines)
+	if err == nil {
+		h.dirty = false
+	}
+	return err
+}
+
+// parseFileLoc parses "<lines>\t<path>", where lines is "-" for a binary file.
+// The path can be quoted, as git and formatPath quote unusual paths.
+func parseFileLoc(s string) (FileLoc, error) {
+	tab := strings.Index(s, "\t")
+	if tab == -1 {
+		return FileLoc{}, fmt.Errorf("invalid file count: %s", s)
+	}
+	f := FileLoc{Path: parsePath(s[tab+1:])}
+	if s[:tab] == "-" {
+		f.Binary = true
+		return f, nil
+	}
+	n, err := strconv.Atoi(s[:tab])
+	if err != nil {
+		return FileLoc{}, fmt.Errorf("invalid file count: %s", s)
+	}
+	f.Lines = n
+	return f, nil
+}
+
+// LocCounts returns the counts from the last "count" run.
+func (db *VcsDb2) LocCounts() ([]LocCount, error) {
+	if err := db.count.Load(db); err != nil {
+		return nil, err
+	}
+	return db.count.counts, nil
+}
+
+// FindCount returns the count of the ref called name (see DotOpts.Ref for
+// the names a ref goes by), or nil if there isn't one.
+func FindCount(counts []LocCount, name string) *LocCount {
+	for i := range counts {
+		if refMatches(counts[i].Refname, name) {
+			return &counts[i]
+		}
+	}
+	return nil
+}
+
+// noExtension is the LocByExtension bucket for files without an extension.
+const noExtension = "(none)"
+
+// LocByExtension adds up the lines of the files at commit ref by file
+// extension (".go", lowercased), from the tree listing of the last count
+// of ref. Files with no extension are under "(none)", and dotfiles such as
+// ".gitignore" under their whole name. The files are read from the repo to
+// sort their lines by kind; a file in a language without a LineClassifier
+// has only code and blank lines. Binary files aren't counted.
+func (db *VcsDb2) LocByExtension(ref vcs.Hash) (map[string]LineStats, error) {
+	if err := db.count.Load(db); err != nil {
+		return nil, err
+	}
+	var lc *LocCount
+	for i := range db.count.counts {
+		if db.count.counts[i].Hash == ref && db.count.counts[i].files != nil {
+			lc = &db.count.counts[i]
+			break
+		}
+	}
+	if lc == nil {
+		return nil, fmt.Errorf("%s hasn't been counted", ref)
+	}
+
+	cat, err := db.catFile()
+	if err != nil {
+		return nil, err
+	}
+
+	byExt := make(map[string]LineStats)
+	for _, f := range lc.files {
+		if f.Binary || strings.Contains(f.Path, "\n") {
+			continue
+		}
+		obj, err := cat.Open(string(ref) + ":" + f.Path)
+		if errors.Is(err, vcs.ErrObjectMissing) {
+			continue // a submodule
+		}
+		if err != nil {
+			return nil, err
+		}
+		ext := extensionOf(f.Path)
+		stats := byExt[ext]
+		stats.Add(CountFile(obj, LanguageOf(f.Path)))
+		byExt[ext] = stats
+	}
+	return byExt, nil
+}
+
+// extensionOf is the LocByExtension bucket of the file at p.
+func extensionOf(p string) string {
+	name := path.Base(p)
+	ext := path.Ext(name)
+	switch {
+	case ext == name:
+		return name // a dotfile
+	case ext == "":
+		return noExtension
+	}
+	return strings.ToLower(ext)
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// Count counts the lines in every file at the tip of each ref and stores the
+// totals in the database. The tree is streamed by diffing the tip against the
+// empty tree, so every file shows up in --numstat output as added, with its
+// line count; binary files show up as "-" and are counted as files but not
+// lines, as in the stat walk. Files in a language with a LineClassifier are
+// then read to sort their lines into code, comments and blank lines. Tips
+// that haven't moved since the last count aren't counted again, and refs
+// pointing at the same commit share a count.
+// The database has to be up to date (see UpdateRepo), since the refs come
+// from it. Refs to trees and blobs aren't counted. Trees are counted work.jobs at a time (see SetJobs).
+func (work *Analyzer) Count() []LocCount {
+	if work.Backend().Name() != "git" {
+		work.terminal.Fatalf("Counting lines is only supported for git repos\n")
+	}
+	work.db.refs.Load(work.db)
+	work.db.count.Load(work.db)
+
+	previous := make(map[vcs.Hash]*LocCount)
+	for i := range work.db.count.counts {
+		lc := &work.db.count.counts[i]
+		if lc.classified {
+			previous[lc.Hash] = lc
+		}
+	}
+
+	// Count each tip we don't have yet once, spread over the workers
+	var tips []vcs.Hash
+	refs := work.db.refs.CommitRefs()
+	for _, ref := range refs {
+		if _, ok := previous[ref.RefHash]; !ok {
+			previous[ref.RefHash] = nil
+			tips = append(tips, ref.RefHash)
+		}
+	}
+	work.countTrees(tips, previous)
+
+	var counts []LocCount
+	for _, ref := range refs {
+		count := *previous[ref.RefHash]
+		count.Refname = ref.Refname
+		counts = append(counts, count)
+	}
+
+	work.db.count.counts = counts
+	work.db.count.dirty = true
+	return counts
+}
+
+// countTrees counts the trees of tips on work.jobs workers, putting the
+// results in counts. With one worker, progress is shown per file.
+func (work *Analyzer) countTrees(tips []vcs.Hash, counts map[vcs.Hash]*LocCount) {
+	jobs := work.numJobs()
+	if jobs == 1 || len(tips) <= 1 {
+		for _, hash := range tips {
+			counts[hash] = work.CountTree(hash)
+		}
+		return
+	}
+
+	// Progress is per tree, and a big tree can take a while
+	defer work.terminal.Busyf("Counting trees (0/%d)...", len(tips))()
+	var mu sync.Mutex // guards counts and the terminal
+	var done int
+	queue := make(chan vcs.Hash)
+	var wg sync.WaitGroup
+	for n := 0; n < jobs; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range queue {
+				lc, warnings := work.countTree(hash, nil)
+				mu.Lock()
+				counts[hash] = lc
+				for _, w := range warnings {
+					work.terminal.Warnf("%s", w)
+				}
+				done += 1
+				if work.terminal.Ready() {
+					work.terminal.Progressf("Counting trees (%d/%d)...", done, len(tips))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, hash := range tips {
+		queue <- hash
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// CountTree counts the lines in each file of a commit's tree.
+func (work *Analyzer) CountTree(hash vcs.Hash) *LocCount {
+	prefixLen := work.db.AbbrevLen()
+	lc, warnings := work.countTree(hash, func(lc *LocCount) {
+		if work.terminal.Ready() {
+			work.terminal.Progressf("Counting %s (%d files, %d lines)...", hash.Abbrev(prefixLen), lc.Files, lc.Lines)
+		}
+	})
+	for _, w := range warnings {
+		work.terminal.Warnf("%s", w)
+	}
+	return lc
+}
+
+// countTree does the work of CountTree without touching the terminal, so it
+// can run on any goroutine; progress, if not nil, is called after each file.
+func (work *Analyzer) countTree(hash vcs.Hash, progress func(lc *LocCount)) (*LocCount, []string) {
+	lc := &LocCount{Hash: hash}
+	var warnings []string
+	outCb := func(line string) {
+		// <add>\t<remove>\t<path>; everything is added
+		tokens := strings.SplitN(line, "\t", 3)
+		if len(tokens) != 3 {
+			return
+		}
+		f, err := parseFileLoc(tokens[0] + "\t" + tokens[2])
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Ignoring bad numstat line for %s: %s", hash, line))
+			return
+		}
+		lc.files = append(lc.files, f)
+		if f.Binary {
+			lc.BinaryFiles += 1
+		} else {
+			lc.Files += 1
+			lc.Lines += f.Lines
+		}
+		if progress != nil {
+			progress(lc)
+		}
+	}
+
+	cmd := []string{"diff", "--numstat", "--no-renames", string(vcs.GitEmptyTreeFor(hash)), string(hash)}
+	vcs.RunGitCommandIncremental(outCb, nil, work.db.hdr.repoPath, nil, cmd...)
+
+	if err := work.classifyTree(lc); err != nil {
+		warnings = append(warnings, fmt.Sprintf("Could not classify lines for %s: %s", hash, err))
+	}
+	return lc, warnings
+}
+
+// classifyTree reads the files of lc in languages with a LineClassifier, and
+// adds up their lines by kind in lc.Stats. The files are streamed from one
+// cat-file, so big ones aren't held in memory.
+func (work *Analyzer) classifyTree(lc *LocCount) error {
+	cat, err := vcs.BatchCatFile(work.db.hdr.repoPath)
+	if err != nil {
+		return err
+	}
+	defer cat.Close()
+
+	for _, f := range lc.files {
+		lang := LanguageOf(f.Path)
+		if lang == "" || f.Binary || strings.Contains(f.Path, "\n") {
+			continue
+		}
+		obj, err := cat.Open(string(lc.Hash) + ":" + f.Path)
+		if errors.Is(err, vcs.ErrObjectMissing) {
+			continue // a submodule, which numstat lists like a file
+		}
+		if err != nil {
+			return err
+		}
+		lc.Stats.Add(CountFile(obj, lang))
+	}
+	lc.classified = true
+	return nil
+}
@@ -4,38 +4,56 @@ package loc
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"strconv"
 
+	"vcsloc/gsos"
 	"vcsloc/vcs"
 )
 
-func NewVcsDb2(dbPath string) *VcsDb2 {
+// dbSchemaVersion is the version of the on-disk database format. It is
+// part of the repo fingerprint, so that databases written by incompatible
+// versions of vcsloc never compare equal.
+const dbSchemaVersion = 1
+
+// NewVcsDb2 makes an empty database kept in store. Use OpenDb for a database
+// on disk, or NewMemDb for one in memory.
+func NewVcsDb2(store Store) *VcsDb2 {
 	return &VcsDb2{
-		dbPath: dbPath,
+		store: store,
 		hdr: NewVcsHeader(),
 		info: NewVcsBaseInfo(),
 		refs: NewVcsRefs(),
 		commits: NewVcsCommits(),
+		count: NewVcsLocCount(),
+		graph: NewVcsGraph(),
+		roots: NewVcsRoots(),
+		checkpoint: NewVcsCheckpoint(),
 	}
 }
 
 // VcsDb is the in-memory representation of the vcsloc database
 type VcsDb2 struct {
-	dbPath string // Path to vcsloc database directory
+	store Store // where the data files are kept
+	lock *dbLock // held while the database is open, if it's on disk
+	cat *vcs.BatchReader // reads objects from the repo; started by catFile, ended by Close
+	closed bool
 
 	hdr *VcsHeader
 	info *VcsBaseInfo
 	refs *VcsRefs
 	commits *VcsCommits
-
-	// roots is the root commits from the repo (root commits have no parents)
-	roots []vcs.Hash
-	rootsDirty bool
+	count *VcsLocCount
+	graph *VcsGraph // the annotated graph (adds children)
+	roots *VcsRoots // the root commits (root commits have no parents)
+	checkpoint *VcsCheckpoint // progress of an unfinished fetch
 
 	// tips is the endpoints of all commits in the repo (tips have no children)
 	tips []vcs.Hash
@@ -45,76 +63,174 @@ type VcsDb2 struct {
 	rawgraph map[vcs.Hash]Commit
 	rawgraphDirty bool
 
-	// graph is the annotated graph (adds children)
-	graph map[vcs.Hash]Commit
-	graphDirty bool
-
 	// nonmergeStat contains the summary of changes for each non-merge commit
 	// (there are multiple entries for merge commits)
 	nonmergeStat map[vcs.Hash]NonmergeStat
 	nonmergeStatdirty bool
 }
 
+var (
+	// ErrDbCorrupt is returned by OpenDb when there's a directory at the
+	// database path but its header can't be read.
+	ErrDbCorrupt = errors.New("database is corrupt")
+
+	// ErrPathConflict is returned by OpenDb when there's a file, not a
+	// directory, at the database path.
+	ErrPathConflict = errors.New("file in the way of database")
+)
+
 // OpenDb opens an existing vcsloc database or creates a new one.
 // If the database exists and repoPath or vcs are non-nil, validate them
-// against the database.
-func OpenDb(dbPath string, repoPath string, vcs string) *VcsDb2 {
-	db := NewVcsDb2(dbPath)
-
-	if db.dbPath == "" {
-		log.Fatalf("Specify a database path with --db=<path>")
+// against the database. A new database needs repoPath to be a repo of
+// that vcs. The database is locked until Unlock, so that no other process
+// opens it meanwhile; see ErrDbInUse.
+func OpenDb(dbPath string, repoPath string, vcsName string) (*VcsDb2, error) {
+	if dbPath == "" {
+		return nil, errors.New("specify a database path with --db=<path>")
 	}
 
 	// If there is a dir at this location, read header from database.
 	// If it's not a valid database, tell the user to point somewhere
 	// else or fix the database.
-	if fInfo, err := os.Stat(db.dbPath); err == nil && fInfo.IsDir() {
+	if fInfo, err := os.Stat(dbPath); err == nil && fInfo.IsDir() {
+		lock, err := lockDb(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		db := NewVcsDb2(NewFileStore(dbPath))
+		db.lock = lock
 		if err = db.hdr.Load(db); err != nil {
-			log.Fatalf("Database at %s is corrupt? %s", db.dbPath, err)
+			lock.Unlock()
+			return nil, fmt.Errorf("%w: %s: %s", ErrDbCorrupt, dbPath, err)
 		}
-		return db
+		return db, nil
 	}
 
 	// If there is no database here, then create a directory to hold
 	// the database
-	if vcs == "" {
-		log.Fatalf("Specify a version control system with --vcs=<type>")
+	if vcsName == "" {
+		return nil, errors.New("specify a version control system with --vcs=<type>")
 	}
 	if repoPath == "" {
-		log.Fatalf("Specify a repository path with --repo=<path>")
+		return nil, errors.New("specify a repository path with --repo=<path>")
+	}
+
+	if fInfo, err := os.Stat(dbPath); err == nil && !fInfo.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrPathConflict, dbPath)
+	}
+
+	// Check the repo before making anything, so that a bad path doesn't
+	// leave an empty database behind
+	if err := vcs.CheckRepo(vcsName, repoPath); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dbPath, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create db '%s': %s", dbPath, err)
+	}
+	lock, err := lockDb(dbPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if fInfo, err := os.Stat(db.dbPath); err == nil && !fInfo.IsDir() {
-		log.Fatalf("File in the way at '%s'\n", db.dbPath)
+	db, err := createDb(NewFileStore(dbPath), repoPath, vcsName)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
 	}
+	db.lock = lock
+	return db, nil
+}
 
-	if err := os.MkdirAll(db.dbPath, os.ModePerm); err != nil {
-		log.Fatalf("Could not create db '%s': %s\n", db.dbPath, err)
+// NewMemDb creates a database that's kept in memory and never touches the
+// disk, for tests and one-off runs. Everything else works as it does for a
+// database from OpenDb.
+func NewMemDb(repoPath string, vcsName string) (*VcsDb2, error) {
+	if err := vcs.CheckRepo(vcsName, repoPath); err != nil {
+		return nil, err
 	}
+	return createDb(NewMemStore(), repoPath, vcsName)
+}
+
+// createDb starts a new database in store by writing its header.
+func createDb(store Store, repoPath string, vcsName string) (*VcsDb2, error) {
+	db := NewVcsDb2(store)
 
 	// Write out an initial header. Save paths as full paths.
 	db.hdr.repoPath, _ = filepath.Abs(repoPath)
-	db.hdr.vcs = vcs
+	db.hdr.vcs = vcsName
 	if err := db.hdr.Save(db); err != nil {
-		log.Fatalf("Could not write db hdr: %s\n", err)
+		return nil, fmt.Errorf("could not write db hdr: %s", err)
 	}
 
-	return db
+	return db, nil
 }
 
-// Save saves any dirty database data to disk
-func (db *VcsDb2) Save() {
-	if db.info.dirty {
-		db.info.Save(db)
+// Save saves any dirty database data to disk. It saves as much as it can,
+// and returns the first error.
+func (db *VcsDb2) Save() error {
+	var firstErr error
+	save := func(dirty bool, saver func(db *VcsDb2) error) {
+		if dirty {
+			if err := saver(db); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
 
-	if db.refs.dirty {
-		db.refs.Save(db)
+	save(db.info.dirty, db.info.Save)
+	save(db.refs.dirty, db.refs.Save)
+	save(db.commits.dirty, db.commits.Save)
+	save(db.count.dirty, db.count.Save)
+	save(db.graph.dirty, db.graph.Save)
+	save(db.roots.dirty, db.roots.Save)
+
+	if firstErr != nil {
+		return fmt.Errorf("could not save db '%s': %s", storePath(db.store, ""), firstErr)
 	}
+	return nil
+}
 
-	if db.commits.dirty {
-		db.commits.Save(db)
+// Close is done with the database: it saves any dirty data, ends the
+// cat-file it reads the repo through, if it started one, and releases the
+// lock. It does all of them even if one fails, and returns the first error.
+// The database can't be used after this; closing it again does nothing.
+func (db *VcsDb2) Close() error {
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	err := db.Save()
+	if db.cat != nil {
+		if cerr := db.cat.Close(); err == nil {
+			err = cerr
+		}
+		db.cat = nil
 	}
+	if uerr := db.Unlock(); err == nil && uerr != nil {
+		err = fmt.Errorf("could not unlock db '%s': %s", storePath(db.store, ""), uerr)
+	}
+	return err
+}
+
+// catFile returns the database's cat-file on the repo, starting it the first
+// time, or again if the last one broke. It's only for one goroutine at a
+// time; work that reads the repo on several has a BatchCatFile of its own
+// for each.
+func (db *VcsDb2) catFile() (*vcs.BatchReader, error) {
+	if db.cat != nil && db.cat.Err() == nil {
+		return db.cat, nil
+	}
+	if db.cat != nil {
+		db.cat.Close()
+		db.cat = nil
+	}
+	cat, err := vcs.BatchCatFile(db.hdr.repoPath)
+	if err != nil {
+		return nil, err
+	}
+	db.cat = cat
+	return cat, nil
 }
 
 // ----------------------------------------------------------------------------------------------
@@ -127,16 +243,48 @@ func NewVcsHeader() *VcsHeader {
 type VcsHeader struct {
 	repoPath string // Path to repo being analyzed
 	vcs string // Version control type: "git", "hg", etc
+	scope Scope // Part of the history the database holds
+	bare bool // true if the repo has no working tree
+	submodules []string // paths of the submodules with databases under this one
+	compressed bool // the large data files are written gzipped, see SetCompressed
+	historyGeneration int // bumped each time rewritten history makes the database start over
+	defaultBranch string // refname of the repo's default branch, "" if not known
 
 	name string // filename data is persisted under
 }
 
 func (h *VcsHeader) Load(db *VcsDb2) error {
 
+	h.scope = Scope{}
+	h.submodules = nil
+	h.compressed = false
+	h.historyGeneration = 0
+	h.defaultBranch = ""
 	return db.doLoadDataRequired(h.name, func(line string) error {
+		var path string
+		if getkvstr(line, &path, "path=") {
+			h.scope.Paths = append(h.scope.Paths, path)
+			return nil
+		}
+		if getkvstr(line, &path, "ref=") {
+			h.scope.Refs = append(h.scope.Refs, path)
+			return nil
+		}
+		if getkvstr(line, &path, "submodule=") {
+			h.submodules = append(h.submodules, path)
+			return nil
+		}
 		if !getkvstr(line, &h.repoPath, "repoPath=") &&
+			!getkvstr(line, &h.scope.Range, "range=") &&
+			!getkvstr(line, &h.scope.Since, "since=") &&
+			!getkvstr(line, &h.scope.Until, "until=") &&
+			!getkvbool(line, &h.scope.FirstParent, "firstParent=") &&
+			!getkvbool(line, &h.bare, "bare=") &&
+			!getkvbool(line, &h.compressed, "compressed=") &&
+			!getkvint(line, &h.historyGeneration, "historyGeneration=") &&
+			!getkvstr(line, &h.defaultBranch, "defaultBranch=") &&
 			!getkvstr(line, &h.vcs, "vcs=") {
-				return fmt.Errorf("invalid data in VcsHeader: %s\n", line)
+				return fmt.Errorf("invalid data in VcsHeader: %s", line)
 			}
 		return nil
 	})
@@ -146,9 +294,88 @@ func (h *VcsHeader) Save(db *VcsDb2) error {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("repoPath=%s\n", h.repoPath))
 	lines = append(lines, fmt.Sprintf("vcs=%s\n", h.vcs))
+	lines = append(lines, fmt.Sprintf("bare=%t\n", h.bare))
+	if h.compressed {
+		lines = append(lines, "compressed=true\n")
+	}
+	if h.defaultBranch != "" {
+		lines = append(lines, fmt.Sprintf("defaultBranch=%s\n", h.defaultBranch))
+	}
+	if h.historyGeneration > 0 {
+		lines = append(lines, fmt.Sprintf("historyGeneration=%d\n", h.historyGeneration))
+	}
+	if h.scope.Range != "" {
+		lines = append(lines, fmt.Sprintf("range=%s\n", h.scope.Range))
+	}
+	for _, ref := range h.scope.Refs {
+		lines = append(lines, fmt.Sprintf("ref=%s\n", ref))
+	}
+	if h.scope.Since != "" {
+		lines = append(lines, fmt.Sprintf("since=%s\n", h.scope.Since))
+	}
+	if h.scope.Until != "" {
+		lines = append(lines, fmt.Sprintf("until=%s\n", h.scope.Until))
+	}
+	for _, path := range h.scope.Paths {
+		lines = append(lines, fmt.Sprintf("path=%s\n", path))
+	}
+	if h.scope.FirstParent {
+		lines = append(lines, "firstParent=true\n")
+	}
+	for _, path := range h.submodules {
+		lines = append(lines, fmt.Sprintf("submodule=%s\n", path))
+	}
 	return db.doSaveDataLines(h.name, lines)
 }
 
+// Scope returns the part of the repo history that the database holds.
+func (db *VcsDb2) Scope() Scope {
+	return db.hdr.scope
+}
+
+// HistoryGeneration counts the times the database has started over because
+// the repo's history was rewritten; 0 if it never has.
+func (db *VcsDb2) HistoryGeneration() int {
+	return db.hdr.historyGeneration
+}
+
+// RepoPath is the full path of the repo the database is for.
+func (db *VcsDb2) RepoPath() string {
+	return db.hdr.repoPath
+}
+
+// IsBare is true if the repo had no working tree when last analyzed.
+func (db *VcsDb2) IsBare() bool {
+	return db.hdr.bare
+}
+
+// DefaultBranch returns the repo's default branch (where HEAD pointed when
+// it was last analyzed) and the commit at its tip. Reports about the mainline
+// follow it. Both are empty if the repo doesn't have one, or the ref is gone.
+func (db *VcsDb2) DefaultBranch() (string, vcs.Hash) {
+	if db.hdr.defaultBranch == "" {
+		return "", ""
+	}
+	if db.refs.refs == nil {
+		db.refs.Load(db)
+	}
+	for _, ref := range db.refs.CommitRefs() {
+		if ref.Refname == db.hdr.defaultBranch {
+			return ref.Refname, ref.RefHash
+		}
+	}
+	return "", ""
+}
+
+// setDefaultBranch records the default branch in the header if it changed.
+func (db *VcsDb2) setDefaultBranch(refname string) error {
+	if refname == db.hdr.defaultBranch {
+		return nil
+	}
+	db.hdr.defaultBranch = refname
+	return db.hdr.Save(db)
+}
+
 // ----------------------------------------------------------------------------------------------
 
 func NewVcsBaseInfo() *VcsBaseInfo {
@@ -162,7 +389,15 @@ type VcsBaseInfo struct {
 	numRepoObjects int // number of objects in the repo
 	numRepoCommits int // number of commits in the repo
 	refsSignature string // a computed signature on VcsRefs
+	refsListSignature string // the backend's cheaper signature, see vcs.VcsBackend.RefsSignature
 	graphUpToDate bool // true if the graph has been fully updated
+	haveStats bool // true if per-file change stats were gathered with the commits
+	noLineCounts bool // true if the stats say which files changed but not how many lines; older databases always have them
+	haveCommitters bool // true if the commits have their committers; older databases don't
+	firstParentStats bool // true if the stats are mainline only (see SetFirstParentStats)
+	mailmap string // signature of the mailmap applied to authors, "" for none
+	excludePaths []string // patterns for paths left out of the stats (see SetExcludePaths)
+	fingerprint string // summary of the analyzed state, see Fingerprint
 
 	dirty bool // true if data needs to be written to disk
 	name string // filename data is persisted under
@@ -175,28 +410,107 @@ func (h *VcsBaseInfo) Load(db *VcsDb2) error {
 		if !getkvint(line, &h.numRepoObjects, "numRepoObjects=") &&
 			!getkvint(line, &h.numRepoCommits, "numRepoCommits=") &&
 			!getkvstr(line, &h.refsSignature, "refsSignature=") &&
-			!getkvbool(line, &h.graphUpToDate, "graphUpToDate=") {
+			!getkvstr(line, &h.refsListSignature, "refsListSignature=") &&
+			!getkvbool(line, &h.graphUpToDate, "graphUpToDate=") &&
+			!getkvbool(line, &h.haveStats, "haveStats=") &&
+			!getkvbool(line, &h.noLineCounts, "noLineCounts=") &&
+			!getkvbool(line, &h.haveCommitters, "haveCommitters=") &&
+			!getkvbool(line, &h.firstParentStats, "firstParentStats=") &&
+			!getkvstr(line, &h.mailmap, "mailmap=") &&
+			!getkvstrlist(line, &h.excludePaths, "excludePaths=") &&
+			!getkvstr(line, &h.fingerprint, "fingerprint=") {
 			return fmt.Errorf("invalid VcsBaseInfo")
 		}
 		return nil
 	})
 }
 
-// (*VcsBaseInfo).Save writes core vars to database.
+// (*VcsBaseInfo).Save writes core vars to database. The fingerprint is
+// recomputed first.
 func (h *VcsBaseInfo) Save(db *VcsDb2) error {
-	h.dirty = false
-	return db.doSaveDataLines(h.name, []string{
+	h.fingerprint = db.Fingerprint()
+	err := db.doSaveDataLines(h.name, []string{
 		fmt.Sprintf("numRepoObjects=%d\n", h.numRepoObjects),
 		fmt.Sprintf("numRepoCommits=%d\n", h.numRepoCommits),
 		fmt.Sprintf("refsSignature=%s\n", h.refsSignature),
+		fmt.Sprintf("refsListSignature=%s\n", h.refsListSignature),
 		fmt.Sprintf("graphUpToDate=%v\n", h.graphUpToDate),
+		fmt.Sprintf("haveStats=%v\n", h.haveStats),
+		fmt.Sprintf("noLineCounts=%v\n", h.noLineCounts),
+		fmt.Sprintf("haveCommitters=%v\n", h.haveCommitters),
+		fmt.Sprintf("firstParentStats=%v\n", h.firstParentStats),
+		fmt.Sprintf("mailmap=%s\n", h.mailmap),
+		fmt.Sprintf("excludePaths=%s\n", strings.Join(h.excludePaths, ", ")),
+		fmt.Sprintf("fingerprint=%s\n", h.fingerprint),
 	})
+	if err == nil {
+		h.dirty = false
+	}
+	return err
+}
+
+// HaveStats is true if the database has per-file change stats. Reports that
+// need them should check this and explain how to get them.
+func (db *VcsDb2) HaveStats() (bool, error) {
+	if err := db.info.Load(db); err != nil {
+		return false, err
+	}
+	return db.info.haveStats, nil
+}
+
+// HaveLineCounts is true if the database's change stats have the lines added
+// and removed (and which files are binary), not just which files changed, as
+// an import from a fast-export stream has. Reports that count lines should
+// check this rather than HaveStats.
+func (db *VcsDb2) HaveLineCounts() (bool, error) {
+	if err := db.info.Load(db); err != nil {
+		return false, err
+	}
+	return db.info.haveStats && !db.info.noLineCounts, nil
+}
+
+// FirstParentStats is true if the change stats were gathered for the
+// first-parent mainline only.
+func (db *VcsDb2) FirstParentStats() (bool, error) {
+	if err := db.info.Load(db); err != nil {
+		return false, err
+	}
+	return db.info.firstParentStats, nil
+}
+
+// Fingerprint returns a short fingerprint of the analyzed repo state, meant to be
+// compared across machines to confirm two databases represent the same repo.
+// It is the first 16 hex digits of the SHA-256 of these lines:
+//
+//	schema=<dbSchemaVersion>
+//	commits=<number of commits>
+//	<hash> <refname>        (one per ref, sorted by refname then hash)
+//
+// Since every ref is included, this is a superset of the refs signature.
+func (db *VcsDb2) Fingerprint() string {
+	refs := make([]vcs.Ref, len(db.refs.refs))
+	copy(refs, db.refs.refs)
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Refname != refs[j].Refname {
+			return refs[i].Refname < refs[j].Refname
+		}
+		return refs[i].RefHash < refs[j].RefHash
+	})
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "schema=%d\n", dbSchemaVersion)
+	fmt.Fprintf(sum, "commits=%d\n", db.info.numRepoCommits)
+	for _, ref := range refs {
+		fmt.Fprintf(sum, "%s %s\n", ref.RefHash, ref.Refname)
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:16]
 }
 
 // ----------------------------------------------------------------------------------------------
 
-// VcsRefs is the refs (heads: branches, tags, etc) from the repo.
-// A signature of this is stored in VcsBasicInfo.
+// VcsRefs is the refs (heads: branches, tags, etc) from the repo, in the
+// order the backend gave them (sorted by refname for git); Save and Load
+// keep that order. A signature of this is stored in VcsBasicInfo.
 type VcsRefs struct {
 	refs []vcs.Ref
 
@@ -208,28 +522,151 @@ func NewVcsRefs() *VcsRefs {
 	return &VcsRefs{name: "refs"}
 }
 
-// *VcsRefs).Load reads in the refs from the database.
+// *VcsRefs).Load reads in the refs from the database. Each line is
+// "<hash> <refname>", followed by the object and target types if known
+// (refnames can't have spaces).
 // TBD update vars in db.info
 func (h *VcsRefs) Load(db *VcsDb2) error {
 	h.refs = nil
 	h.dirty = false
 
 	return db.doLoadData(h.name, func(line string) error {
-		hash := line[:40]
-		refname := line[41:]
-		h.refs = append(h.refs, vcs.Ref{vcs.Hash(hash), refname})
+		ref, err := parseRef(line)
+		if err != nil {
+			return fmt.Errorf("invalid VcsRefs: %w", err)
+		}
+		h.refs = append(h.refs, ref)
 		return nil
 	})
 }
 
+// parseRef parses a ref as written by formatRef.
+func parseRef(line string) (vcs.Ref, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) != 2 && len(fields) != 4 {
+		return vcs.Ref{}, fmt.Errorf("bad ref: %s", line)
+	}
+	hash, err := vcs.ParseHash(fields[0])
+	if err != nil {
+		return vcs.Ref{}, err
+	}
+	ref := vcs.Ref{RefHash: hash, Refname: fields[1]}
+	if len(fields) == 4 {
+		ref.ObjectType, ref.TargetType = fields[2], fields[3]
+	}
+	return ref, nil
+}
+
+// formatRef is a ref as "<hash> <refname>", followed by its types if they're
+// known.
+func formatRef(ref vcs.Ref) string {
+	if ref.ObjectType == "" || ref.TargetType == "" {
+		return fmt.Sprintf("%s %s", string(ref.RefHash), ref.Refname)
+	}
+	return fmt.Sprintf("%s %s %s %s", string(ref.RefHash), ref.Refname, ref.ObjectType, ref.TargetType)
+}
+
+// (*VcsRefs).CommitRefs returns the refs that lead to commits.
+func (h *VcsRefs) CommitRefs() []vcs.Ref {
+	var refs []vcs.Ref
+	for _, ref := range h.refs {
+		if ref.IsCommit() {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// (*VcsRefs).Signature is a short hash of the refs, stored in VcsBaseInfo.
+// It's enough to tell if the refs changed, without loading them.
+func (h *VcsRefs) Signature() string {
+	return refsSignature(h.refs)
+}
+
+// refsSignature is the first 16 hex digits of the SHA-256 of the sorted
+// "<hash> <refname>" lines, so it doesn't depend on the order refs are listed.
+func refsSignature(refs []vcs.Ref) string {
+	lines := make([]string, len(refs))
+	for i, ref := range refs {
+		lines[i] = fmt.Sprintf("%s %s\n", ref.RefHash, ref.Refname)
+	}
+	sort.Strings(lines)
+
+	sum := sha256.New()
+	for _, line := range lines {
+		sum.Write([]byte(line))
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:16]
+}
+
 // *VcsRefs).Save writes all refs to the database.
 func (h *VcsRefs) Save(db *VcsDb2) error {
+	err := db.doSaveDataN(h.name, len(h.refs), func(i int) string {
+		return formatRef(h.refs[i]) + "\n"
+	})
+	if err == nil {
+		h.dirty = false
+	}
+	return err
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// VcsRoots is the root commits, the ones with no parents. A repo can have
+// many: the git repo itself has 9, from merging in other projects' history.
+type VcsRoots struct {
+	roots []vcs.Hash
+
+	dirty bool // true if data needs to be written to disk
+	name string // filename data is persisted under
+}
+
+func NewVcsRoots() *VcsRoots {
+	return &VcsRoots{name: "roots"}
+}
+
+// (*VcsRoots).Find sets the roots from commits, in commits order.
+func (h *VcsRoots) Find(commits []Commit) {
+	h.roots = nil
+	for i := range commits {
+		// The edge of a shallow clone looks like a root, but isn't one
+		if len(commits[i].parents) == 0 && !commits[i].shallowBoundary {
+			h.roots = append(h.roots, commits[i].hash)
+		}
+	}
+	h.dirty = true
+}
+
+// (*VcsRoots).Load reads the roots from the database.
+func (h *VcsRoots) Load(db *VcsDb2) error {
+	h.roots = nil
 	h.dirty = false
-	return db.doSaveDataN(h.name, len(h.refs), func(i int) string {
-		return fmt.Sprintf("%s %s\n", string(h.refs[i].RefHash), h.refs[i].Refname)
+
+	return db.doLoadData(h.name, func(line string) error {
+		h.roots = append(h.roots, vcs.Hash(line))
+		return nil
 	})
 }
 
+// (*VcsRoots).Save writes the roots to the database, one hash per line.
+func (h *VcsRoots) Save(db *VcsDb2) error {
+	err := db.doSaveDataN(h.name, len(h.roots), func(i int) string {
+		return fmt.Sprintf("%s\n", string(h.roots[i]))
+	})
+	if err == nil {
+		h.dirty = false
+	}
+	return err
+}
+
+// Roots returns the root commits, newest first.
+func (db *VcsDb2) Roots() ([]vcs.Hash, error) {
+	if err := db.roots.Load(db); err != nil {
+		return nil, err
+	}
+	return db.roots.roots, nil
+}
+
 // ----------------------------------------------------------------------------------------------
 
 // VcsCommits is the commits from the repo, in "log --all" order.
@@ -239,6 +676,8 @@ func (h *VcsRefs) Save(db *VcsDb2) error {
 type VcsCommits struct {
 	hashes []vcs.Hash
 	commits []Commit
+	sorted []vcs.Hash // hashes in sorted order, built on demand by hashIndex
+	prefixLen int // built on demand by ShortestUniquePrefix, 0 until then
 
 	hashFile string // name used to store hashes
 	commitFiles []string // zero or more files used to store commits
@@ -252,6 +691,14 @@ func NewVcsCommits() *VcsCommits {
 	return &VcsCommits{name: "commits", hashFile: "commits.hashes"}
 }
 
+// (*VcsCommits).SetHashes replaces the commit hash list.
+func (h *VcsCommits) SetHashes(hashes []vcs.Hash) {
+	h.hashes = hashes
+	h.sorted = nil
+	h.prefixLen = 0
+	h.dirty = true
+}
+
 func (h *VcsCommits) Load(db *VcsDb2) error {
 	h.dirty = false
 	h.err = nil
@@ -259,9 +706,11 @@ func (h *VcsCommits) Load(db *VcsDb2) error {
 }
 
 func (h *VcsCommits) Save(db *VcsDb2) error {
-	h.dirty = false
 	h.err = nil
-	return h.SaveCommits(db).SaveHashes(db).SaveBase(db).err
+	if h.SaveCommits(db).SaveHashes(db).SaveGraph(db).SaveBase(db).err == nil {
+		h.dirty = false
+	}
+	return h.err
 }
 
 // (*VcsCommits).LoadBase reads in the commits abstract from the database.
@@ -296,6 +745,8 @@ func (h *VcsCommits) SaveBase(db *VcsDb2) *VcsCommits {
 // from the repo.
 func (h *VcsCommits) LoadHashes(db *VcsDb2) *VcsCommits {
 	h.hashes = nil
+	h.sorted = nil
+	h.prefixLen = 0
 	if h.err == nil {
 		h.err = db.doLoadData(h.hashFile, func(line string) error {
 			h.hashes = append(h.hashes, vcs.Hash(line))
@@ -319,32 +770,91 @@ func (h *VcsCommits) SaveHashes(db *VcsDb2) *VcsCommits {
 // This is not ordered, but it is treated as an append-only list.
 func (h *VcsCommits) LoadCommits(db *VcsDb2) *VcsCommits {
 	h.commits = nil
+	if h.err == nil {
+		h.err = h.scanCommitFiles(db, func(c *Commit) error {
+			h.commits = append(h.commits, *c)
+			return nil
+		})
+	}
+	return h
+}
+
+// (*VcsCommits).ScanCommits reads the commit data from the database one commit
+// at a time, calling fn for each. Commits are not retained, so this can stream
+// through databases too large to load all at once.
+func (h *VcsCommits) ScanCommits(db *VcsDb2, fn func(c *Commit) error) error {
+	h.err = nil
+	if err := h.LoadBase(db).err; err != nil {
+		return err
+	}
+	return h.scanCommitFiles(db, fn)
+}
+
+// (*VcsCommits).scanCommitFiles parses each commit in the commit files, in order.
+func (h *VcsCommits) scanCommitFiles(db *VcsDb2, fn func(c *Commit) error) error {
+	var c Commit
+	var n int // number of commits started
 	for _, file := range h.commitFiles {
-		if h.err != nil {
-			break
-		}
-		var i int
-		h.err = db.doLoadData(file, func(line string) error {
+		err := db.doLoadData(file, func(line string) error {
 			var index int
 			if getkvint(line, &index, "-- ") {
-				i = len(h.commits)
-				h.commits = append(h.commits, Commit{})
-				if i != index {
-					return fmt.Errorf("invalid VcsCommits.commits: saw %d but wanted %d", index, i)
+				if n > 0 {
+					c.fillCommitter()
+					c.markNoAuthor()
+					if err := fn(&c); err != nil {
+						return err
+					}
+				}
+				if n != index {
+					return fmt.Errorf("invalid VcsCommits.commits: saw %d but wanted %d", index, n)
 				}
+				n += 1
+				c = Commit{}
+				return nil
 			}
-			if !getkvstr(line, &h.commits[i].hash, "hash=") &&
-				!getkvint(line, &h.commits[i].timestamp, "timestamp=") &&
-				!getkvstr(line, &h.commits[i].authorName, "authorName=") &&
-				!getkvstr(line, &h.commits[i].authorEmail, "authorEmail=") &&
-				!getkvstrlist(line, &h.commits[i].parents, "parents=") &&
-				!getkvstrlist(line, &h.commits[i].children, "children=") {
-					return fmt.Errorf("invalid VcsCommits.commits: %d", i)
+			if n == 0 {
+				return fmt.Errorf("invalid VcsCommits.commits: data before first commit")
+			}
+			var change string
+			if getkvstr(line, &change, "change=") {
+				ch, err := parseChange(change)
+				if err != nil {
+					return fmt.Errorf("invalid VcsCommits.commits: %d: %s", n-1, err)
+				}
+				c.changes = append(c.changes, ch)
+				return nil
+			}
+			if !getkvhash(line, &c.hash, "hash=") &&
+				!getkvint(line, &c.timestamp, "timestamp=") &&
+				!getkvint(line, &c.tzOffset, "tzOffset=") &&
+				!getkvstr(line, &c.authorName, "authorName=") &&
+				!getkvstr(line, &c.authorEmail, "authorEmail=") &&
+				!getkvstr(line, &c.rawAuthorName, "rawAuthorName=") &&
+				!getkvstr(line, &c.rawAuthorEmail, "rawAuthorEmail=") &&
+				!getkvstr(line, &c.committerName, "committerName=") &&
+				!getkvstr(line, &c.committerEmail, "committerEmail=") &&
+				!getkvint(line, &c.committerTimestamp, "committerTimestamp=") &&
+				!getkvstr(line, &c.rawCommitterName, "rawCommitterName=") &&
+				!getkvstr(line, &c.rawCommitterEmail, "rawCommitterEmail=") &&
+				!getkvbool(line, &c.shallowBoundary, "shallowBoundary=") &&
+				!getkvhashlist(line, &c.parents, "parents=") &&
+				!getkvhashlist(line, &c.children, "children=") &&
+				!getkvstr(line, &c.subject, "subject=") &&
+				!getkvescaped(line, &c.body, "body=") {
+					return fmt.Errorf("invalid VcsCommits.commits: %d", n-1)
 				}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
 	}
-	return h
+	if n > 0 {
+		c.fillCommitter()
+		c.markNoAuthor()
+		return fn(&c)
+	}
+	return nil
 }
 
 // (*VcsCommits).SaveCommits writes the commit data tp the database.
@@ -354,13 +864,7 @@ func (h *VcsCommits) SaveCommits(db *VcsDb2) *VcsCommits {
 		h.commitFiles = []string{h.name+".commits"}
 		var sb strings.Builder
 		h.err = db.doSaveDataN(h.commitFiles[0], len(h.commits), func(i int) string {
-			sb.WriteString(fmt.Sprintf("-- %d\n", i))
-			sb.WriteString(fmt.Sprintf("hash=%s\n", string(h.commits[i].hash)))
-			sb.WriteString(fmt.Sprintf("timestamp=%d\n", h.commits[i].timestamp))
-			sb.WriteString(fmt.Sprintf("authorName=%s\n", h.commits[i].authorName))
-			sb.WriteString(fmt.Sprintf("authorEmail=%s\n", h.commits[i].authorEmail))
-			sb.WriteString(fmt.Sprintf("parents=%s\n", strings.Join(h.commits[i].parents, " ")))
-			sb.WriteString(fmt.Sprintf("children=%s\n", strings.Join(h.commits[i].children, " ")))
+			formatCommit(&sb, i, &h.commits[i])
 			joined := sb.String()
 			sb.Reset()
 			return joined
@@ -369,90 +873,188 @@ func (h *VcsCommits) SaveCommits(db *VcsDb2) *VcsCommits {
 	return h
 }
 
-// ----------------------------------------------------------------------------------------------
-
-func (db *VcsDb2) doLoadDataRequired(name string, callback func(line string) error) error {
-	path := filepath.Join(db.dbPath, name)
-	if _, err := os.Stat(path); err != nil {
-		return err
+// formatCommit writes commit number index in its persisted form.
+func formatCommit(sb *strings.Builder, index int, c *Commit) {
+	sb.WriteString(fmt.Sprintf("-- %d\n", index))
+	sb.WriteString(fmt.Sprintf("hash=%s\n", string(c.hash)))
+	sb.WriteString(fmt.Sprintf("timestamp=%d\n", c.timestamp))
+	if c.tzOffset != 0 {
+		sb.WriteString(fmt.Sprintf("tzOffset=%d\n", c.tzOffset))
+	}
+	sb.WriteString(fmt.Sprintf("authorName=%s\n", c.authorName))
+	sb.WriteString(fmt.Sprintf("authorEmail=%s\n", c.authorEmail))
+	if c.rawAuthorName != "" || c.rawAuthorEmail != "" {
+		sb.WriteString(fmt.Sprintf("rawAuthorName=%s\n", c.rawAuthorName))
+		sb.WriteString(fmt.Sprintf("rawAuthorEmail=%s\n", c.rawAuthorEmail))
+	}
+	if !c.committedByAuthor() {
+		sb.WriteString(fmt.Sprintf("committerName=%s\n", c.committerName))
+		sb.WriteString(fmt.Sprintf("committerEmail=%s\n", c.committerEmail))
+		sb.WriteString(fmt.Sprintf("committerTimestamp=%d\n", c.committerTimestamp))
+		if c.rawCommitterName != "" || c.rawCommitterEmail != "" {
+			sb.WriteString(fmt.Sprintf("rawCommitterName=%s\n", c.rawCommitterName))
+			sb.WriteString(fmt.Sprintf("rawCommitterEmail=%s\n", c.rawCommitterEmail))
+		}
+	}
+	if c.shallowBoundary {
+		sb.WriteString("shallowBoundary=true\n")
+	}
+	sb.WriteString(fmt.Sprintf("parents=%s\n", vcs.JoinHashes(c.parents, " ")))
+	sb.WriteString(fmt.Sprintf("children=%s\n", vcs.JoinHashes(c.children, " ")))
+	sb.WriteString(fmt.Sprintf("subject=%s\n", c.subject))
+	if c.body != "" {
+		sb.WriteString(fmt.Sprintf("body=%s\n", escapeText(c.body)))
+	}
+	for _, ch := range c.changes {
+		sb.WriteString(fmt.Sprintf("change=%s\n", formatChange(ch)))
 	}
-	return db.doLoadData(name, callback)
 }
 
-func (db *VcsDb2) doLoadData(name string, callback func(line string) error) error {
-	path := filepath.Join(db.dbPath, name)
+// committedByAuthor is true if the author made the commit, when it was
+// authored, as for most commits. Those are saved without their committer,
+// which fillCommitter puts back.
+func (c *Commit) committedByAuthor() bool {
+	return c.committerName == c.authorName && c.committerEmail == c.authorEmail &&
+		c.committerTimestamp == c.timestamp &&
+		c.rawCommitterName == c.rawAuthorName && c.rawCommitterEmail == c.rawAuthorEmail
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		return nil
+// fillCommitter makes the author the committer of a commit saved without
+// one; see committedByAuthor.
+func (c *Commit) fillCommitter() {
+	if c.committerName != "" || c.committerEmail != "" || c.committerTimestamp != 0 {
+		return
 	}
-	defer f.Close()
+	c.committerName, c.committerEmail, c.committerTimestamp = c.authorName, c.authorEmail, c.timestamp
+	c.rawCommitterName, c.rawCommitterEmail = c.rawAuthorName, c.rawAuthorEmail
+}
 
-	fs := bufio.NewScanner(f)
-	for fs.Scan() {
-		if err := callback(fs.Text()); err != nil {
-			return err
-		}
+// formatChange turns a Change into its persisted form:
+// "<add>\t<remove>\t<flags>\t<path>\t<oldPath>", where flags is some of
+// "b" (binary), "c" (create), "d" (delete), "r" (rename), or "-" for none.
+func formatChange(ch Change) string {
+	var flags string
+	if ch.binary {
+		flags += "b"
+	}
+	if ch.create {
+		flags += "c"
+	}
+	if ch.delete {
+		flags += "d"
+	}
+	if ch.rename {
+		flags += "r"
+	}
+	if flags == "" {
+		flags = "-"
 	}
-	return fs.Err()
+	return fmt.Sprintf("%d\t%d\t%s\t%s\t%s", ch.add, ch.remove, flags, formatPath(ch.path), formatPath(ch.oldPath))
 }
 
-func (db *VcsDb2) doLoadDataLines(name string) ([]string, error) {
-	path := filepath.Join(db.dbPath, name)
-
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// parseChange is the inverse of formatChange.
+func parseChange(text string) (Change, error) {
+	var ch Change
+	fields := strings.Split(text, "\t")
+	if len(fields) != 5 {
+		return ch, fmt.Errorf("bad change '%s'", text)
 	}
-	defer f.Close()
+	var err1, err2 error
+	ch.add, err1 = strconv.Atoi(fields[0])
+	ch.remove, err2 = strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return ch, fmt.Errorf("bad change counts '%s'", text)
+	}
+	ch.binary = strings.Contains(fields[2], "b")
+	ch.create = strings.Contains(fields[2], "c")
+	ch.delete = strings.Contains(fields[2], "d")
+	ch.rename = strings.Contains(fields[2], "r")
+	ch.path = parsePath(fields[3])
+	ch.oldPath = parsePath(fields[4])
+	return ch, nil
+}
 
-	var lines []string
-	fs := bufio.NewScanner(f)
-	for fs.Scan() {
-		lines = append(lines, fs.Text())
+// formatPath makes a path safe to persist as a tab-separated field: one with
+// a tab or a line break in it, or that starts with a quote, is written
+// quoted.
+func formatPath(path string) string {
+	if strings.ContainsAny(path, "\t\n\r") || strings.HasPrefix(path, `"`) {
+		return strconv.Quote(path)
 	}
-	return lines, fs.Err()
+	return path
 }
 
-func (db *VcsDb2) doSaveData(name string, callback func() string) error {
-	path := filepath.Join(db.dbPath, name)
+// parsePath is the inverse of formatPath. It also decodes the git-quoted
+// paths that databases kept before they were decoded on the way in.
+func parsePath(text string) string {
+	return vcs.GitUnquotePath(text)
+}
 
-	f, err := os.Create(path)
+// ----------------------------------------------------------------------------------------------
+
+// warningsName is the file holding the warnings from the last analysis.
+const warningsName = "warnings"
+
+// removeData removes a data file, if there is one.
+func (db *VcsDb2) removeData(name string) error {
+	return db.store.Remove(name)
+}
+
+func (db *VcsDb2) doLoadDataRequired(name string, callback func(line string) error) error {
+	r, err := db.openData(name)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
+	defer r.Close()
 
-	line := callback()
-	for line != "" {
-		_, err = w.WriteString(line)
-		if err != nil {
-			return err
-		}
-		line = callback()
+	return gsos.ScanLines(r, callback)
+}
+
+func (db *VcsDb2) doLoadData(name string, callback func(line string) error) error {
+	r, err := db.openData(name)
+	if err != nil {
+		return nil
 	}
+	defer r.Close()
 
-	return nil
+	return gsos.ScanLines(r, callback)
 }
 
-func (db *VcsDb2) doSaveDataN(name string, N int, callback func(int) string) error {
-	path := filepath.Join(db.dbPath, name)
-
-	f, err := os.Create(path)
+func (db *VcsDb2) doLoadDataLines(name string) ([]string, error) {
+	r, err := db.openData(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
+	defer r.Close()
 
-	for i := 0; i < N; i++ {
-		_, err = w.WriteString(callback(i))
-	}
+	var lines []string
+	err = gsos.ScanLines(r, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	return lines, err
+}
 
-	return nil
+func (db *VcsDb2) doSaveData(name string, callback func() string) error {
+	return db.doSaveDataWorker(name, func(w *bufio.Writer) error {
+		for line := callback(); line != ""; line = callback() {
+			if _, err := w.WriteString(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *VcsDb2) doSaveDataN(name string, N int, callback func(int) string) error {
+	return db.doSaveDataWorker(name, func(w *bufio.Writer) error {
+		for i := 0; i < N; i++ {
+			if _, err := w.WriteString(callback(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (db *VcsDb2) doSaveDataLines(name string, lines []string) error {
@@ -466,18 +1068,36 @@ func (db *VcsDb2) doSaveDataLines(name string, lines []string) error {
 	})
 }
 
+// doSaveDataWorker creates the named file and calls worker to write it, through
+// a compressor for a large file in a compressed database (see SetCompressed). Write,
+// flush and close errors are all returned, so a full disk isn't mistaken for
+// a successful save. The store only replaces the old file once all of the
+// new one is written; if anything fails, the old file is left as it was.
 func (db *VcsDb2) doSaveDataWorker(name string, worker func(w *bufio.Writer) error) error {
-	path := filepath.Join(db.dbPath, name)
-
-	f, err := os.Create(path)
+	f, err := db.store.Writer(name)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
+	zw, finish := db.compressWriter(name, f)
+	w := bufio.NewWriter(zw)
 
-	return worker(w)
+	err = worker(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		if sw, ok := f.(storeWriter); ok {
+			sw.Abort()
+			return err
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Get the stringlist value of a key=value pair
@@ -495,6 +1115,26 @@ func getkvstrlist(text string, val *[]string, prefix string) bool {
 	return true
 }
 
+// Get the hash value of a key=value pair
+func getkvhash(text string, val *vcs.Hash, prefix string) bool {
+	var str string
+	if !getkvstr(text, &str, prefix) {
+		return false
+	}
+	*val = vcs.Hash(str)
+	return true
+}
+
+// Get the space-separated hash list value of a key=value pair
+func getkvhashlist(text string, val *[]vcs.Hash, prefix string) bool {
+	var str string
+	if !getkvstr(text, &str, prefix) {
+		return false
+	}
+	*val = vcs.ParseHashList(str)
+	return true
+}
+
 // Get the string value of a key=value pair
 func getkvstr(text string, val *string, prefix string) bool {
 	n := len(prefix)
@@ -505,6 +1145,52 @@ func getkvstr(text string, val *string, prefix string) bool {
 	return true
 }
 
+// Get the value of a key=value pair written with escapeText
+func getkvescaped(text string, val *string, prefix string) bool {
+	var str string
+	if !getkvstr(text, &str, prefix) {
+		return false
+	}
+	*val = unescapeText(str)
+	return true
+}
+
+// escapeText makes multi-line text fit on one line of a data file, writing
+// newlines as "\n", carriage returns as "\r" and backslashes as "\\".
+func escapeText(text string) string {
+	return textEscaper.Replace(text)
+}
+
+var textEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+// unescapeText undoes escapeText. A backslash before anything else is kept.
+func unescapeText(text string) string {
+	if !strings.Contains(text, "\\") {
+		return text
+	}
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			switch text[i+1] {
+			case 'n':
+				sb.WriteByte('\n')
+				i++
+				continue
+			case 'r':
+				sb.WriteByte('\r')
+				i++
+				continue
+			case '\\':
+				sb.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(text[i])
+	}
+	return sb.String()
+}
+
 // Get the int value of a key=value pair
 func getkvint(text string, val *int, prefix string) bool {
 	var numStr string
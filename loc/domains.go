@@ -0,0 +1,154 @@
+// vcsloc/loc/domains.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"vcsloc/gsos"
+)
+
+// unknownDomain is the domain of an email that doesn't have one.
+const unknownDomain = "(unknown)"
+
+// DomainMap folds email domains together before they're counted, e.g. a
+// company's many subdomains into the company. A domain map file has one rule
+// per line, a domain and what it's counted as:
+//
+//	*.redhat.com redhat.com
+//	us.ibm.com ibm.com
+//
+// "*." matches any subdomain (but not the domain itself). An exact rule wins
+// over a wildcard, and a longer wildcard over a shorter one. Matching ignores
+// case, and "#" starts a comment.
+type DomainMap struct {
+	exact map[string]string
+	wildcards []domainRule // longest suffix first
+}
+
+// domainRule is a wildcard rule: domains ending in suffix (".redhat.com")
+// are counted as domain.
+type domainRule struct {
+	suffix string
+	domain string
+}
+
+// LoadDomainMap reads a domain map file.
+func LoadDomainMap(path string) (*DomainMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDomainMap(f)
+}
+
+// ParseDomainMap reads a domain map. Unlike a mailmap, a line that isn't a
+// rule is an error, since a typo would quietly leave a domain unfolded.
+func ParseDomainMap(r io.Reader) (*DomainMap, error) {
+	m := &DomainMap{exact: make(map[string]string)}
+	lineNum := 0
+	err := gsos.ScanLines(r, func(line string) error {
+		lineNum += 1
+		if pos := strings.Index(line, "#"); pos != -1 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 {
+			return nil
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("domain map line %d: want '<domain> <counted-as>': %s", lineNum, line)
+		}
+		if strings.HasPrefix(fields[0], "*.") {
+			m.wildcards = append(m.wildcards, domainRule{suffix: fields[0][1:], domain: fields[1]})
+		} else {
+			m.exact[fields[0]] = fields[1]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(m.wildcards, func(i, j int) bool { return len(m.wildcards[i].suffix) > len(m.wildcards[j].suffix) })
+	return m, nil
+}
+
+// Fold returns what domain is counted as. A nil map folds nothing.
+func (m *DomainMap) Fold(domain string) string {
+	if m == nil {
+		return domain
+	}
+	if folded, ok := m.exact[domain]; ok {
+		return folded
+	}
+	for _, rule := range m.wildcards {
+		if strings.HasSuffix(domain, rule.suffix) {
+			return rule.domain
+		}
+	}
+	return domain
+}
+
+// emailDomain returns the lowercased part of email after the "@", or
+// unknownDomain if there isn't one.
+func emailDomain(email string) string {
+	pos := strings.LastIndex(email, "@")
+	if pos == -1 || pos == len(email)-1 {
+		return unknownDomain
+	}
+	return strings.ToLower(email[pos+1:])
+}
+
+// DomainStats counts the commits from each email domain of the authors (or
+// committers), folded with domains (which can be nil). The emails are the
+// ones after the mailmap, if there was one. An email with no domain counts
+// as "(unknown)".
+func (db *VcsDb2) DomainStats(role Role, domains *DomainMap) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		_, email, _ := c.identity(role)
+		domain := emailDomain(email)
+		if domain != unknownDomain {
+			domain = domains.Fold(domain)
+		}
+		counts[domain] += 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// WriteDomainStats writes the domain counts, one domain per line: commits,
+// percentage of all commits, and the domain. They're sorted by commit count
+// (descending), then by domain.
+func (db *VcsDb2) WriteDomainStats(w io.Writer, role Role, domains *DomainMap) error {
+	counts, err := db.DomainStats(role, domains)
+	if err != nil {
+		return err
+	}
+	var total int
+	names := make([]string, 0, len(counts))
+	for domain, n := range counts {
+		names = append(names, domain)
+		total += n
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, domain := range names {
+		if _, err := fmt.Fprintf(w, "%7d commits %5.1f%%  %s\n", counts[domain], percent(counts[domain], total), domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
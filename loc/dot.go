@@ -0,0 +1,128 @@
+// vcsloc/loc/dot.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// DotOpts picks the part of the graph WriteDOT draws; the whole graph of a
+// big repo is more than Graphviz (or anyone) can make sense of.
+type DotOpts struct {
+	Last int // only the newest N commits; 0 for all of them
+	Ref string // only this ref and its ancestors: a full refname, or a branch, tag or remote name; "" for all refs
+}
+
+// WriteDOT writes the commit graph in Graphviz DOT form, for "dot -Tsvg".
+// Each commit points at its parents. Merges (more than one parent) and
+// branch points (more than one child) are drawn in different colors, and ref
+// tips are labeled with their refnames. Edges to commits that were left out
+// aren't drawn.
+func (db *VcsDb2) WriteDOT(w io.Writer, opts DotOpts) error {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return err
+		}
+	}
+	if err := db.refs.Load(db); err != nil {
+		return err
+	}
+	graph := db.graph.graph
+
+	labels := make(map[vcs.Hash][]string)
+	var start []vcs.Hash
+	for _, ref := range db.refs.CommitRefs() {
+		labels[ref.RefHash] = append(labels[ref.RefHash], ref.Refname)
+		if opts.Ref != "" && refMatches(ref.Refname, opts.Ref) {
+			start = append(start, ref.RefHash)
+		}
+	}
+
+	var hashes []vcs.Hash
+	if opts.Ref != "" {
+		if len(start) == 0 {
+			return fmt.Errorf("no ref '%s'", opts.Ref)
+		}
+		for hash := range ancestors(graph, start) {
+			hashes = append(hashes, hash)
+		}
+	} else {
+		for hash := range graph {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	// Newest first, so that Last keeps the newest
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := graph[hashes[i]], graph[hashes[j]]
+		if a.timestamp != b.timestamp {
+			return a.timestamp > b.timestamp
+		}
+		return hashes[i] < hashes[j]
+	})
+	if opts.Last > 0 && len(hashes) > opts.Last {
+		hashes = hashes[:opts.Last]
+	}
+	included := make(map[vcs.Hash]bool, len(hashes))
+	for _, hash := range hashes {
+		included[hash] = true
+	}
+
+	prefixLen := db.AbbrevLen()
+	var sb strings.Builder
+	sb.WriteString("digraph vcsloc {\n")
+	sb.WriteString("\tnode [shape=box, style=filled, fillcolor=white, fontname=\"monospace\"];\n")
+	for _, hash := range hashes {
+		c := graph[hash]
+		label := append([]string{hash.Abbrev(prefixLen)}, labels[hash]...)
+		attrs := fmt.Sprintf("label=%s", dotQuote(strings.Join(label, "\n")))
+		switch {
+		case len(c.parents) > 1:
+			attrs += ", fillcolor=lightblue"
+		case len(c.children) > 1:
+			attrs += ", fillcolor=lightyellow"
+		}
+		if len(labels[hash]) > 0 {
+			attrs += ", penwidth=2"
+		}
+		fmt.Fprintf(&sb, "\t%s [%s];\n", dotQuote(string(hash)), attrs)
+	}
+	for _, hash := range hashes {
+		for _, parent := range graph[hash].parents {
+			if included[parent] {
+				fmt.Fprintf(&sb, "\t%s -> %s;\n", dotQuote(string(hash)), dotQuote(string(parent)))
+			}
+		}
+	}
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// refMatches is true if refname is name, or is name under refs/heads,
+// refs/tags or refs/remotes.
+func refMatches(refname string, name string) bool {
+	if refname == name {
+		return true
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if refname == prefix+name {
+			return true
+		}
+	}
+	return false
+}
+
+// dotQuote makes s a quoted DOT string. A newline becomes a DOT line break.
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
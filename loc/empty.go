@@ -0,0 +1,75 @@
+// vcsloc/loc/empty.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+
+	"vcsloc/vcs"
+)
+
+// EmptyCommits is the result of the empty commit check.
+type EmptyCommits struct {
+	Commits int // all commits
+	Empty []vcs.Hash // non-merge commits with no file changes, newest first
+	CleanMerges int // merges with no changes of their own (not counted as empty)
+}
+
+// EmptyCommits finds non-merge commits that change no files, such as those
+// made with "git commit --allow-empty". Merges are left out: a merge that
+// resolved without conflicts has no diff against all of its parents, which is
+// normal, so those are only counted. Root commits with no files are reported
+// as empty.
+func (db *VcsDb2) EmptyCommits() (*EmptyCommits, error) {
+	if haveStats, err := db.HaveStats(); err != nil {
+		return nil, err
+	} else if !haveStats {
+		return nil, ErrNoStats
+	}
+	if firstParent, err := db.FirstParentStats(); err != nil {
+		return nil, err
+	} else if firstParent {
+		// commits off the mainline have no stats, so they'd all look empty
+		return nil, fmt.Errorf("database has mainline stats only (it was analyzed with --first-parent)")
+	}
+
+	result := &EmptyCommits{}
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		result.Commits += 1
+		if len(c.changes) != 0 {
+			return nil
+		}
+		if len(c.parents) > 1 {
+			result.CleanMerges += 1
+		} else {
+			result.Empty = append(result.Empty, c.hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WriteEmptyReport writes the count of empty commits and their hashes.
+func (db *VcsDb2) WriteEmptyReport(w io.Writer) error {
+	result, err := db.EmptyCommits()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "commits:       %d\n", result.Commits)
+	fmt.Fprintf(w, "empty:         %d (%.1f%%)\n", len(result.Empty), percent(len(result.Empty), result.Commits))
+	fmt.Fprintf(w, "clean merges:  %d\n", result.CleanMerges)
+	if len(result.Empty) > 0 {
+		fmt.Fprintf(w, "\n")
+	}
+	for _, hash := range result.Empty {
+		if _, err := fmt.Fprintf(w, "%s\n", hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// vcsloc/loc/exclude.go
+
+package loc
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// PathFilter is a set of glob patterns for paths to leave out of the change
+// stats, e.g. vendored or generated code. Patterns are matched with
+// path.Match a segment at a time, and "**" matches any number of segments:
+//
+//	vendor/**        everything under vendor at the top
+//	**/testdata/**   everything under any testdata directory
+//	*.pb.go          a pattern without a "/" matches a name at any level
+//	third_party      a directory that matches excludes everything under it
+type PathFilter struct {
+	patterns []string
+}
+
+// NewPathFilter checks and compiles the patterns. No patterns give a nil
+// filter, which matches nothing.
+func NewPathFilter(patterns []string) (*PathFilter, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	f := &PathFilter{}
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("bad path pattern '%s'", pattern)
+		}
+		f.patterns = append(f.patterns, pattern)
+	}
+	return f, nil
+}
+
+// Patterns returns the patterns, as they're recorded in the database.
+func (f *PathFilter) Patterns() []string {
+	if f == nil {
+		return nil
+	}
+	return f.patterns
+}
+
+// Match is true if p is excluded by any of the patterns.
+func (f *PathFilter) Match(p string) bool {
+	if f == nil {
+		return false
+	}
+	segments := strings.Split(p, "/")
+	for _, pattern := range f.patterns {
+		if !strings.Contains(pattern, "/") {
+			for _, segment := range segments {
+				if ok, _ := path.Match(pattern, segment); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if matchSegments(strings.Split(pattern, "/"), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches a pattern against a path, both split on "/". The
+// path can go on past the end of the pattern, since a matching directory
+// takes everything under it.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return true
+}
+
+// filterChanges drops the changes to excluded paths. A rename with only one
+// side excluded becomes a delete of the old path or a create of the new
+// one, keeping its line counts; a copy from an excluded path becomes a
+// create.
+func (f *PathFilter) filterChanges(changes []Change) []Change {
+	if f == nil || len(changes) == 0 {
+		return changes
+	}
+	kept := changes[:0]
+	for _, ch := range changes {
+		excluded := f.Match(ch.path)
+		switch {
+		case ch.rename && ch.oldPath != "":
+			oldExcluded := f.Match(ch.oldPath)
+			if excluded && oldExcluded {
+				continue
+			}
+			if excluded {
+				ch.path, ch.oldPath = ch.oldPath, ""
+				ch.rename, ch.create, ch.delete = false, false, true
+			} else if oldExcluded {
+				ch.oldPath = ""
+				ch.rename, ch.create = false, true
+			}
+		case excluded:
+			continue
+		case ch.oldPath != "" && f.Match(ch.oldPath):
+			ch.oldPath = ""
+		}
+		kept = append(kept, ch)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// SetExcludePaths leaves the paths that f matches out of the change stats.
+// The patterns are recorded in the database, and stats gathered with other
+// patterns are fetched again.
+func (work *Analyzer) SetExcludePaths(f *PathFilter) {
+	work.exclude = f
+}
+
+// SetExcludePaths leaves the paths that f matches out of the change stats.
+func (db *VcsDb) SetExcludePaths(f *PathFilter) {
+	db.exclude = f
+}
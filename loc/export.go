@@ -0,0 +1,78 @@
+// vcsloc/loc/export.go
+
+package loc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoStats is returned by reports that need per-file change stats when the
+// database was built without them.
+var ErrNoStats = errors.New("database has no change stats (it was analyzed with --no-stat); analyze again with --include-stat")
+
+// ErrNoLineCounts is returned by reports that count lines when the database's
+// change stats don't have them.
+var ErrNoLineCounts = errors.New("database has no line counts (it was imported from a fast-export stream); analyze the repo instead")
+
+// ErrNoSQLite is returned by ExportSQLite in builds without SQLite support.
+var ErrNoSQLite = errors.New("vcsloc was built without SQLite support; rebuild with -tags sqlite")
+
+// changeRecord is one file change in the flat JSON Lines export.
+type changeRecord struct {
+	Commit string `json:"commit"`
+	Timestamp int `json:"timestamp"`
+	Author string `json:"author"`
+	Path string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+	Add int `json:"add"`
+	Remove int `json:"remove"`
+	Binary bool `json:"binary"`
+	Change string `json:"change"`
+}
+
+// ExportChangesJSONL writes every file change of every commit to w as JSON Lines,
+// one object per file change. This is the flat ("long") form of the per-commit
+// change data, suited to loading into analysis tools. Commits are streamed from
+// the database one at a time, so memory use doesn't grow with the repo.
+// It returns the number of records written.
+func (db *VcsDb2) ExportChangesJSONL(w io.Writer) (int, error) {
+	if haveStats, err := db.HaveStats(); err != nil {
+		return 0, err
+	} else if !haveStats {
+		return 0, ErrNoStats
+	}
+	if haveLines, err := db.HaveLineCounts(); err != nil {
+		return 0, err
+	} else if !haveLines {
+		return 0, ErrNoLineCounts
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	var count int
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		for i := range c.changes {
+			ch := &c.changes[i]
+			rec := changeRecord{
+				Commit: string(c.hash),
+				Timestamp: c.timestamp,
+				Author: fmt.Sprintf("%s <%s>", c.authorName, c.authorEmail),
+				Path: ch.path,
+				OldPath: ch.oldPath,
+				Add: ch.add,
+				Remove: ch.remove,
+				Binary: ch.binary,
+				Change: ch.kind(),
+			}
+			if err := enc.Encode(&rec); err != nil {
+				return err
+			}
+			count += 1
+		}
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,470 @@
+// vcsloc/loc/fastexport.go
+
+package loc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// ImportFastExport builds the database from a "git fast-export" stream instead of
+// a live repo, so that a dump can be analyzed without its object store. Commit
+// records (mark, author, committer, from/merge, file changes), resets and tags
+// are used; blobs are skipped.
+//
+// Commits are identified by their original-oid if the stream has one (fast-export
+// --show-original-ids), otherwise by a synthetic id made from the mark number,
+// zero-padded to the width of a git hash. File changes are recorded by kind
+// (modify/delete/rename/copy) only; the stream has no line counts, so reports
+// that count lines (see HaveLineCounts) turn the database down.
+func (work *Analyzer) ImportFastExport(r io.Reader) error {
+	// The stream can be slow to start if it's piped from fast-export
+	defer work.terminal.Busyf("Reading fast-export stream...")()
+
+	p := &fastExportParser{
+		r: bufio.NewReader(r),
+		marks: make(map[string]vcs.Hash),
+		branches: make(map[string]vcs.Hash),
+	}
+	if err := p.parse(func(n int) {
+		if work.terminal.Ready() {
+			work.terminal.Progressf("Reading fast-export stream (%d commits)...", n)
+		}
+	}); err != nil {
+		return err
+	}
+
+	// Match "git log --all" order, which is newest first. The commits then go
+	// through the mailmap, path exclusions and streams like fetched ones.
+	commits := make([]Commit, len(p.commits))
+	hashes := make([]vcs.Hash, len(p.commits))
+	for i, c := range p.commits {
+		n := len(p.commits) - 1 - i
+		commits[n] = c
+		hashes[n] = c.hash
+	}
+	for i := range commits {
+		work.applyMailmap(&commits[i])
+		work.finishCommit(&commits[i], true)
+	}
+	work.finishStatStream()
+	work.finishCommitStream()
+
+	var refs []vcs.Ref
+	for refname, hash := range p.branches {
+		if hash != "" {
+			refs = append(refs, vcs.Ref{RefHash: hash, Refname: refname})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Refname < refs[j].Refname })
+
+	work.db.refs.refs = refs
+	work.db.refs.dirty = true
+	work.db.info.refsListSignature = "" // the repo's refs have to be listed again
+	if err := work.db.setDefaultBranch(vcs.GuessDefaultBranch(refs)); err != nil {
+		return err
+	}
+
+	work.db.commits.SetHashes(hashes)
+	work.db.commits.commits = commits
+
+	work.db.info.numRepoCommits = len(commits)
+	work.db.info.graphUpToDate = false
+	work.db.info.haveStats = work.storeStats
+	work.db.info.noLineCounts = true // the stream has file changes, but no line counts
+	work.db.info.haveCommitters = true
+	work.db.info.mailmap = work.mailmapSignature()
+	work.db.info.excludePaths = nil
+	if work.db.info.haveStats {
+		work.db.info.excludePaths = work.exclude.Patterns()
+	}
+	work.db.info.dirty = true
+
+	work.terminal.Printf("Got %d commits, %d refs from fast-export stream\n", len(commits), len(refs))
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// fastExportParser holds the state of a fast-export stream as it is read.
+type fastExportParser struct {
+	r *bufio.Reader
+	line string // current line, without the trailing LF
+	lineNum int
+	eof bool
+
+	commits []Commit
+	marks map[string]vcs.Hash // ":<n>" to commit hash
+	branches map[string]vcs.Hash // refname to current tip ("" after a reset)
+	unmarked uint64 // count of commits without a mark, used for synthetic ids
+}
+
+// next reads the next line into p.line. It returns false at end of stream.
+func (p *fastExportParser) next() (bool, error) {
+	if p.eof {
+		return false, nil
+	}
+	line, err := p.r.ReadString('\n')
+	if err == io.EOF {
+		p.eof = true
+		if line == "" {
+			return false, nil
+		}
+	} else if err != nil {
+		return false, err
+	}
+	p.lineNum += 1
+	p.line = strings.TrimSuffix(line, "\n")
+	return true, nil
+}
+
+// errorf reports a parse error at the current line.
+func (p *fastExportParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("fast-export line %d: %s", p.lineNum, fmt.Sprintf(format, a...))
+}
+
+// parse reads the whole stream. progress is called after each commit.
+func (p *fastExportParser) parse(progress func(n int)) error {
+	ok, err := p.next()
+	for ok && err == nil {
+		cmd := p.line
+		switch {
+		case cmd == "":
+			ok, err = p.next()
+		case strings.HasPrefix(cmd, "commit "):
+			ok, err = p.parseCommit(strings.TrimPrefix(cmd, "commit "))
+			progress(len(p.commits))
+		case strings.HasPrefix(cmd, "reset "):
+			ok, err = p.parseReset(strings.TrimPrefix(cmd, "reset "))
+		case strings.HasPrefix(cmd, "tag "):
+			ok, err = p.parseTag(strings.TrimPrefix(cmd, "tag "))
+		case cmd == "blob":
+			ok, err = p.skipRecord()
+		case cmd == "done":
+			ok = false
+		default:
+			// feature, option, progress, checkpoint and the like don't describe history
+			ok, err = p.next()
+		}
+	}
+	return err
+}
+
+// parseCommit reads a commit record; p.line is the "commit" line.
+func (p *fastExportParser) parseCommit(refname string) (bool, error) {
+	var c Commit
+	var mark, oid, committer string
+	var explicitFrom bool
+
+	ok, err := p.next()
+	for ok && err == nil {
+		L := p.line
+		switch {
+		case strings.HasPrefix(L, "mark "):
+			mark = L[5:]
+		case strings.HasPrefix(L, "original-oid "):
+			oid = L[13:]
+		case strings.HasPrefix(L, "author "):
+			if c.authorName, c.authorEmail, c.timestamp, c.tzOffset, err = parseFastExportPerson(L[7:]); err != nil {
+				return false, p.errorf("%s", err)
+			}
+		case strings.HasPrefix(L, "committer "):
+			committer = L[10:]
+		case strings.HasPrefix(L, "encoding "):
+		case strings.HasPrefix(L, "data "):
+			var msg string
+			if msg, err = p.readData(L[5:]); err != nil {
+				return false, err
+			}
+			c.subject, c.body = splitMessage(msg)
+		case strings.HasPrefix(L, "from "):
+			explicitFrom = true
+			if parent := p.resolve(L[5:]); parent != "" {
+				c.parents = append(c.parents, parent)
+			}
+		case strings.HasPrefix(L, "merge "):
+			if parent := p.resolve(L[6:]); parent != "" {
+				c.parents = append(c.parents, parent)
+			}
+		case L == "deleteall":
+		case strings.HasPrefix(L, "M "):
+			fields := strings.SplitN(L, " ", 4)
+			if len(fields) != 4 {
+				return false, p.errorf("bad filemodify: '%s'", L)
+			}
+			c.changes = append(c.changes, Change{path: vcs.GitUnquotePath(fields[3])})
+			if fields[2] == "inline" {
+				// The file's content follows as a data block; it isn't the message
+				if err = p.skipInlineData(); err != nil {
+					return false, err
+				}
+			}
+		case strings.HasPrefix(L, "N "):
+			if strings.HasPrefix(L, "N inline ") {
+				if err = p.skipInlineData(); err != nil {
+					return false, err
+				}
+			}
+		case strings.HasPrefix(L, "D "):
+			c.changes = append(c.changes, Change{path: vcs.GitUnquotePath(L[2:]), delete: true})
+		case strings.HasPrefix(L, "R "), strings.HasPrefix(L, "C "):
+			oldPath, path, valid := splitFastExportPaths(L[2:])
+			if !valid {
+				return false, p.errorf("bad filerename/filecopy: '%s'", L)
+			}
+			c.changes = append(c.changes, Change{path: path, oldPath: oldPath, rename: L[0] == 'R', create: L[0] == 'C'})
+		case L == "":
+			// blank line ends the record
+			ok, err = p.next()
+			return p.finishCommit(refname, &c, mark, oid, committer, explicitFrom, ok, err)
+		default:
+			// start of the next record
+			return p.finishCommit(refname, &c, mark, oid, committer, explicitFrom, true, nil)
+		}
+		if err != nil {
+			return false, err
+		}
+		ok, err = p.next()
+	}
+	return p.finishCommit(refname, &c, mark, oid, committer, explicitFrom, ok, err)
+}
+
+// finishCommit assigns an id to a parsed commit and advances its branch.
+func (p *fastExportParser) finishCommit(refname string, c *Commit, mark, oid, committer string, explicitFrom bool, ok bool, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	if committer != "" {
+		var perr error
+		if c.committerName, c.committerEmail, c.committerTimestamp, _, perr = parseFastExportPerson(committer); perr != nil {
+			return false, p.errorf("%s", perr)
+		}
+	}
+
+	// git fast-import falls back to the committer if there's no author line
+	if c.authorName == "" && c.authorEmail == "" && committer != "" {
+		var perr error
+		if c.authorName, c.authorEmail, c.timestamp, c.tzOffset, perr = parseFastExportPerson(committer); perr != nil {
+			return false, p.errorf("%s", perr)
+		}
+	}
+	c.markNoAuthor()
+
+	// Without a from line, a commit continues the existing branch
+	if !explicitFrom {
+		if tip := p.branches[refname]; tip != "" {
+			c.parents = append([]vcs.Hash{tip}, c.parents...)
+		}
+	}
+
+	switch {
+	case oid != "":
+		c.hash = vcs.Hash(oid)
+	case mark != "":
+		n, perr := strconv.ParseUint(strings.TrimPrefix(mark, ":"), 10, 64)
+		if perr != nil {
+			return false, p.errorf("bad mark '%s'", mark)
+		}
+		c.hash = vcs.Hash(fmt.Sprintf("%040x", n))
+	default:
+		p.unmarked += 1
+		c.hash = vcs.Hash(fmt.Sprintf("%040x", uint64(1)<<63|p.unmarked))
+	}
+
+	if mark != "" {
+		p.marks[mark] = c.hash
+	}
+	p.branches[refname] = c.hash
+	p.commits = append(p.commits, *c)
+	return ok, nil
+}
+
+// parseReset reads a reset record, which moves or clears a branch.
+func (p *fastExportParser) parseReset(refname string) (bool, error) {
+	p.branches[refname] = ""
+	ok, err := p.next()
+	if ok && err == nil && strings.HasPrefix(p.line, "from ") {
+		p.branches[refname] = p.resolve(p.line[5:])
+		ok, err = p.next()
+	}
+	return ok, err
+}
+
+// parseTag reads an annotated tag record, recording it as a ref on its commit.
+func (p *fastExportParser) parseTag(name string) (bool, error) {
+	var target vcs.Hash
+	ok, err := p.next()
+	for ok && err == nil {
+		L := p.line
+		if strings.HasPrefix(L, "from ") {
+			target = p.resolve(L[5:])
+		} else if strings.HasPrefix(L, "data ") {
+			if _, err = p.readData(L[5:]); err != nil {
+				return false, err
+			}
+		} else if !strings.HasPrefix(L, "mark ") && !strings.HasPrefix(L, "original-oid ") &&
+			!strings.HasPrefix(L, "tagger ") {
+			break
+		}
+		ok, err = p.next()
+	}
+	if target != "" {
+		p.branches["refs/tags/"+name] = target
+	}
+	return ok, err
+}
+
+// skipRecord skips a record we don't care about (blobs), including its data.
+func (p *fastExportParser) skipRecord() (bool, error) {
+	ok, err := p.next()
+	for ok && err == nil {
+		L := p.line
+		if strings.HasPrefix(L, "data ") {
+			if _, err = p.readData(L[5:]); err != nil {
+				return false, err
+			}
+		} else if !strings.HasPrefix(L, "mark ") && !strings.HasPrefix(L, "original-oid ") {
+			return true, nil
+		}
+		ok, err = p.next()
+	}
+	return ok, err
+}
+
+// readData reads the payload of a "data" command, in either the exact byte
+// count form ("data 123") or the delimited form ("data <<EOT").
+func (p *fastExportParser) readData(arg string) (string, error) {
+	if strings.HasPrefix(arg, "<<") {
+		delim := arg[2:]
+		var lines []string
+		for {
+			ok, err := p.next()
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return "", p.errorf("missing data delimiter '%s'", delim)
+			}
+			if p.line == delim {
+				return strings.Join(lines, "\n"), nil
+			}
+			lines = append(lines, p.line)
+		}
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", p.errorf("bad data length '%s'", arg)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		return "", p.errorf("short data: %s", err)
+	}
+
+	// The LF after the payload is optional
+	if b, err := p.r.Peek(1); err == nil && b[0] == '\n' {
+		p.r.ReadByte()
+	}
+	return string(buf), nil
+}
+
+// skipInlineData reads the data block that follows an inline filemodify or
+// notemodify, which holds file or note content.
+func (p *fastExportParser) skipInlineData() error {
+	ok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if !ok || !strings.HasPrefix(p.line, "data ") {
+		return p.errorf("missing data for inline content")
+	}
+	_, err = p.readData(p.line[5:])
+	return err
+}
+
+// splitFastExportPaths splits the "<source> <dest>" of a filerename or
+// filecopy. Either path can be C-style quoted; a quoted source can contain
+// spaces, and an unquoted one can't.
+func splitFastExportPaths(s string) (string, string, bool) {
+	var end int
+	if strings.HasPrefix(s, "\"") {
+		end = -1
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				end = i + 1
+				break
+			}
+		}
+		if end == -1 || end >= len(s) || s[end] != ' ' {
+			return "", "", false
+		}
+	} else {
+		end = strings.IndexByte(s, ' ')
+		if end == -1 {
+			return "", "", false
+		}
+	}
+	return vcs.GitUnquotePath(s[:end]), vcs.GitUnquotePath(s[end+1:]), true
+}
+
+// resolve turns a commit-ish (":mark", a hash, or a branch name) into a hash.
+func (p *fastExportParser) resolve(ref string) vcs.Hash {
+	if strings.HasPrefix(ref, ":") {
+		return p.marks[ref]
+	}
+	if tip, ok := p.branches[strings.TrimSuffix(ref, "^0")]; ok {
+		return tip
+	}
+	return vcs.Hash(ref)
+}
+
+// parseFastExportPerson parses "Name <email> when tz" into a name, an email,
+// a unix time and a timezone offset in minutes.
+func parseFastExportPerson(s string) (name string, email string, timestamp int, tzOffset int, err error) {
+	lt := strings.Index(s, "<")
+	gt := strings.LastIndex(s, ">")
+	if lt == -1 || gt < lt {
+		return "", "", 0, 0, fmt.Errorf("bad identity '%s'", s)
+	}
+	name = strings.TrimSpace(s[:lt])
+	email = s[lt+1:gt]
+
+	when := strings.Fields(s[gt+1:])
+	if len(when) > 0 {
+		if timestamp, err = strconv.Atoi(when[0]); err != nil {
+			return "", "", 0, 0, fmt.Errorf("bad timestamp in '%s'", s)
+		}
+	}
+	if len(when) > 1 {
+		if tzOffset, err = parseTzOffset(when[1]); err != nil {
+			return "", "", 0, 0, fmt.Errorf("bad %s in '%s'", err, s)
+		}
+	}
+	return name, email, timestamp, tzOffset, nil
+}
+
+// splitMessage splits a commit message into its subject and body the way
+// git's %s and %b do: the subject is the first paragraph, joined into one
+// line, and the body is the rest.
+func splitMessage(msg string) (string, string) {
+	lines := strings.Split(strings.TrimLeft(msg, "\n"), "\n")
+	n := 0
+	for n < len(lines) && strings.TrimSpace(lines[n]) != "" {
+		n++
+	}
+	for i := range lines[:n] {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	subject := strings.Join(lines[:n], " ")
+	body := strings.Trim(strings.Join(lines[n:], "\n"), "\n")
+	return subject, body
+}
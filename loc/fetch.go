@@ -5,9 +5,11 @@
 package loc
 
 import (
-	"fmt"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"vcsloc/gsos"
 	"vcsloc/vcs"
@@ -15,22 +17,29 @@ import (
 
 // ----------------------------------------------------------------------------------------------
 
+// statWalk is a commit to walk from, and the parent it was reached from
+type statWalk struct {
+	hash vcs.Hash
+	parent vcs.Hash
+}
+
+// FetchChangeStats gets the stats for each non-merge commit. The graph walk
+// decides which parent each commit is diffed against, so it's done first;
+// then the "git log" runs are spread over db.jobs workers.
 func (db *VcsDb) FetchChangeStats() {
-	stats := make(map[string]NonmergeStat)
-	seen := make(map[string]bool)
+	seen := make(map[vcs.Hash]bool)
+	var fetches []statWalk
 
-	var walkRefs [][]string
+	var walkRefs []statWalk
 	for _, ref := range db.roots {
-		walkRefs = append(walkRefs, []string{ref, ""})
+		walkRefs = append(walkRefs, statWalk{ref, ""})
 	}
 
-	count := 0
 	for len(walkRefs) > 0 {
-		root := walkRefs[0][0]
-		parent := walkRefs[0][1]
+		parent := walkRefs[0].parent
+		hash := walkRefs[0].hash
 		walkRefs = walkRefs[1:]
 
-		hash := root
 		for {
 			// If we have seen this hash, then we must have already traversed
 			// it and all its children.
@@ -41,12 +50,8 @@ func (db *VcsDb) FetchChangeStats() {
 			// Get info on commit
 			commit := db.graph[hash]
 
-			count += 1
-			db.terminal.Progressf("%d (%d) follow %s: git log %s", count, len(walkRefs), root[:10], hash[:10])
-
 			if len(commit.parents) <= 1 {
-				sh := db.GetNonmergeStat(hash, parent)
-				stats[hash] = sh
+				fetches = append(fetches, statWalk{hash, parent})
 			}
 			seen[hash] = true
 
@@ -63,26 +68,68 @@ func (db *VcsDb) FetchChangeStats() {
 				if _, ok := seen[h]; ok {
 					continue
 				}
-				walkRefs = append(walkRefs, []string{h, parent})
+				walkRefs = append(walkRefs, statWalk{h, parent})
 			}
 		}
 	}
 
+	known := make([]vcs.Hash, 0, len(db.graph))
+	for hash := range db.graph {
+		known = append(known, hash)
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] < known[j] })
+	prefixLen := abbrevFor(uniquePrefixLen(known))
+
+	stats := make(map[vcs.Hash]NonmergeStat, len(fetches))
+	var mu sync.Mutex // guards stats, count and the terminal
+	count := 0
+
+	queue := make(chan statWalk)
+	var wg sync.WaitGroup
+	for n := 0; n < db.numJobs(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range queue {
+				sh := db.GetNonmergeStat(w.hash, w.parent)
+				mu.Lock()
+				stats[w.hash] = sh
+				count += 1
+				db.terminal.Progressf("%d/%d git log %s", count, len(fetches), w.hash.Abbrev(prefixLen))
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, w := range fetches {
+		queue <- w
+	}
+	close(queue)
+	wg.Wait()
+
 	db.nonmergeStat = stats
 }
 
-func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
-	commitRange := hash
+// numJobs is how many stat fetches run at once; 0 means one per CPU.
+func (db *VcsDb) numJobs() int {
+	if db.jobs > 0 {
+		return db.jobs
+	}
+	return runtime.NumCPU()
+}
+
+func (db *VcsDb) GetNonmergeStat(hash, parent vcs.Hash) NonmergeStat {
+	commitRange := string(hash)
 	if parent != "" {
-		commitRange = parent + ".." + hash
+		commitRange = string(parent) + ".." + string(hash)
 	}
 	cmd := []string{"log", "--numstat", "--summary", "--pretty=format:%H", commitRange}
 
-	_, stdout, _ := vcs.RunGitCommand(db.repoPath, nil, cmd...)
+	_, stdout, _ := vcs.MustRunGitCommand(db.repoPath, nil, cmd...)
 	text := gsos.BytesToLines(stdout)
-	// TBD only do this output if we are redirecting stdout to a file?
-	fmt.Printf("git %s\n", strings.Join(cmd, " "))
-	fmt.Printf("%s\n", strings.Join(text, "\n"))
+	if db.verbose {
+		db.terminal.Printf("git %s\n", strings.Join(cmd, " "))
+		db.terminal.Printf("%s\n", strings.Join(text, "\n"))
+	}
 
 	changes := make(map[string]Change)
 	for _, L := range(text[1:]) {
@@ -90,7 +137,7 @@ func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
 		// If it's a numstat line, it's <add>\t<del>\t<file>
 		tokens := strings.Split(L, "\t")
 		if len(tokens) == 3 {
-			filepath := tokens[2]
+			filepath := vcs.GitUnquotePath(tokens[2])
 			var add, del int
 			var isBinary bool
 			if tokens[0] == "-" && tokens[1] == "-" {
@@ -100,12 +147,8 @@ func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
 				del, _ = strconv.Atoi(tokens[1])
 			}
 			// If the filepath has a " => " in the middle of it, it's a rename
-			pos := strings.Index(filepath, " => ")
-			var oldPath string
-			if pos != -1 {
-				//fmt.Printf("filepath: '%s', pos: %d\n", filepath, pos)
-				oldPath = filepath[pos+4:]
-				filepath = filepath[:pos]
+			if oldPath, newPath, ok := splitRename(tokens[2]); ok {
+				filepath = newPath
 				changes[filepath] = Change{path: filepath, add: add, remove: del, binary: isBinary, rename: true, oldPath: oldPath}
 			} else {
 				// Not a rename, a regular add/remove line
@@ -116,7 +159,7 @@ func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
 			//  examplar line: " create mode 100644 .gitattributes"
 			verb := L[0:7]
 			access := L[13:20]
-			filepath := L[20:]
+			filepath := vcs.GitUnquotePath(L[20:])
 			if !(access == "100644 " || access == "100755 " || access == "120000 " || access == "160000 ") {
 				db.terminal.Fatalf("%s don't understand access '%s' line: '%s'", commitRange, access, L)
 			}
@@ -129,14 +172,15 @@ func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
 			changes[filepath] = change
 		} else if L[0:8] == " rename " {
 			//  examplar line: " rename test.sh => t/test.sh (100%)"
-			pos1 := 8
-			pos2 := strings.Index(L, " => ")
 			pos3 := strings.LastIndex(L, "(")
-			if pos2 == -1 || pos3 == -1 {
+			var oldPath, newPath string
+			var ok bool
+			if pos3 != -1 {
+				oldPath, newPath, ok = splitRename(L[8:pos3-1])
+			}
+			if !ok {
 				db.terminal.Fatalf("%s don't understand rename: '%s'", commitRange, L)
 			}
-			oldPath := L[pos1:pos2]
-			newPath := L[pos2+4:pos3-1]
 			change := changes[newPath]
 			change.rename = true
 			change.oldPath = oldPath
@@ -144,16 +188,19 @@ func (db *VcsDb) GetNonmergeStat(hash, parent string) NonmergeStat {
 		} else if L[0:13] == " mode change " {
 			//  examplar line: " mode change 100644 => 100755 t/t7409-submodule-detached-worktree.sh
 			// We don't care
-			fmt.Printf("Ignoring %s\n", L)
+			db.terminal.Warnf("%s ignoring '%s'", commitRange, L)
 		} else {
 			db.terminal.Fatalf("%s don't understand: '%s'", commitRange, L)
 		}
 	}
 
+	// Sort, so that the changes don't depend on map order
 	var nchanges []Change
 	for _, v := range changes {
 		nchanges = append(nchanges, v)
 	}
+	nchanges = db.exclude.filterChanges(nchanges)
+	sort.Slice(nchanges, func(i, j int) bool { return nchanges[i].path < nchanges[j].path })
 	return NonmergeStat{parent: parent, changes: nchanges}
 }
 
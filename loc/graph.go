@@ -0,0 +1,275 @@
+// vcsloc/loc/graph.go
+
+package loc
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// VcsGraph is the annotated commit graph: every commit with its parents and
+// children. It's built from VcsCommits after they're fetched, and persisted
+// in the same form as the legacy "graph" file, so old and new databases can
+// be diffed.
+type VcsGraph struct {
+	graph map[vcs.Hash]Commit
+
+	dirty bool // true if data needs to be written to disk
+	name string // filename data is persisted under
+}
+
+func NewVcsGraph() *VcsGraph {
+	return &VcsGraph{name: "graph"}
+}
+
+// (*VcsGraph).Build makes the graph from commits, filling in children.
+// Children are in the order of commits, and parents that aren't in commits
+// (e.g. outside a range) get no children. Changes aren't part of the graph.
+func (h *VcsGraph) Build(commits []Commit) {
+	graph := make(map[vcs.Hash]Commit, len(commits))
+	for i := range commits {
+		c := commits[i]
+		c.changes = nil
+		c.children = nil
+		graph[c.hash] = c
+	}
+	for i := range commits {
+		child := commits[i].hash
+		for _, parentHash := range commits[i].parents {
+			parent, ok := graph[parentHash]
+			if !ok {
+				continue
+			}
+			parent.children = append(parent.children, child)
+			graph[parentHash] = parent
+		}
+	}
+
+	h.graph = graph
+	h.dirty = true
+}
+
+// ErrGraphCycle is returned by TopoSort for a graph where a commit is its own
+// ancestor, which can only come from a corrupt database.
+var ErrGraphCycle = errors.New("commit graph has a cycle")
+
+// TopoSort returns the commits in the graph in topological order, every
+// parent before its children. Of the commits that are ready, the one with
+// the oldest author timestamp (then the smallest hash) goes first, so the
+// order is stable from run to run, and is timestamp order where the
+// timestamps agree with the graph. Rebases and wrong clocks can make author
+// time go backwards, which would put a child before its parent.
+func (db *VcsDb2) TopoSort() ([]vcs.Hash, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return nil, err
+		}
+	}
+	commits, err := db.graph.sorted()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]vcs.Hash, len(commits))
+	for i := range commits {
+		hashes[i] = commits[i].hash
+	}
+	return hashes, nil
+}
+
+// Mainline returns the first-parent chain of the default branch (see
+// DefaultBranch), newest first: the history as the branch itself saw it, one
+// commit per merge. It stops where the chain leaves the database. It's empty
+// if there's no default branch.
+func (db *VcsDb2) Mainline() ([]vcs.Hash, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return nil, err
+		}
+	}
+	_, hash := db.DefaultBranch()
+	var mainline []vcs.Hash
+	for hash != "" {
+		c, ok := db.graph.graph[hash]
+		if !ok {
+			break
+		}
+		mainline = append(mainline, hash)
+		hash = ""
+		if len(c.parents) > 0 {
+			hash = c.parents[0]
+		}
+	}
+	return mainline, nil
+}
+
+// UnreachableCommits returns the commits in the graph that no ref leads to,
+// newest first. A git repo's graph comes from "log --all", so these are the
+// commits only HEAD leads to (on a detached HEAD); a fast-export stream can
+// also leave commits behind, on a branch that was reset away. Such history
+// is what a force push or a deleted branch leaves, and is otherwise easy to
+// miss.
+func (db *VcsDb2) UnreachableCommits() ([]vcs.Hash, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.refs.Load(db); err != nil {
+		return nil, err
+	}
+	graph := db.graph.graph
+
+	var tips []vcs.Hash
+	for _, ref := range db.refs.CommitRefs() {
+		tips = append(tips, ref.RefHash)
+	}
+	reachable := ancestors(graph, tips)
+
+	var unreachable []vcs.Hash
+	for hash := range graph {
+		if !reachable[hash] {
+			unreachable = append(unreachable, hash)
+		}
+	}
+	sort.Slice(unreachable, func(i, j int) bool {
+		a, b := graph[unreachable[i]], graph[unreachable[j]]
+		if a.timestamp != b.timestamp {
+			return a.timestamp > b.timestamp
+		}
+		return unreachable[i] < unreachable[j]
+	})
+	return unreachable, nil
+}
+
+// (*VcsGraph).sorted returns the commits in the stable order used on disk;
+// see TopoSort. It uses Kahn's algorithm, with parents that aren't in the
+// graph (outside a range, or past a shallow clone's edge) left out.
+func (h *VcsGraph) sorted() ([]Commit, error) {
+	waiting := make(map[vcs.Hash]int, len(h.graph)) // parents not yet output
+	ready := &CommitHeap{}
+	for _, c := range h.graph {
+		for _, parent := range c.parents {
+			if _, ok := h.graph[parent]; ok {
+				waiting[c.hash] += 1
+			}
+		}
+		if waiting[c.hash] == 0 {
+			*ready = append(*ready, c)
+		}
+	}
+	heap.Init(ready)
+
+	commits := make([]Commit, 0, len(h.graph))
+	for ready.Len() > 0 {
+		c := heap.Pop(ready).(Commit)
+		commits = append(commits, c)
+		for _, child := range c.children {
+			if _, ok := h.graph[child]; !ok {
+				continue
+			}
+			waiting[child] -= 1
+			if waiting[child] == 0 {
+				heap.Push(ready, h.graph[child])
+			}
+		}
+	}
+	if len(commits) != len(h.graph) {
+		return nil, fmt.Errorf("%w: %d commits aren't reachable from a root", ErrGraphCycle, len(h.graph)-len(commits))
+	}
+	return commits, nil
+}
+
+// (*VcsGraph).Load reads the graph from the database. The binary graph file
+// is much quicker to read, so it's used if it's there and has every parent;
+// otherwise (an older database, or one with parents outside its scope) the
+// text graph is read.
+func (h *VcsGraph) Load(db *VcsDb2) error {
+	if graph, err := db.LoadGraphFile(); err == nil {
+		h.graph = graph
+		h.dirty = false
+		return nil
+	}
+	return h.loadText(db)
+}
+
+// (*VcsGraph).loadText reads the graph from the text graph file.
+func (h *VcsGraph) loadText(db *VcsDb2) error {
+	h.graph = make(map[vcs.Hash]Commit)
+	h.dirty = false
+
+	var c Commit
+	var n int // number of commits started
+	err := db.doLoadData(h.name, func(line string) error {
+		var index int
+		if getkvint(line, &index, "-- ") {
+			if n > 0 {
+				h.graph[c.hash] = c
+			}
+			if n != index {
+				return fmt.Errorf("invalid VcsGraph: saw %d but wanted %d", index, n)
+			}
+			n += 1
+			c = Commit{}
+			return nil
+		}
+		if n == 0 {
+			return fmt.Errorf("invalid VcsGraph: data before first commit")
+		}
+		var notes string // a save-file artifact, not kept
+		if !getkvhash(line, &c.hash, "hash=") &&
+			!getkvint(line, &c.timestamp, "timestamp=") &&
+			!getkvstr(line, &c.authorName, "name=") &&
+			!getkvstr(line, &c.authorEmail, "email=") &&
+			!getkvstr(line, &notes, "notes=") &&
+			!getkvhashlist(line, &c.parents, "parents=") &&
+			!getkvhashlist(line, &c.children, "children=") {
+			return fmt.Errorf("invalid VcsGraph: %d", n-1)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		h.graph[c.hash] = c
+	}
+	return nil
+}
+
+// (*VcsGraph).Save writes the graph to the database, in topological order.
+func (h *VcsGraph) Save(db *VcsDb2) error {
+	commits, err := h.sorted()
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	err = db.doSaveDataN(h.name, len(commits), func(i int) string {
+		e := &commits[i]
+		var notes []string
+		if len(e.parents) > 1 {
+			notes = append(notes, "merge")
+		}
+		if len(e.children) > 1 {
+			notes = append(notes, "branch")
+		}
+		sb.Reset()
+		sb.WriteString(fmt.Sprintf("-- %d\n", i))
+		sb.WriteString(fmt.Sprintf("hash=%s\n", e.hash))
+		sb.WriteString(fmt.Sprintf("timestamp=%d\n", e.timestamp))
+		sb.WriteString(fmt.Sprintf("name=%s\n", e.authorName))
+		sb.WriteString(fmt.Sprintf("email=%s\n", e.authorEmail))
+		sb.WriteString(fmt.Sprintf("notes=%s\n", strings.Join(notes, ", ")))
+		sb.WriteString(fmt.Sprintf("parents=%s\n", vcs.JoinHashes(e.parents, " ")))
+		sb.WriteString(fmt.Sprintf("children=%s\n", vcs.JoinHashes(e.children, " ")))
+		return sb.String()
+	})
+	if err == nil {
+		h.dirty = false
+	}
+	return err
+}
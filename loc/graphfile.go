@@ -0,0 +1,450 @@
+// vcsloc/loc/graphfile.go
+
+package loc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"vcsloc/vcs"
+)
+
+// The graph file is a compact binary form of the commit graph, in the spirit
+// of git's commit-graph file. Every record is fixed-width, so a commit can be
+// found and read with a few seeks instead of parsing the text commit files,
+// which remain the primary (and debuggable) form of the data.
+//
+// Layout, all integers big-endian:
+//
+//	header     "VLCG", version uint32, flags uint32, hashLen uint32, numCommits uint32, numExtra uint32
+//	fanout     256 x uint32: number of commits whose first hash byte is <= i
+//	hashes     numCommits x hashLen bytes, sorted
+//	commits    numCommits x {parent1 uint32, parent2 uint32, generation uint32, timestamp int64}
+//	extra      numExtra x uint32: parents of octopus merges
+//
+// Parents are indexes into the hash table. graphNoParent means no parent. If a
+// commit has more than two parents, parent2 is graphExtraEdge|i, and the second
+// and later parents are extra[i:], the last one marked with graphExtraEdge.
+// Parents that aren't in the graph (e.g. outside a path-limited scope) are left
+// out, and the graphPartial flag is set, since the text commit files keep
+// them and the graph file can't stand in for those then. Generation is 1 for
+// commits without parents, otherwise one more than the largest generation of
+// the parents.
+const (
+	graphFileName = "graph.bin"
+	graphMagic = "VLCG"
+	graphVersion = 1
+	graphHeaderLen = 24
+	graphFanoutLen = 256 * 4
+	graphRecordLen = 20
+
+	graphNoParent = 0xffffffff
+	graphExtraEdge = 0x80000000
+
+	graphPartial = 1 // flag: some parents were left out
+)
+
+var ErrGraphFile = errors.New("bad graph file")
+
+// (*VcsCommits).SaveGraph writes the binary graph file alongside the text
+// commit files. If it can't be written (e.g. ids that aren't hex hashes), any
+// old one is removed, and readers fall back to the text files.
+func (h *VcsCommits) SaveGraph(db *VcsDb2) *VcsCommits {
+	if h.err == nil {
+		if err := db.SaveGraphFile(); err != nil {
+			h.err = db.removeData(graphFileName)
+		}
+	}
+	return h
+}
+
+// SaveGraphFile writes the commits to the binary graph file.
+func (db *VcsDb2) SaveGraphFile() error {
+	commits := db.commits.commits
+
+	// Sort commits by binary hash; all hashes have to be the same length
+	order := make([]int, len(commits))
+	keys := make([][]byte, len(commits))
+	hashLen := 0
+	for i := range commits {
+		key, err := hex.DecodeString(string(commits[i].hash))
+		if err != nil {
+			return fmt.Errorf("graph file needs hex hashes: %s", commits[i].hash)
+		}
+		if hashLen == 0 {
+			hashLen = len(key)
+		} else if len(key) != hashLen {
+			return fmt.Errorf("graph file needs hashes of one length: %s", commits[i].hash)
+		}
+		order[i] = i
+		keys[i] = key
+	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(keys[order[i]], keys[order[j]]) < 0 })
+
+	position := make(map[vcs.Hash]uint32, len(commits))
+	for pos, i := range order {
+		position[commits[i].hash] = uint32(pos)
+	}
+
+	// Generation numbers need parents first, so walk with an explicit stack
+	generation := make([]uint32, len(commits))
+	for pos := range order {
+		stack := []uint32{uint32(pos)}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if generation[top] != 0 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			gen := uint32(1)
+			pending := false
+			for _, parent := range commits[order[top]].parents {
+				p, ok := position[parent]
+				if !ok {
+					continue
+				}
+				if generation[p] == 0 {
+					stack = append(stack, p)
+					pending = true
+				} else if generation[p] + 1 > gen {
+					gen = generation[p] + 1
+				}
+			}
+			if !pending {
+				generation[top] = gen
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	// Build the commit records and the extra edge list
+	var fanout [256]uint32
+	var extra []uint32
+	var flags uint32
+	records := make([]byte, 0, len(commits)*graphRecordLen)
+	for pos, i := range order {
+		c := &commits[i]
+		fanout[keys[i][0]] += 1
+
+		var parents []uint32
+		for _, parent := range c.parents {
+			if p, ok := position[parent]; ok {
+				parents = append(parents, p)
+			} else {
+				flags |= graphPartial
+			}
+		}
+		p1, p2 := uint32(graphNoParent), uint32(graphNoParent)
+		if len(parents) > 0 {
+			p1 = parents[0]
+		}
+		if len(parents) == 2 {
+			p2 = parents[1]
+		} else if len(parents) > 2 {
+			p2 = graphExtraEdge | uint32(len(extra))
+			extra = append(extra, parents[1:]...)
+			extra[len(extra)-1] |= graphExtraEdge
+		}
+
+		records = binary.BigEndian.AppendUint32(records, p1)
+		records = binary.BigEndian.AppendUint32(records, p2)
+		records = binary.BigEndian.AppendUint32(records, generation[pos])
+		records = binary.BigEndian.AppendUint64(records, uint64(int64(c.timestamp)))
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+
+	return db.doSaveDataWorker(graphFileName, func(w *bufio.Writer) error {
+		hdr := []byte(graphMagic)
+		hdr = binary.BigEndian.AppendUint32(hdr, graphVersion)
+		hdr = binary.BigEndian.AppendUint32(hdr, flags)
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(hashLen))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(commits)))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(extra)))
+		w.Write(hdr)
+		for _, n := range fanout {
+			binary.Write(w, binary.BigEndian, n)
+		}
+		for _, i := range order {
+			w.Write(keys[i])
+		}
+		w.Write(records)
+		for _, e := range extra {
+			binary.Write(w, binary.BigEndian, e)
+		}
+		return nil
+	})
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// graphReader is a data file that can be read at random, as the readers from
+// both FileStore and MemStore can.
+type graphReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// GraphFile gives random access to a graph file without reading all of it.
+type GraphFile struct {
+	f graphReader
+	partial bool // some parents were left out
+	hashLen int
+	numCommits int
+	numExtra int
+	fanout [256]uint32
+}
+
+// OpenGraphFile opens the database's binary graph file.
+func (db *VcsDb2) OpenGraphFile() (*GraphFile, error) {
+	r, err := db.store.Reader(graphFileName)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := r.(graphReader)
+	if !ok {
+		r.Close()
+		return nil, fmt.Errorf("%w: %s can't be read at random", ErrGraphFile, storePath(db.store, graphFileName))
+	}
+
+	g := &GraphFile{f: f}
+	head := make([]byte, graphHeaderLen + graphFanoutLen)
+	if _, err := f.ReadAt(head, 0); err != nil || string(head[:4]) != graphMagic ||
+		binary.BigEndian.Uint32(head[4:]) != graphVersion {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrGraphFile, storePath(db.store, graphFileName))
+	}
+	g.partial = binary.BigEndian.Uint32(head[8:]) & graphPartial != 0
+	g.hashLen = int(binary.BigEndian.Uint32(head[12:]))
+	g.numCommits = int(binary.BigEndian.Uint32(head[16:]))
+	g.numExtra = int(binary.BigEndian.Uint32(head[20:]))
+	for i := range g.fanout {
+		g.fanout[i] = binary.BigEndian.Uint32(head[graphHeaderLen + 4*i:])
+	}
+	return g, nil
+}
+
+// LoadGraphFile reads the whole commit graph from the binary graph file,
+// with children filled in. The file has no author names or subjects, which
+// nothing walking the graph needs, or the order of children, so they're put
+// newest first. A partial file is an error, since the graph would be missing
+// edges; callers fall back to the text commit files.
+func (db *VcsDb2) LoadGraphFile() (map[vcs.Hash]Commit, error) {
+	g, err := db.OpenGraphFile()
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+	if g.Partial() {
+		return nil, fmt.Errorf("%w: %s leaves out parents", ErrGraphFile, storePath(db.store, graphFileName))
+	}
+	hashes, records, err := g.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	graph := make(map[vcs.Hash]Commit, len(hashes))
+	for i, hash := range hashes {
+		c := Commit{hash: hash, timestamp: records[i].Timestamp}
+		for _, p := range records[i].Parents {
+			c.parents = append(c.parents, hashes[p])
+		}
+		graph[hash] = c
+	}
+	for i, hash := range hashes {
+		for _, p := range records[i].Parents {
+			parent := graph[hashes[p]]
+			parent.children = append(parent.children, hash)
+			graph[hashes[p]] = parent
+		}
+	}
+	for hash, c := range graph {
+		if len(c.children) > 1 {
+			sort.Slice(c.children, func(i, j int) bool {
+				a, b := graph[c.children[i]], graph[c.children[j]]
+				if a.timestamp != b.timestamp {
+					return a.timestamp > b.timestamp
+				}
+				return a.hash < b.hash
+			})
+			graph[hash] = c
+		}
+	}
+	return graph, nil
+}
+
+// Close closes the graph file.
+func (g *GraphFile) Close() error {
+	return g.f.Close()
+}
+
+// Len is the number of commits in the graph file.
+func (g *GraphFile) Len() int {
+	return g.numCommits
+}
+
+// Partial is true if parents outside the graph were left out, so that a
+// commit's parents in the file may be fewer than it has.
+func (g *GraphFile) Partial() bool {
+	return g.partial
+}
+
+// Hash returns the hash of commit i.
+func (g *GraphFile) Hash(i int) (vcs.Hash, error) {
+	key, err := g.key(i)
+	if err != nil {
+		return "", err
+	}
+	return vcs.Hash(hex.EncodeToString(key)), nil
+}
+
+// Lookup returns the index of a commit, using the fanout table and a binary
+// search of the hash table.
+func (g *GraphFile) Lookup(hash vcs.Hash) (int, bool, error) {
+	want, err := hex.DecodeString(string(hash))
+	if err != nil || len(want) != g.hashLen {
+		return 0, false, nil
+	}
+
+	lo := 0
+	if want[0] > 0 {
+		lo = int(g.fanout[want[0]-1])
+	}
+	hi := int(g.fanout[want[0]])
+	var searchErr error
+	i := lo + sort.Search(hi-lo, func(n int) bool {
+		key, err := g.key(lo + n)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return bytes.Compare(key, want) >= 0
+	})
+	if searchErr != nil {
+		return 0, false, searchErr
+	}
+	if i == hi {
+		return 0, false, nil
+	}
+	key, err := g.key(i)
+	if err != nil {
+		return 0, false, err
+	}
+	return i, bytes.Equal(key, want), nil
+}
+
+// GraphCommit is one commit record from a graph file.
+type GraphCommit struct {
+	Parents []int // indexes of the parents in the graph file
+	Generation int
+	Timestamp int
+}
+
+// Commit reads the record for commit i.
+func (g *GraphFile) Commit(i int) (GraphCommit, error) {
+	if i < 0 || i >= g.numCommits {
+		return GraphCommit{}, fmt.Errorf("%w: no commit %d", ErrGraphFile, i)
+	}
+
+	rec := make([]byte, graphRecordLen)
+	if _, err := g.f.ReadAt(rec, g.recordsOffset() + int64(i*graphRecordLen)); err != nil {
+		return GraphCommit{}, err
+	}
+	extraOffset := g.recordsOffset() + int64(g.numCommits*graphRecordLen)
+	var edge [4]byte
+	return g.parseRecord(rec, func(k int) (uint32, error) {
+		if _, err := g.f.ReadAt(edge[:], extraOffset + int64(4*k)); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(edge[:]), nil
+	})
+}
+
+// ReadAll reads the hashes and records of every commit, in index order. It
+// reads the tables in one go rather than a few small reads per commit, for
+// loading the whole graph.
+func (g *GraphFile) ReadAll() ([]vcs.Hash, []GraphCommit, error) {
+	keysLen := g.numCommits * g.hashLen
+	recordsLen := g.numCommits * graphRecordLen
+	buf := make([]byte, keysLen + recordsLen + 4*g.numExtra)
+	if _, err := g.f.ReadAt(buf, graphHeaderLen + graphFanoutLen); err != nil {
+		return nil, nil, err
+	}
+	records := buf[keysLen:keysLen+recordsLen]
+	extra := buf[keysLen+recordsLen:]
+	extraEdge := func(k int) (uint32, error) {
+		if k < 0 || k >= g.numExtra {
+			return 0, fmt.Errorf("%w: no extra edge %d", ErrGraphFile, k)
+		}
+		return binary.BigEndian.Uint32(extra[4*k:]), nil
+	}
+
+	hashes := make([]vcs.Hash, g.numCommits)
+	commits := make([]GraphCommit, g.numCommits)
+	for i := range commits {
+		hashes[i] = vcs.Hash(hex.EncodeToString(buf[i*g.hashLen:(i+1)*g.hashLen]))
+		gc, err := g.parseRecord(records[i*graphRecordLen:], extraEdge)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range gc.Parents {
+			if p >= g.numCommits {
+				return nil, nil, fmt.Errorf("%w: commit %d has parent %d", ErrGraphFile, i, p)
+			}
+		}
+		commits[i] = gc
+	}
+	return hashes, commits, nil
+}
+
+// parseRecord decodes a commit record; extraEdge reads the k'th entry of the
+// extra edge list, for octopus merges.
+func (g *GraphFile) parseRecord(rec []byte, extraEdge func(k int) (uint32, error)) (GraphCommit, error) {
+	var gc GraphCommit
+	p1 := binary.BigEndian.Uint32(rec[0:])
+	p2 := binary.BigEndian.Uint32(rec[4:])
+	gc.Generation = int(binary.BigEndian.Uint32(rec[8:]))
+	gc.Timestamp = int(int64(binary.BigEndian.Uint64(rec[12:])))
+
+	if p1 != graphNoParent {
+		gc.Parents = append(gc.Parents, int(p1))
+	}
+	if p2 == graphNoParent {
+		return gc, nil
+	}
+	if p2 & graphExtraEdge == 0 {
+		gc.Parents = append(gc.Parents, int(p2))
+		return gc, nil
+	}
+
+	// Octopus merge: read extra edges until the one marked as last
+	for k := int(p2 &^ graphExtraEdge); ; k++ {
+		e, err := extraEdge(k)
+		if err != nil {
+			return gc, err
+		}
+		gc.Parents = append(gc.Parents, int(e &^ graphExtraEdge))
+		if e & graphExtraEdge != 0 {
+			return gc, nil
+		}
+	}
+}
+
+// key reads the binary hash of commit i.
+func (g *GraphFile) key(i int) ([]byte, error) {
+	key := make([]byte, g.hashLen)
+	_, err := g.f.ReadAt(key, int64(graphHeaderLen + graphFanoutLen + i*g.hashLen))
+	return key, err
+}
+
+// recordsOffset is where the commit records start.
+func (g *GraphFile) recordsOffset() int64 {
+	return int64(graphHeaderLen + graphFanoutLen + g.numCommits*g.hashLen)
+}
@@ -0,0 +1,74 @@
+// vcsloc/loc/grep.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// GrepOptions controls how Grep matches commits.
+type GrepOptions struct {
+	IgnoreCase bool // match pattern without regard to case
+	Author string // if set, only commits whose author name or email matches this regexp
+	AllFields bool // match pattern against author name and email as well as the message
+}
+
+// Grep searches the commit messages (subject and body) persisted in the
+// database and writes each matching commit to w as it is found, in the
+// format of Log. This is an offline "git log --grep" - it works even when
+// the original repo is gone. It returns the number of matching commits.
+func (db *VcsDb2) Grep(w io.Writer, pattern string, opts GrepOptions) (int, error) {
+	re, err := compileGrep(pattern, opts.IgnoreCase)
+	if err != nil {
+		return 0, err
+	}
+
+	var authorRe *regexp.Regexp
+	if opts.Author != "" {
+		if authorRe, err = compileGrep(opts.Author, opts.IgnoreCase); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.commits.Load(db); err != nil {
+		return 0, err
+	}
+
+	var count int
+	for i := range db.commits.commits {
+		c := &db.commits.commits[i]
+
+		if authorRe != nil && !authorRe.MatchString(c.authorName) && !authorRe.MatchString(c.authorEmail) {
+			continue
+		}
+
+		match := re.MatchString(c.subject) || re.MatchString(c.body)
+		if !match && opts.AllFields {
+			match = re.MatchString(c.authorName) || re.MatchString(c.authorEmail)
+		}
+		if !match {
+			continue
+		}
+
+		count += 1
+		if err := writeLogLine(w, c); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// compileGrep compiles a user-supplied regexp, optionally case-insensitive.
+func compileGrep(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern '%s': %s", pattern, err)
+	}
+	return re, nil
+}
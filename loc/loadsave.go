@@ -44,26 +44,32 @@ type VcsDb struct {
 	refsDirty bool
 
 	// roots is the root commits from the repo (root commits have no parents)
-	roots []string
+	roots []vcs.Hash
 	rootsDirty bool
 
 	// tips is the endpoints of all commits in the repo (tips have no children)
-	tips []string
+	tips []vcs.Hash
 	tipsDirty bool
 
 	// rawGraph is the commit graph from the repo
-	rawgraph map[string]Commit
+	rawgraph map[vcs.Hash]Commit
 	rawgraphDirty bool
 
 	// graph is the annotated graph (adds children)
-	graph map[string]Commit
+	graph map[vcs.Hash]Commit
 	graphDirty bool
 
 	// nonmergeStat contains the summary of changes for each non-merge commit
 	// (there are multiple entries for merge commits)
-	nonmergeStat map[string]NonmergeStat
+	nonmergeStat map[vcs.Hash]NonmergeStat
 	nonmergeStatdirty bool
 
+	// jobs is how many "git log" runs FetchChangeStats does at once
+	jobs int
+
+	// exclude is paths left out of the change stats, if set
+	exclude *PathFilter
+
 	verbose bool
 	startTime time.Time
 	terminal gsos.Terminal
@@ -90,6 +96,12 @@ func Load(dbPath string, repoPath string, vcs string) *VcsDb {
 	return db
 }
 
+// SetJobs sets how many commits FetchChangeStats fetches at once; 0 (the
+// default) means one per CPU.
+func (db *VcsDb) SetJobs(jobs int) {
+	db.jobs = jobs
+}
+
 // Save writes out any unsaved data to the vcsloc database.
 func (db *VcsDb) Save() {
 	// Make sure the directory exists
@@ -197,12 +209,21 @@ func (db *VcsDb) SaveNumRepoObjects() error {
 func (db *VcsDb) LoadRefs() error {
 	db.refs = nil
 
+	var badLine error
 	fn := func(line string) {
-		hash := line[:40]
-		refname := line[41:]
-		db.refs = append(db.refs, vcs.Ref{vcs.Hash(hash), refname})
+		hash, refname, err := vcs.ParseHashLine(line)
+		if err != nil {
+			if badLine == nil {
+				badLine = fmt.Errorf("invalid refs: %w", err)
+			}
+			return
+		}
+		db.refs = append(db.refs, vcs.Ref{RefHash: hash, Refname: refname})
 	}
 	err := db.doLoadData("refs", fn)
+	if err == nil {
+		err = badLine
+	}
 
 	db.refsDirty = false
 	return err
@@ -229,7 +250,7 @@ func (db *VcsDb) LoadRoots() error {
 	db.roots = nil
 
 	fn := func(line string) {
-		db.roots = append(db.roots, line)
+		db.roots = append(db.roots, vcs.Hash(line))
 	}
 	err := db.doLoadData("roots", fn)
 
@@ -258,7 +279,7 @@ func (db *VcsDb) LoadTips() error {
 	db.tips = nil
 
 	fn := func(line string) {
-		db.tips = append(db.tips, line)
+		db.tips = append(db.tips, vcs.Hash(line))
 	}
 	err := db.doLoadData("tips", fn)
 
@@ -301,8 +322,8 @@ func (db *VcsDb) LoadGraph() error {
 	return err
 }
 
-func (db *VcsDb) LoadOneGraph(graphFile string) (map[string]Commit, error) {
-	graph := make(map[string]Commit)
+func (db *VcsDb) LoadOneGraph(graphFile string) (map[vcs.Hash]Commit, error) {
+	graph := make(map[vcs.Hash]Commit)
 
 	path := filepath.Join(db.dbPath, graphFile)
 	if db.verbose {
@@ -323,9 +344,9 @@ func (db *VcsDb) LoadOneGraph(graphFile string) (map[string]Commit, error) {
 		// Parse an graph entry - marker, commit hash, timestamp, date, author, subject
 		fail = true
 		var c Commit
-		var parentsS, childrenS, noteS string
+		var hashS, parentsS, childrenS, noteS string
 		if !getint(r, &id, "-- ") || id != i ||
-			!sgetstr(r, &c.hash, "hash=") ||
+			!sgetstr(r, &hashS, "hash=") ||
 			!sgetint(r, &c.timestamp, "timestamp=") ||
 			!sgetstr(r, &c.authorName, "name=") ||
 			!sgetstr(r, &c.authorEmail, "email=") ||
@@ -335,16 +356,9 @@ func (db *VcsDb) LoadOneGraph(graphFile string) (map[string]Commit, error) {
 			break
 		}
 		// we don't keep the notes, they are a save-file artifact
-		if parentsS == "" {
-			c.parents = nil
-		} else {
-			c.parents = strings.Split(parentsS, " ")
-		}
-		if childrenS == "" {
-			c.children = nil
-		} else {
-			c.children = strings.Split(childrenS, " ")
-		}
+		c.hash = vcs.Hash(hashS)
+		c.parents = vcs.ParseHashList(parentsS)
+		c.children = vcs.ParseHashList(childrenS)
 
 		// Save parsed entry
 		fail = false
@@ -374,7 +388,7 @@ func (db *VcsDb) SaveGraph() error {
 	return err
 }
 
-func (db *VcsDb) SaveOneGraph(graphFile string, graph map[string]Commit) error {
+func (db *VcsDb) SaveOneGraph(graphFile string, graph map[vcs.Hash]Commit) error {
 
 	path := filepath.Join(db.dbPath, graphFile)
 	if db.verbose {
@@ -414,8 +428,8 @@ func (db *VcsDb) SaveOneGraph(graphFile string, graph map[string]Commit) error {
 		w.WriteString(fmt.Sprintf("name=%s\n", e.authorName))
 		w.WriteString(fmt.Sprintf("email=%s\n", e.authorEmail))
 		w.WriteString(fmt.Sprintf("notes=%s\n", strings.Join(notes, ", ")))
-		w.WriteString(fmt.Sprintf("parents=%s\n", strings.Join(e.parents, " ")))
-		w.WriteString(fmt.Sprintf("children=%s\n", strings.Join(e.children, " ")))
+		w.WriteString(fmt.Sprintf("parents=%s\n", vcs.JoinHashes(e.parents, " ")))
+		w.WriteString(fmt.Sprintf("children=%s\n", vcs.JoinHashes(e.children, " ")))
 		i++
 	}
 
@@ -426,7 +440,10 @@ func (db *VcsDb) SaveOneGraph(graphFile string, graph map[string]Commit) error {
 type CommitHeap []Commit
 func (h CommitHeap) Len() int { return len(h) }
 func (h CommitHeap) Less(i, j int) bool {
-	return h[i].timestamp < h[j].timestamp
+	if h[i].timestamp != h[j].timestamp {
+		return h[i].timestamp < h[j].timestamp
+	}
+	return h[i].hash < h[j].hash
 }
 func (h CommitHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
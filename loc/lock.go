@@ -0,0 +1,130 @@
+// vcsloc/loc/lock.go
+
+package loc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vcsloc/gsos"
+)
+
+// ErrDbInUse is returned by OpenDb when another process has the database
+// open.
+var ErrDbInUse = errors.New("database in use")
+
+// lockName is the lockfile in the database directory.
+const lockName = ".lock"
+
+// dbLock is a database directory's lockfile, held while a process has the
+// database open so that two processes don't write to it at once. It records
+// which process has it, so that one left behind by a process that died can
+// be taken over.
+type dbLock struct {
+	path string
+}
+
+// lockDb takes the lock on the database in dir. If another process has it,
+// the error is ErrDbInUse, naming the process.
+func lockDb(dir string) (*dbLock, error) {
+	path := filepath.Join(dir, lockName)
+	host, _ := os.Hostname()
+	contents := fmt.Sprintf("pid=%d\ntime=%s\nhost=%s\n", os.Getpid(), time.Now().Format(time.RFC3339), host)
+
+	// A stale lock is removed and then tried again, once
+	for try := 0; ; try++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			_, err = f.WriteString(contents)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("could not write lock %s: %s", path, err)
+			}
+			return &dbLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not lock database: %s", err)
+		}
+
+		owner := readLockOwner(path)
+		if try > 0 || !owner.stale(host) {
+			return nil, fmt.Errorf("%w: %s is locked by %s; remove %s if that's wrong", ErrDbInUse, dir, owner, path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not remove stale lock %s: %s", path, err)
+		}
+	}
+}
+
+// Unlock removes the lockfile. It's safe to call more than once.
+func (l *dbLock) Unlock() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	err := os.Remove(l.path)
+	l.path = ""
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lockOwner is what a lockfile says about the process that has it.
+type lockOwner struct {
+	pid int
+	time string
+	host string
+}
+
+// readLockOwner reads a lockfile. One that can't be read, or that's still
+// being written, gives a zero pid.
+func readLockOwner(path string) lockOwner {
+	var owner lockOwner
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return owner
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "pid="):
+			owner.pid, _ = strconv.Atoi(line[4:])
+		case strings.HasPrefix(line, "time="):
+			owner.time = line[5:]
+		case strings.HasPrefix(line, "host="):
+			owner.host = line[5:]
+		}
+	}
+	return owner
+}
+
+// stale is true if the process that has the lock is gone. That can only be
+// told on the same host; a lock from another host (on a shared filesystem)
+// is never stale. A lock with no pid may be being written right now, so it
+// isn't either.
+func (o lockOwner) stale(host string) bool {
+	return o.pid > 0 && o.host == host && !gsos.ProcessExists(o.pid)
+}
+
+func (o lockOwner) String() string {
+	if o.pid == 0 {
+		return "another process"
+	}
+	return fmt.Sprintf("process %d on %s since %s", o.pid, o.host, o.time)
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// Unlock releases the database's lock, so that other processes can open it.
+// The database shouldn't be saved after this. A database in memory has no
+// lock.
+func (db *VcsDb2) Unlock() error {
+	return db.lock.Unlock()
+}
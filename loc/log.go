@@ -0,0 +1,118 @@
+// vcsloc/loc/log.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"vcsloc/vcs"
+)
+
+// LogOptions controls which commits Log writes, and in what order.
+type LogOptions struct {
+	TopoOrder bool // children before their parents, rather than newest first
+	Limit int // at most this many commits; 0 for all
+	Author string // if set, only commits whose author name or email matches this regexp
+	Grep string // if set, only commits whose message (subject or body) matches this regexp
+	IgnoreCase bool // match Author and Grep without regard to case
+}
+
+// Log writes the commits in the database to w, one per line, as
+//
+//	<hash> <date> <author name> <<author email>> <subject>
+//
+// where the date is the author's, as YYYY-MM-DD in the author's timezone.
+// This is the format Grep writes too, and is meant to be stable for
+// scripts; the subject is the last field, so it can have spaces. Commits are
+// newest first by author time (then by hash), or with TopoOrder, in
+// topological order with every commit ahead of its parents. This is an
+// offline "git log", over the history as analyzed. It returns the number of
+// commits written.
+func (db *VcsDb2) Log(w io.Writer, opts LogOptions) (int, error) {
+	var authorRe, grepRe *regexp.Regexp
+	var err error
+	if opts.Author != "" {
+		if authorRe, err = compileGrep(opts.Author, opts.IgnoreCase); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Grep != "" {
+		if grepRe, err = compileGrep(opts.Grep, opts.IgnoreCase); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.commits.Load(db); err != nil {
+		return 0, err
+	}
+	commits := db.commits.commits
+	order, err := logOrder(commits, opts.TopoOrder)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, i := range order {
+		if opts.Limit > 0 && count >= opts.Limit {
+			break
+		}
+		c := &commits[i]
+		if authorRe != nil && !authorRe.MatchString(c.authorName) && !authorRe.MatchString(c.authorEmail) {
+			continue
+		}
+		if grepRe != nil && !grepRe.MatchString(c.subject) && !grepRe.MatchString(c.body) {
+			continue
+		}
+		count += 1
+		if err := writeLogLine(w, c); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// logOrder returns the indexes of commits in the order Log writes them. The
+// topological order is TopoSort's, reversed; it's worked out from the
+// commits rather than the stored graph, which not every database has.
+func logOrder(commits []Commit, topo bool) ([]int, error) {
+	index := make(map[vcs.Hash]int, len(commits))
+	for i := range commits {
+		index[commits[i].hash] = i
+	}
+	order := make([]int, 0, len(commits))
+
+	if topo {
+		var graph VcsGraph
+		graph.Build(commits)
+		sorted, err := graph.sorted()
+		if err != nil {
+			return nil, err
+		}
+		for i := len(sorted) - 1; i >= 0; i-- {
+			order = append(order, index[sorted[i].hash])
+		}
+		return order, nil
+	}
+
+	for i := range commits {
+		order = append(order, i)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := &commits[order[i]], &commits[order[j]]
+		if a.timestamp != b.timestamp {
+			return a.timestamp > b.timestamp
+		}
+		return a.hash < b.hash
+	})
+	return order, nil
+}
+
+// writeLogLine writes c as a line of Log (or Grep) output.
+func writeLogLine(w io.Writer, c *Commit) error {
+	date := c.AuthorTime().Format("2006-01-02")
+	_, err := fmt.Fprintf(w, "%s %s %s <%s> %s\n", c.hash, date, c.authorName, c.authorEmail, c.subject)
+	return err
+}
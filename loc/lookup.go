@@ -0,0 +1,133 @@
+// vcsloc/loc/lookup.go
+
+package loc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"vcsloc/vcs"
+)
+
+// MinPrefixLen is the shortest hash prefix ResolvePrefix accepts; git has
+// the same minimum.
+const MinPrefixLen = 4
+
+var (
+	ErrPrefixTooShort = errors.New("hash prefix too short")
+	ErrPrefixNotFound = errors.New("no commit with hash prefix")
+	ErrPrefixAmbiguous = errors.New("ambiguous hash prefix")
+)
+
+// ResolvePrefix finds the one commit whose hash starts with prefix. It fails
+// if the prefix is shorter than MinPrefixLen, matches nothing, or matches more
+// than one commit.
+func (db *VcsDb2) ResolvePrefix(prefix string) (vcs.Hash, error) {
+	if len(prefix) < MinPrefixLen {
+		return "", fmt.Errorf("%w: '%s' (need at least %d characters)", ErrPrefixTooShort, prefix, MinPrefixLen)
+	}
+	prefix = strings.ToLower(prefix)
+
+	index, err := db.hashIndex()
+	if err != nil {
+		return "", err
+	}
+
+	// Everything starting with prefix sorts together, starting here
+	i := sort.Search(len(index), func(i int) bool { return string(index[i]) >= prefix })
+	if i == len(index) || !strings.HasPrefix(string(index[i]), prefix) {
+		return "", fmt.Errorf("%w: '%s'", ErrPrefixNotFound, prefix)
+	}
+	if i+1 < len(index) && strings.HasPrefix(string(index[i+1]), prefix) {
+		return "", fmt.Errorf("%w: '%s' matches %s and %s", ErrPrefixAmbiguous, prefix, index[i], index[i+1])
+	}
+	return index[i], nil
+}
+
+// hashIndex returns the commit hashes in sorted order, loading them if needed.
+func (db *VcsDb2) hashIndex() ([]vcs.Hash, error) {
+	h := db.commits
+	if h.sorted != nil {
+		return h.sorted, nil
+	}
+
+	if h.hashes == nil {
+		h.err = nil
+		if err := h.LoadBase(db).LoadHashes(db).err; err != nil {
+			return nil, err
+		}
+	}
+
+	h.sorted = make([]vcs.Hash, len(h.hashes))
+	copy(h.sorted, h.hashes)
+	sort.Slice(h.sorted, func(i, j int) bool { return h.sorted[i] < h.sorted[j] })
+	return h.sorted, nil
+}
+
+// DefaultAbbrevLen is how long hashes are where output abbreviates them,
+// unless SetAbbrevLen changes it.
+const DefaultAbbrevLen = 12
+
+// abbrevLen is the least length of abbreviated hashes; see SetAbbrevLen.
+var abbrevLen = DefaultAbbrevLen
+
+// SetAbbrevLen sets how long hashes are where output abbreviates them. They
+// come out longer where n isn't enough to tell commits apart, and whole if
+// they're no longer than n (as svn revisions are). 0 means not to abbreviate.
+func SetAbbrevLen(n int) {
+	abbrevLen = n
+}
+
+// abbrevFor is the length to abbreviate hashes to, given the shortest
+// prefix length that tells them apart (0 if that isn't known, in which case
+// they aren't abbreviated); see Hash.Abbrev.
+func abbrevFor(unique int) int {
+	if abbrevLen <= 0 || unique <= 0 {
+		return 0
+	}
+	return max(abbrevLen, unique)
+}
+
+// AbbrevLen is the length to abbreviate the database's hashes to in output:
+// the one set with SetAbbrevLen, or longer if that's too short to tell every
+// commit apart.
+func (db *VcsDb2) AbbrevLen() int {
+	return abbrevFor(db.ShortestUniquePrefix())
+}
+
+// ShortestUniquePrefix is the shortest hash prefix length that tells every
+// commit in the database apart (and at least MinPrefixLen), for showing
+// hashes abbreviated without ambiguity; 7 or 10 characters aren't always
+// enough in big repos. If the hashes can't be loaded, it's 0, meaning
+// don't abbreviate.
+func (db *VcsDb2) ShortestUniquePrefix() int {
+	h := db.commits
+	if h.prefixLen == 0 {
+		index, err := db.hashIndex()
+		if err != nil {
+			return 0
+		}
+		h.prefixLen = uniquePrefixLen(index)
+	}
+	return h.prefixLen
+}
+
+// uniquePrefixLen is the shortest prefix length that tells apart all of the
+// sorted hashes. Only neighbours need comparing, since hashes sharing a
+// prefix sort together.
+func uniquePrefixLen(sorted []vcs.Hash) int {
+	n := MinPrefixLen
+	for i := 1; i < len(sorted); i++ {
+		a, b := sorted[i-1], sorted[i]
+		common := 0
+		for common < len(a) && common < len(b) && a[common] == b[common] {
+			common++
+		}
+		if common+1 > n {
+			n = common + 1
+		}
+	}
+	return n
+}
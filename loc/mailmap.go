@@ -0,0 +1,214 @@
+// vcsloc/loc/mailmap.go
+
+package loc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"vcsloc/gsos"
+)
+
+// Mailmap maps the author identities in commits onto canonical ones, with the
+// same rules as git's .mailmap files:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// The first three match on email alone, the last on name and email; a name
+// and email match wins. Matching ignores case, and "#" starts a comment.
+type Mailmap struct {
+	byEmail map[string]*mailmapEntry // keyed by lowercased commit email
+	signature string // identifies the mailmap contents, see Signature
+}
+
+// mailmapEntry is the rules for one commit email.
+type mailmapEntry struct {
+	name string // replacement name for any name, or "" to keep it
+	email string // replacement email for any name, or "" to keep it
+	byName map[string]mailmapIdentity // keyed by lowercased commit name
+}
+
+// mailmapIdentity is a replacement; an empty field is kept from the commit.
+type mailmapIdentity struct {
+	name string
+	email string
+}
+
+// LoadMailmap reads a mailmap file.
+func LoadMailmap(path string) (*Mailmap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMailmap(f)
+}
+
+// ParseMailmap reads a mailmap. Lines that aren't rules are ignored, as git
+// does.
+func ParseMailmap(r io.Reader) (*Mailmap, error) {
+	m := &Mailmap{byEmail: make(map[string]*mailmapEntry)}
+	hash := sha256.New()
+	err := gsos.ScanLines(r, func(line string) error {
+		fmt.Fprintf(hash, "%s\n", line)
+		m.addLine(line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.signature = hex.EncodeToString(hash.Sum(nil))[:16]
+	return m, nil
+}
+
+// addLine adds the rule on one mailmap line, if it has one.
+func (m *Mailmap) addLine(line string) {
+	if pos := strings.Index(line, "#"); pos != -1 {
+		line = line[:pos]
+	}
+	name1, email1, rest, ok := splitMailmapIdentity(line)
+	if !ok {
+		return
+	}
+	name2, email2, _, ok := splitMailmapIdentity(rest)
+
+	// With one email, it's the commit email; with two, the second is
+	if !ok {
+		m.add(name1, "", "", email1)
+		return
+	}
+	m.add(name1, email1, name2, email2)
+}
+
+// add adds a rule mapping commitName/commitEmail (commitName can be empty
+// to match any name) onto name/email.
+func (m *Mailmap) add(name, email, commitName, commitEmail string) {
+	key := strings.ToLower(commitEmail)
+	entry, ok := m.byEmail[key]
+	if !ok {
+		entry = &mailmapEntry{}
+		m.byEmail[key] = entry
+	}
+	if commitName == "" {
+		if name != "" {
+			entry.name = name
+		}
+		if email != "" {
+			entry.email = email
+		}
+		return
+	}
+	if entry.byName == nil {
+		entry.byName = make(map[string]mailmapIdentity)
+	}
+	entry.byName[strings.ToLower(commitName)] = mailmapIdentity{name: name, email: email}
+}
+
+// splitMailmapIdentity splits "Name <email> rest" into its parts. The name
+// can be empty; ok is false if there's no <email>.
+func splitMailmapIdentity(s string) (name, email, rest string, ok bool) {
+	left := strings.Index(s, "<")
+	if left == -1 {
+		return "", "", "", false
+	}
+	right := strings.Index(s[left:], ">")
+	if right == -1 {
+		return "", "", "", false
+	}
+	right += left
+	return strings.TrimSpace(s[:left]), s[left+1:right], s[right+1:], true
+}
+
+// Lookup returns the canonical name and email for an author. Anything the
+// mailmap doesn't mention comes back unchanged.
+func (m *Mailmap) Lookup(name, email string) (string, string) {
+	entry, ok := m.byEmail[strings.ToLower(email)]
+	if !ok {
+		return name, email
+	}
+	if id, ok := entry.byName[strings.ToLower(name)]; ok {
+		if id.name != "" {
+			name = id.name
+		}
+		if id.email != "" {
+			email = id.email
+		}
+		return name, email
+	}
+	if entry.name != "" {
+		name = entry.name
+	}
+	if entry.email != "" {
+		email = entry.email
+	}
+	return name, email
+}
+
+// Signature identifies the mailmap's contents, so a database can tell when
+// it was made with a different one.
+func (m *Mailmap) Signature() string {
+	return m.signature
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// SetMailmap makes the analyzer canonicalize commit authors with m. The raw
+// identity is kept as well; see Commit.RawAuthor.
+func (work *Analyzer) SetMailmap(m *Mailmap) {
+	work.mailmap = m
+}
+
+// mailmapSignature is the signature of the analyzer's mailmap, "" for none.
+func (work *Analyzer) mailmapSignature() string {
+	if work.mailmap == nil {
+		return ""
+	}
+	return work.mailmap.Signature()
+}
+
+// applyMailmap sets the author and committer of c from their raw
+// identities and the mailmap. It can be applied again, e.g. with a different
+// mailmap.
+func (work *Analyzer) applyMailmap(c *Commit) {
+	rawName, rawEmail := c.RawAuthor()
+	c.authorName, c.authorEmail, c.rawAuthorName, c.rawAuthorEmail = work.mapIdentity(rawName, rawEmail)
+	rawName, rawEmail = c.RawCommitter()
+	c.committerName, c.committerEmail, c.rawCommitterName, c.rawCommitterEmail = work.mapIdentity(rawName, rawEmail)
+}
+
+// mapIdentity looks up a raw identity in the mailmap. It returns the
+// identity to use, and the raw one to keep, if it changed.
+func (work *Analyzer) mapIdentity(rawName, rawEmail string) (string, string, string, string) {
+	name, email := rawName, rawEmail
+	if work.mailmap != nil {
+		name, email = work.mailmap.Lookup(rawName, rawEmail)
+	}
+	if name != rawName || email != rawEmail {
+		return name, email, rawName, rawEmail
+	}
+	return name, email, "", ""
+}
+
+// RawAuthor returns the author as recorded in the repo, before any mailmap.
+func (c *Commit) RawAuthor() (string, string) {
+	if c.rawAuthorName != "" || c.rawAuthorEmail != "" {
+		return c.rawAuthorName, c.rawAuthorEmail
+	}
+	return c.authorName, c.authorEmail
+}
+
+// RawCommitter returns the committer as recorded in the repo, before any
+// mailmap.
+func (c *Commit) RawCommitter() (string, string) {
+	if c.rawCommitterName != "" || c.rawCommitterEmail != "" {
+		return c.rawCommitterName, c.rawCommitterEmail
+	}
+	return c.committerName, c.committerEmail
+}
@@ -0,0 +1,87 @@
+// vcsloc/loc/mergebase.go
+
+package loc
+
+import (
+	"errors"
+	"fmt"
+
+	"vcsloc/vcs"
+)
+
+var ErrNoMergeBase = errors.New("no common ancestor")
+
+// MergeBase finds the lowest common ancestor of commits a and b from the
+// persisted graph, without going back to the repo: a common ancestor that
+// isn't an ancestor of any other common ancestor. Criss-cross merges can
+// leave more than one; then the newest is picked (ties go to the smaller
+// hash), so the answer is stable. Histories with no commit in common (e.g.
+// two root commits) give ErrNoMergeBase.
+func (db *VcsDb2) MergeBase(a, b vcs.Hash) (vcs.Hash, error) {
+	if db.graph.graph == nil {
+		if err := db.graph.Load(db); err != nil {
+			return "", err
+		}
+	}
+	graph := db.graph.graph
+	for _, hash := range []vcs.Hash{a, b} {
+		if _, ok := graph[hash]; !ok {
+			return "", fmt.Errorf("%s isn't in the graph", hash)
+		}
+	}
+
+	// Every common ancestor is reachable from b and an ancestor of a
+	fromA := ancestors(graph, []vcs.Hash{a})
+	var common []vcs.Hash
+	for hash := range ancestors(graph, []vcs.Hash{b}) {
+		if fromA[hash] {
+			common = append(common, hash)
+		}
+	}
+	if len(common) == 0 {
+		return "", fmt.Errorf("%w: %s and %s", ErrNoMergeBase, a, b)
+	}
+
+	// Drop the ones that are behind another common ancestor
+	var parents []vcs.Hash
+	for _, hash := range common {
+		parents = append(parents, graph[hash].parents...)
+	}
+	behind := ancestors(graph, parents)
+
+	var best vcs.Hash
+	for _, hash := range common {
+		if behind[hash] {
+			continue
+		}
+		if best == "" || graph[hash].timestamp > graph[best].timestamp ||
+			(graph[hash].timestamp == graph[best].timestamp && hash < best) {
+			best = hash
+		}
+	}
+	return best, nil
+}
+
+// ancestors is the hashes and every commit reachable from them by parent
+// links. Commits that aren't in the graph (outside a range) are left out.
+func ancestors(graph map[vcs.Hash]Commit, hashes []vcs.Hash) map[vcs.Hash]bool {
+	seen := make(map[vcs.Hash]bool)
+	var stack []vcs.Hash
+	for _, hash := range hashes {
+		if _, ok := graph[hash]; ok && !seen[hash] {
+			seen[hash] = true
+			stack = append(stack, hash)
+		}
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, parent := range graph[hash].parents {
+			if _, ok := graph[parent]; ok && !seen[parent] {
+				seen[parent] = true
+				stack = append(stack, parent)
+			}
+		}
+	}
+	return seen
+}
@@ -0,0 +1,140 @@
+// vcsloc/loc/merges.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// MergeStats summarizes merge habits: how many commits are merges, how many
+// parents they have, and (if change data was captured) how large they are.
+type MergeStats struct {
+	Commits int // all commits
+	Merges int // commits with more than one parent
+	Octopus int // commits with more than two parents
+	Parents int // total parent count over all merges
+
+	MergeChanges int // file changes recorded on merge commits
+	MergeLines int // lines added plus removed on merge commits
+
+	Mainline string // the default branch, "" if there isn't one
+	MainlineCommits int // commits on its first-parent chain
+	MainlineMerges int // merges among them
+
+	Months []MergeMonth // per calendar month (UTC), oldest first
+}
+
+// MergeMonth is the merge activity in one calendar month.
+type MergeMonth struct {
+	Month string // "2006-01"
+	Commits int
+	Merges int
+}
+
+// AvgParents is the average number of parents of a merge commit.
+func (m *MergeStats) AvgParents() float64 {
+	if m.Merges == 0 {
+		return 0
+	}
+	return float64(m.Parents) / float64(m.Merges)
+}
+
+// MergeStats computes merge statistics from the persisted commits.
+func (db *VcsDb2) MergeStats() (*MergeStats, error) {
+	stats := &MergeStats{}
+	months := make(map[string]*MergeMonth)
+
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		month := time.Unix(int64(c.timestamp), 0).UTC().Format("2006-01")
+		mm, ok := months[month]
+		if !ok {
+			mm = &MergeMonth{Month: month}
+			months[month] = mm
+		}
+
+		stats.Commits += 1
+		mm.Commits += 1
+		if len(c.parents) <= 1 {
+			return nil
+		}
+
+		stats.Merges += 1
+		mm.Merges += 1
+		stats.Parents += len(c.parents)
+		if len(c.parents) > 2 {
+			stats.Octopus += 1
+		}
+		for _, ch := range c.changes {
+			stats.MergeChanges += 1
+			stats.MergeLines += ch.add + ch.remove
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mm := range months {
+		stats.Months = append(stats.Months, *mm)
+	}
+
+	// How the default branch took its history: merged in, or committed
+	// straight to it
+	stats.Mainline, _ = db.DefaultBranch()
+	if stats.Mainline != "" {
+		mainline, err := db.Mainline()
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range mainline {
+			stats.MainlineCommits += 1
+			if len(db.graph.graph[hash].parents) > 1 {
+				stats.MainlineMerges += 1
+			}
+		}
+	}
+	sort.Slice(stats.Months, func(i, j int) bool { return stats.Months[i].Month < stats.Months[j].Month })
+	return stats, nil
+}
+
+// WriteMergeReport writes the merge statistics as text.
+func (db *VcsDb2) WriteMergeReport(w io.Writer) error {
+	stats, err := db.MergeStats()
+	if err != nil {
+		return err
+	}
+
+	direct := stats.Commits - stats.Merges
+	fmt.Fprintf(w, "commits:      %d\n", stats.Commits)
+	fmt.Fprintf(w, "direct:       %d\n", direct)
+	fmt.Fprintf(w, "merges:       %d (%.1f%%)\n", stats.Merges, percent(stats.Merges, stats.Commits))
+	fmt.Fprintf(w, "octopus:      %d\n", stats.Octopus)
+	fmt.Fprintf(w, "avg parents:  %.2f\n", stats.AvgParents())
+	if stats.Mainline != "" {
+		fmt.Fprintf(w, "mainline:     %d commits on %s, %d merges (%.1f%%)\n",
+			stats.MainlineCommits, stats.Mainline, stats.MainlineMerges, percent(stats.MainlineMerges, stats.MainlineCommits))
+	}
+	if stats.MergeChanges > 0 {
+		fmt.Fprintf(w, "merge size:   %d file changes, %d lines (%.1f lines/merge)\n",
+			stats.MergeChanges, stats.MergeLines, float64(stats.MergeLines)/float64(stats.Merges))
+	}
+
+	fmt.Fprintf(w, "\nmonth    commits  merges\n")
+	for _, mm := range stats.Months {
+		if _, err := fmt.Fprintf(w, "%s  %7d %7d\n", mm.Month, mm.Commits, mm.Merges); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// percent returns n as a percentage of total (0 if total is 0).
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,182 @@
+// vcsloc/loc/rawlog.go
+
+package loc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"vcsloc/gsos"
+	"vcsloc/vcs"
+)
+
+// rawLogVersion is the version of the raw log format. It has to change
+// whenever the log that ParseCommitLine reads does (see
+// vcs.VcsBackend.LogIncremental), so that an old dump isn't misread.
+const rawLogVersion = 1
+
+// errRawLogVersion is for a raw log without a version line.
+var errRawLogVersion = errors.New("raw log has no version; not written by vcsloc?")
+
+// DumpRawLog writes the log of the commits in scope, exactly as the backend
+// produces it for the database, so that it can be analyzed later with
+// ImportRawLog without the repo. It has change stats if the analyzer gathers
+// them (see SetStats) and the backend has them. Ahead of the log is a
+// header, with the format version, the vcs, whether there are stats, the
+// default branch, and the refs.
+func (work *Analyzer) DumpRawLog(w io.Writer) error {
+	stats := work.stats && work.Backend().SupportsStats()
+	refs := work.Backend().Refs()
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "version=%d\n", rawLogVersion)
+	fmt.Fprintf(bw, "vcs=%s\n", work.Backend().Name())
+	fmt.Fprintf(bw, "stats=%t\n", stats)
+	if branch := work.Backend().DefaultBranch(refs); branch != "" {
+		fmt.Fprintf(bw, "defaultBranch=%s\n", branch)
+	}
+	for _, ref := range refs {
+		fmt.Fprintf(bw, "ref=%s\n", formatRef(ref))
+	}
+
+	defer work.terminal.Busyf("Dumping log...")()
+	var n int
+	var err error
+	if work.Backend().CountObjects() > 0 && !work.scope.IsEmptyWindow() {
+		work.Backend().LogIncremental(func(line string) {
+			if strings.HasPrefix(line, vcs.LogRecordSep) {
+				n += 1
+				work.terminal.Report(gsos.Progress{Phase: "commits", Current: n})
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(bw, "%s\n", line)
+			}
+		}, stats, work.logArgs()...)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	if gsos.IsInterrupted() {
+		return fmt.Errorf("interrupted after %d commits", n)
+	}
+	work.terminal.Printf("Dumped %d commits, %d refs\n", n, len(refs))
+	return nil
+}
+
+// ImportRawLog builds the database from a log written by DumpRawLog, as if
+// it had been fetched from the repo. A log from another version of the
+// format is an error.
+func (work *Analyzer) ImportRawLog(r io.Reader) error {
+	defer work.terminal.Busyf("Reading raw log...")()
+
+	br := bufio.NewReader(r)
+	var version int
+	var vcsName string
+	var defaultBranch string
+	var stats bool
+	var refs []vcs.Ref
+	var commits []Commit
+	lineNum := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		lineNum += 1
+		line = strings.TrimSuffix(line, "\n")
+
+		// The header is everything ahead of the first commit
+		if len(commits) == 0 && !strings.HasPrefix(line, vcs.LogRecordSep) {
+			var refLine string
+			switch {
+			case getkvint(line, &version, "version="):
+				if version != rawLogVersion {
+					return fmt.Errorf("raw log is version %d, this vcsloc reads version %d; dump it again", version, rawLogVersion)
+				}
+			case getkvstr(line, &vcsName, "vcs="):
+			case getkvbool(line, &stats, "stats="):
+			case getkvstr(line, &defaultBranch, "defaultBranch="):
+			case getkvstr(line, &refLine, "ref="):
+				ref, err := parseRef(refLine)
+				if err != nil {
+					return fmt.Errorf("raw log line %d: %s", lineNum, err)
+				}
+				refs = append(refs, ref)
+			default:
+				return fmt.Errorf("raw log line %d: not a raw log header line: %q", lineNum, line)
+			}
+			continue
+		}
+		if version == 0 {
+			return errRawLogVersion
+		}
+
+		if strings.HasPrefix(line, vcs.LogRecordSep) {
+			if len(commits) > 0 {
+				work.finishCommit(&commits[len(commits)-1], stats)
+			}
+			commits = append(commits, Commit{})
+		}
+		work.ParseCommitLine(line, &commits[len(commits)-1])
+		if work.terminal.Ready() {
+			work.terminal.Progressf("Reading raw log (%d commits)...", len(commits))
+		}
+	}
+	if version == 0 {
+		return errRawLogVersion
+	}
+	if len(commits) > 0 {
+		work.finishCommit(&commits[len(commits)-1], stats)
+	}
+	work.finishStatStream()
+	work.finishCommitStream()
+
+	hashes := make([]vcs.Hash, len(commits))
+	for i := range commits {
+		hashes[i] = commits[i].hash
+	}
+
+	work.db.refs.refs = refs
+	work.db.refs.dirty = true
+	work.db.info.refsSignature = refsSignature(refs)
+	work.db.info.refsListSignature = "" // the repo's refs have to be listed again
+	if defaultBranch == "" {
+		defaultBranch = vcs.GuessDefaultBranch(refs)
+	}
+	if err := work.db.setDefaultBranch(defaultBranch); err != nil {
+		return err
+	}
+
+	work.db.commits.SetHashes(hashes)
+	work.db.commits.commits = commits
+	work.db.commits.dirty = true
+
+	work.markShallowBoundaries(nil)
+	work.db.graph.Build(work.db.commits.commits)
+	work.db.roots.Find(work.db.commits.commits)
+
+	work.db.info.numRepoCommits = len(commits)
+	work.db.info.graphUpToDate = true
+	work.db.info.haveStats = stats && work.storeStats
+	work.db.info.noLineCounts = false
+	work.db.info.haveCommitters = true
+	work.db.info.firstParentStats = false
+	work.db.info.mailmap = work.mailmapSignature()
+	work.db.info.excludePaths = nil
+	if work.db.info.haveStats {
+		work.db.info.excludePaths = work.exclude.Patterns()
+	}
+	work.db.info.dirty = true
+
+	work.terminal.Printf("Got %d commits, %d refs from %s raw log\n", len(commits), len(refs), vcsName)
+	return nil
+}
@@ -4,6 +4,7 @@ package loc
 
 import (
 	"fmt"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -12,73 +13,301 @@ import (
 	"vcsloc/vcs"
 )
 
-func NewAnalyzer(startTime time.Time, verbose bool, db *VcsDb2, ) *Analyzer {
+// NewAnalyzer creates an Analyzer for db, with its progress and messages
+// going to terminal (e.g. a gsos.ThrottleTerminal, or a gsos.NullTerminal to
+// run quietly).
+func NewAnalyzer(startTime time.Time, verbose bool, terminal gsos.Terminal, db *VcsDb2) *Analyzer {
 	return &Analyzer{
 		startTime: startTime,
 		verbose:
 		verbose,
 		db: db,
-		terminal: gsos.NewThrottleTerminal(100*time.Millisecond),
+		terminal: terminal,
+		stats: true,
+		storeStats: true,
 	}
 }
 
 type Analyzer struct {
 	db *VcsDb2
+	scope Scope
+	stats bool // gather per-file change stats with the commits
+	firstParentStats bool // gather stats for the mainline only
+	storeStats bool // keep the stats in the database
+	statStream *StatStream // if set, stats are streamed as they're read
+	commitStream *StatStream // if set, commits are streamed as they're read, see SetCommitStream
+	backend vcs.VcsBackend // the repo, see Backend
+	jobs int // how many trees Count counts at once; 0 is one per CPU
+	mailmap *Mailmap // canonicalizes authors, if set
+	exclude *PathFilter // paths left out of the stats, if set
+	maxObjects int // objects UpdateRepo takes on without asking, see SetMaxObjects
+	confirmLarge func(objects int) bool
+
+	inBody bool // reading a commit message body in the log, see ParseCommitLine
 
 	verbose bool
 	startTime time.Time
 	terminal gsos.Terminal
 }
 
+// SetScope limits the analysis to part of the repo history.
+func (work *Analyzer) SetScope(scope Scope) {
+	work.scope = scope
+}
+
+// SetStats controls whether per-file change stats are gathered along with the
+// commits (the default). Without them analysis is much faster, but only the
+// graph and author/commit data are available.
+func (work *Analyzer) SetStats(stats bool) {
+	work.stats = stats
+}
+
+// SetFirstParentStats limits the change stats to the first-parent spine of
+// each ref, with every mainline commit (merges included) diffed against its
+// first parent, like "git log --first-parent -m". This is churn as seen on
+// the integration branch. It changes the totals compared to the full walk:
+// there, each topic branch commit has its own changes and a merge only has
+// what its conflict resolution changed, while here a merge carries the net
+// change of the whole branch it brought in, work that was later undone on
+// the branch doesn't count, and commits off the mainline have no changes.
+// All commits are still fetched, and only the stats differ, unless the scope
+// is limited to first parents too (Scope.FirstParent), as --first-parent does.
+func (work *Analyzer) SetFirstParentStats(firstParent bool) {
+	work.firstParentStats = firstParent
+}
+
+// SetJobs sets how many external commands can run at once where work is
+// split up, e.g. one per tree in Count. 0 (the default) means one per CPU.
+func (work *Analyzer) SetJobs(jobs int) {
+	work.jobs = jobs
+}
+
+// SetMaxObjects makes UpdateRepo ask confirm before analyzing more than max
+// objects that it doesn't have yet, so that a huge repo isn't taken on by
+// mistake; if confirm is nil or says no, it stops with a fatal error. 0 (the
+// default) is no limit.
+func (work *Analyzer) SetMaxObjects(max int, confirm func(objects int) bool) {
+	work.maxObjects = max
+	work.confirmLarge = confirm
+}
+
+// numJobs is the worker count for SetJobs.
+func (work *Analyzer) numJobs() int {
+	if work.jobs > 0 {
+		return work.jobs
+	}
+	return runtime.NumCPU()
+}
+
+// Backend returns the backend for the database's repo.
+func (work *Analyzer) Backend() vcs.VcsBackend {
+	if work.backend == nil {
+		backend, err := vcs.NewBackend(work.db.hdr.vcs, work.db.hdr.repoPath)
+		if err != nil {
+			work.terminal.Fatalf("%s\n", err)
+		}
+		work.backend = backend
+	}
+	return work.backend
+}
+
+// logArgs returns the backend's arguments selecting the commits in scope.
+func (work *Analyzer) logArgs() []string {
+	return work.Backend().LogArgs(work.scope.revSpec())
+}
+
 func (work *Analyzer) Run() {
 	// Make sure our database is up-to-date with the target repo
 	// (this can take a while the first time)
-	work.UpdateRepo()
+	if !work.UpdateRepo() {
+		work.db.refs.Load(work.db) // not needed to see it was up to date
+	}
+	if gsos.IsInterrupted() {
+		return
+	}
+
+	if !work.scope.IsWhole() {
+		work.terminal.Printf("History limited to %s\n", work.scope)
+	}
+	work.terminal.Printf("Fingerprint %s (%d commits, %d refs)\n",
+		work.db.Fingerprint(), work.db.info.numRepoCommits, len(work.db.refs.refs))
 
-	// Courtesy terminate any progress message
-	work.terminal.Printf("")
+	work.ReportWarnings()
+}
+
+// ReportWarnings saves any warnings issued during the run to the database
+// directory and prints how many there were.
+func (work *Analyzer) ReportWarnings() {
+	warnings := work.terminal.Warnings()
+	if len(warnings) == 0 {
+		work.db.removeData(warningsName)
+		return
+	}
+
+	lines := make([]string, len(warnings))
+	for i, w := range warnings {
+		lines[i] = w + "\n"
+	}
+	if err := work.db.doSaveDataLines(warningsName, lines); err != nil {
+		work.terminal.Printf("%d warnings (could not save them: %s)\n", len(warnings), err)
+		return
+	}
+	work.terminal.Printf("%d warnings (see %s)\n", len(warnings), storePath(work.db.store, warningsName))
+}
+
+// Watch keeps the database up to date with the repo, checking it every interval
+// until stop is closed. Checks that find nothing changed are cheap (they only
+// count objects and read refs). The database is saved after each update.
+func (work *Analyzer) Watch(interval time.Duration, stop <-chan struct{}) {
+	work.db.info.Load(work.db)
+	for {
+		before := work.db.info.numRepoCommits
+		if work.UpdateRepo() && !gsos.IsInterrupted() {
+			after := work.db.info.numRepoCommits
+			work.terminal.Printf("%s: updated %d commits (%+d)\n",
+				time.Now().Format("2006-01-02 15:04:05"), after, after-before)
+			work.ReportWarnings()
+		}
+		if err := work.db.Save(); err != nil {
+			work.terminal.Fatalf("%s\n", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
 }
 
 // ----------------------------------------------------------------------------------------------
 
-func (work *Analyzer) UpdateRepo() {
+// UpdateRepo brings the database up to date with the repo. It returns false
+// if the database was already up to date. If it's interrupted (see
+// gsos.Interrupt), it stops early, leaving the database marked as out of date
+// and any commits fetched so far in a checkpoint.
+func (work *Analyzer) UpdateRepo() bool {
 
 	work.terminal.Force().Progressf("Checking repo...")
 
+	if work.stats && !work.Backend().SupportsStats() {
+		work.terminal.Printf("No change stats for %s repos\n", work.Backend().Name())
+		work.stats = false
+	}
+
+	// If the history scope changed, what we have can't be reused
+	scopeChanged := !work.scope.Equal(work.db.hdr.scope)
+	if scopeChanged {
+		work.terminal.Printf("Scope changed from %s to %s\n", work.db.hdr.scope, work.scope)
+		work.db.hdr.scope = work.scope
+	}
+	bare := work.Backend().IsBare()
+	if scopeChanged || bare != work.db.hdr.bare {
+		work.db.hdr.bare = bare
+		if err := work.db.hdr.Save(work.db); err != nil {
+			work.terminal.Fatalf("Could not write db hdr: %s\n", err)
+		}
+	}
+
 	// Check the size of the repo (we may want a progress bar on long repos)
 	work.db.info.Load(work.db)
 
-	numObjects, _ := vcs.GitCountObjects(work.db.hdr.repoPath)
-
-	// Get all the refs from the repo and compare against our local refs
-	work.db.refs.Load(work.db)
+	numObjects := work.Backend().CountObjects()
 
+	// Get all the refs from the repo and compare against our local refs.
+	// The signature in the info is enough; databases from before it was
+	// stored have to compare against the refs file. If the backend's
+	// cheaper signature hasn't changed, neither have the refs, and the
+	// stored ones save listing them all.
 	var refs []vcs.Ref
-	refs, _ = vcs.GitRefs(work.db.hdr.repoPath)
+	listSignature := work.Backend().RefsSignature()
+	if listSignature != "" && listSignature == work.db.info.refsListSignature && work.db.info.refsSignature != "" && work.db.refs.Load(work.db) == nil {
+		refs = work.db.refs.refs
+	} else {
+		refs = work.Backend().Refs()
+	}
+	signature := refsSignature(refs)
 	var sameRefs bool
+	if err := work.db.setDefaultBranch(work.Backend().DefaultBranch(refs)); err != nil {
+		work.terminal.Fatalf("Could not write db hdr: %s\n", err)
+	}
 
-	if len(refs) == len(work.db.refs.refs) {
-		sameRefs = true
-		for i := 0; i < len(refs); i++ {
-			if refs[i].RefHash != work.db.refs.refs[i].RefHash {
-				sameRefs = false
-			}
-			if refs[i].Refname != work.db.refs.refs[i].Refname {
-				sameRefs = false
-			}
-		}
+	if work.db.info.refsSignature != "" {
+		sameRefs = signature == work.db.info.refsSignature
+	} else if work.db.refs.Load(work.db) == nil {
+		// The signature doesn't depend on the order, and refs files from
+		// before GitRefs sorted its refs could be in any order
+		sameRefs = signature == refsSignature(work.db.refs.refs)
 	}
 
 	// If we have the same objects and the same refs, we have all
 	// the data (this is probably too strong, either is likely sufficient)
-	if work.db.info.graphUpToDate && work.db.info.numRepoObjects == numObjects && sameRefs {
-		work.terminal.Printf("Database up to date\n")
-		return
+	// If we want stats and don't have them, we have to fetch again
+	missingStats := work.stats && work.storeStats && !work.db.info.haveStats && work.db.info.numRepoCommits > 0
+	if missingStats {
+		work.terminal.Printf("Database has no change stats\n")
+	} else if work.stats && work.storeStats && work.db.info.haveStats && work.db.info.firstParentStats != work.firstParentStats {
+		work.terminal.Printf("Database has change stats for a different walk\n")
+		missingStats = true
+	} else if work.stats && work.storeStats && work.db.info.haveStats &&
+		strings.Join(work.db.info.excludePaths, ", ") != strings.Join(work.exclude.Patterns(), ", ") {
+		work.terminal.Printf("Database has change stats for different excluded paths\n")
+		missingStats = true
+	}
+
+	// Databases from before committers were kept have to fetch again too
+	missingCommitters := !work.db.info.haveCommitters && work.db.info.numRepoCommits > 0
+	if missingCommitters {
+		work.terminal.Printf("Database has no committers\n")
+	}
+	// A rebase or filter-repo can leave the stored commits stale without
+	// the counts showing it
+	rewritten := work.historyRewritten()
+	refetch := missingStats || missingCommitters || rewritten
+
+	// A different mailmap doesn't need a fetch, just a new pass over the
+	// authors (see mergeCommits)
+	mailmapChanged := work.db.info.mailmap != work.mailmapSignature()
+	if mailmapChanged {
+		work.terminal.Printf("Mailmap changed\n")
+	}
+
+	if !scopeChanged && !refetch && !mailmapChanged && work.db.info.graphUpToDate && work.db.info.numRepoObjects == numObjects && sameRefs {
+		if work.db.info.refsSignature == "" || work.db.info.refsListSignature != listSignature {
+			// Databases from before the signatures get them now. Saving
+			// recomputes the fingerprint, which needs the stored refs.
+			if err := work.db.refs.Load(work.db); err != nil {
+				work.terminal.Fatalf("%s\n", err)
+			}
+			work.db.info.refsSignature = signature
+			work.db.info.refsListSignature = listSignature
+			if err := work.db.info.Save(work.db); err != nil {
+				work.terminal.Fatalf("Could not write db hdr: %s\n", err)
+			}
+		}
+		work.terminal.Force().Progressf("Database up to date")
+		return false
 	}
 
 	// Something didn't match, update our data
+	work.db.refs.Load(work.db)
 	work.terminal.Printf("Got %d/%d objects, %d/%d refs\n",
 		work.db.info.numRepoObjects, numObjects, len(work.db.refs.refs), len(refs))
+	if numObjects == 0 {
+		work.terminal.Printf("Repo is empty\n")
+	}
+
+	// Don't start on a huge repo by mistake. What we have only counts if
+	// it can be kept.
+	newObjects := numObjects
+	if !scopeChanged && !refetch && work.db.info.graphUpToDate {
+		newObjects -= work.db.info.numRepoObjects
+	}
+	if work.maxObjects > 0 && newObjects > work.maxObjects {
+		if work.confirmLarge == nil || !work.confirmLarge(newObjects) {
+			work.terminal.Fatalf("Stopped: %d objects to analyze, more than the limit of %d\n", newObjects, work.maxObjects)
+		}
+	}
 
 	work.terminal.Printf("Updating repo...\n")
 
@@ -88,12 +317,25 @@ func (work *Analyzer) UpdateRepo() {
 
 	work.db.refs.refs = refs
 	work.db.refs.dirty = true
-
-	// Now update our commits list. We just get the whole thing, it's faster
-	// than trying to do it incrementally.
-	work.db.commits.hashes = work.FetchAllCommitHashes()
-	work.db.commits.dirty = true
-	work.db.info.numRepoCommits = len(work.db.commits.commits)
+	if skipped := len(refs) - len(work.db.refs.CommitRefs()); skipped > 0 {
+		work.terminal.Printf("Skipping %d refs that aren't commits\n", skipped)
+	}
+	work.db.info.refsSignature = signature
+	work.db.info.refsListSignature = listSignature
+
+	// Now update our commits list. Getting all the hashes is fast; if the
+	// commits we already have are still good, we only fetch the new ones.
+	hashes, _ := work.FetchAllCommitHashes()
+	if gsos.IsInterrupted() {
+		return true
+	}
+	shallow := work.shallowCommits()
+	var missing []vcs.Hash
+	if !scopeChanged && !refetch && !work.firstParentStats && work.db.info.graphUpToDate {
+		missing = work.findMissingCommits(hashes, shallow)
+	}
+	work.db.commits.SetHashes(hashes)
+	work.db.info.numRepoCommits = len(work.db.commits.hashes)
 	work.db.info.graphUpToDate = false // we might have changed commits, re-scan
 
 	// Do incremental save - we'll update the other parts next
@@ -102,39 +344,226 @@ func (work *Analyzer) UpdateRepo() {
 	work.db.commits.Save(work.db)
 
 	// Now see if we need to fetch more raw commits
-	work.FetchMissingCommits()
+	total := work.db.info.numRepoCommits
+	if missing != nil {
+		total = len(missing)
+	}
+	work.FetchMissingCommits(missing, total)
+	if gsos.IsInterrupted() {
+		return true
+	}
 
-	// Do incremental save
+	// The commits, and so the parent links, are now complete
+	work.markShallowBoundaries(shallow)
+	done := work.terminal.Busyf("Building graph...")
+	work.db.graph.Build(work.db.commits.commits)
+	work.db.roots.Find(work.db.commits.commits)
+	done()
+	work.terminal.Printf("Found %d root commits\n", len(work.db.roots.roots))
+	work.db.info.graphUpToDate = true
+	work.db.info.haveStats = work.stats && work.storeStats
+	work.db.info.noLineCounts = false
+	work.db.info.haveCommitters = true
+	work.db.info.firstParentStats = work.db.info.haveStats && work.firstParentStats
+	work.db.info.mailmap = work.mailmapSignature()
+	work.db.info.excludePaths = nil
+	if work.db.info.haveStats {
+		work.db.info.excludePaths = work.exclude.Patterns()
+	}
+
+	// Do incremental save. The commits are all saved now, so a checkpoint
+	// from the fetch isn't needed any more.
 	work.db.info.Save(work.db)
 	work.db.refs.Save(work.db)
-	work.db.commits.Save(work.db)
+	if err := work.db.commits.Save(work.db); err == nil {
+		work.db.checkpoint.Clear(work.db)
+	}
+	work.db.graph.Save(work.db)
+	work.db.roots.Save(work.db)
+	return true
+}
+
+// shallowCommits returns the edge of a shallow clone as a set; it's empty
+// for a full repo.
+func (work *Analyzer) shallowCommits() map[vcs.Hash]bool {
+	shallow := make(map[vcs.Hash]bool)
+	for _, hash := range work.Backend().ShallowCommits() {
+		shallow[hash] = true
+	}
+	return shallow
+}
+
+// markShallowBoundaries flags the commits at the edge of a shallow clone.
+// Those are the ones the repo lists, and, for the whole history, any commit
+// with a parent that isn't there; a missing parent is treated as the edge of
+// the history rather than an error.
+func (work *Analyzer) markShallowBoundaries(shallow map[vcs.Hash]bool) {
+	commits := work.db.commits.commits
+	known := make(map[vcs.Hash]bool, len(commits))
+	for i := range commits {
+		known[commits[i].hash] = true
+	}
+
+	var n int
+	for i := range commits {
+		c := &commits[i]
+		c.shallowBoundary = shallow[c.hash]
+		if work.scope.IsWhole() {
+			for _, parent := range c.parents {
+				if !known[parent] {
+					c.shallowBoundary = true
+				}
+			}
+		}
+		if c.shallowBoundary {
+			n += 1
+		}
+	}
+	if n > 0 {
+		work.terminal.Printf("Shallow clone: %d commits at the edge of the history\n", n)
+	}
+}
+
+// historyRewritten checks that the tips the database has are still in the
+// repo. If any are gone, history was rewritten, and none of the stored
+// commits can be trusted; the database starts over, as a new generation of
+// history (see VcsDb2.HistoryGeneration).
+func (work *Analyzer) historyRewritten() bool {
+	if work.db.info.numRepoCommits == 0 {
+		return false
+	}
+	work.db.refs.Load(work.db)
+	var tips []vcs.Hash
+	seen := make(map[vcs.Hash]bool)
+	for _, ref := range work.db.refs.CommitRefs() {
+		if !seen[ref.RefHash] {
+			seen[ref.RefHash] = true
+			tips = append(tips, ref.RefHash)
+		}
+	}
+	gone := work.Backend().MissingCommits(tips)
+	if len(gone) == 0 {
+		return false
+	}
+
+	work.terminal.Printf("History was rewritten: %d of %d tips are gone from the repo\n", len(gone), len(tips))
+	work.db.hdr.historyGeneration += 1
+	if err := work.db.hdr.Save(work.db); err != nil {
+		work.terminal.Fatalf("Could not write db hdr: %s\n", err)
+	}
+	return true
 }
 
 // FetchAllCommitHashes fetches just the commit hashes. This should run at
-// about 100K hashes/second.
-func (work *Analyzer) FetchAllCommitHashes() []vcs.Hash {
+// about 100K hashes/second. It returns the hashes and how long it took; the
+// hashes rather than their count, which is len(hashes), since UpdateRepo
+// needs them to find the commits it doesn't have.
+func (work *Analyzer) FetchAllCommitHashes() ([]vcs.Hash, time.Duration) {
+	startTime := gsos.HighresTime()
+	progress := func(n int) {
+		work.terminal.Report(gsos.Progress{Phase: "hashes", Current: n})
+	}
+	// The log can be a while starting on a big repo
+	defer work.terminal.Busyf("Getting commit hashes...")()
+
 	var hashes []vcs.Hash
-	outCb := func(line string) {
-		hashes = append(hashes, vcs.Hash(line))
-		if work.terminal.Ready() {
-			work.terminal.Progressf("Getting commit hashes (%d)...", len(hashes))
-		}
+	if !work.noCommits() {
+		hashes = work.Backend().AllCommitHashes(progress, work.logArgs()...)
 	}
+	elapsed := (gsos.HighresTime() - startTime).Duration()
+	work.terminal.Printf("Got %d commit hashes in %.2f sec\n", len(hashes), elapsed.Seconds())
 
-	cmd := []string{"log", "--all", "--pretty=%H"}
-	vcs.RunGitCommandIncremental(outCb, nil, work.db.hdr.repoPath, nil, cmd...)
-	work.terminal.Printf("Got %d commit hashes\n", len(hashes))
+	return hashes, elapsed
+}
+
+// noCommits is true if there can't be any commits in scope: the repo is
+// empty (freshly created), or the date window is. The backend isn't relied on
+// for either; a log of a range or a path in an empty repo fails, since it
+// names a ref that isn't there yet.
+func (work *Analyzer) noCommits() bool {
+	return work.db.info.numRepoObjects == 0 || work.scope.IsEmptyWindow()
+}
+
+// findMissingCommits loads the commits we already have and returns the ones
+// in hashes that aren't among them. It returns nil if the stored commits
+// can't be used, so that everything is fetched again. That includes a
+// shallow clone that was deepened (or made shallower), since commits at the
+// old edge were logged without their parents.
+func (work *Analyzer) findMissingCommits(hashes []vcs.Hash, shallow map[vcs.Hash]bool) []vcs.Hash {
+	if err := work.db.commits.Load(work.db); err != nil {
+		return nil
+	}
+	if len(work.db.commits.commits) == 0 || len(work.db.commits.commits) != len(work.db.commits.hashes) {
+		return nil
+	}
+	for i := range work.db.commits.commits {
+		c := &work.db.commits.commits[i]
+		if c.shallowBoundary != shallow[c.hash] {
+			work.terminal.Printf("Shallow clone boundary moved\n")
+			return nil
+		}
+	}
 
-	return hashes
+	known := make(map[vcs.Hash]bool, len(work.db.commits.commits))
+	for i := range work.db.commits.commits {
+		known[work.db.commits.commits[i].hash] = true
+	}
+	missing := []vcs.Hash{}
+	for _, hash := range hashes {
+		if !known[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
 }
 
 // FetchMissingCommits fetches commits that we haven't received yet. This should
 // run at about 2000 commits/second without -m, and about 500 commits/sec with -m.
-func (work *Analyzer) FetchMissingCommits() {
+// If missing is nil, every commit in scope is fetched. Otherwise only the
+// commits in missing are new: the log is cut off at the old tips that are
+// still in the repo, and what comes back is merged with the commits we already
+// have. Either way, the commits end up in the order of db.commits.hashes, and
+// commits that are no longer in it (from deleted or rewound refs) are dropped.
+// total is how many commits are expected, for progress; 0 if it isn't known.
+// It returns the number of commits fetched and how long fetching them took.
+// A full fetch from a git repo saves a checkpoint every checkpointBatch
+// commits, and if it's interrupted, the next one picks up after the last
+// checkpoint (see VcsCheckpoint). If it's stopped with gsos.Interrupt, the
+// commits it got are saved as a checkpoint and the database is left as it was.
+func (work *Analyzer) FetchMissingCommits(missing []vcs.Hash, total int) (int, time.Duration) {
+	if missing != nil && len(missing) == 0 {
+		work.mergeCommits(nil)
+		return 0, 0
+	}
+	defer work.terminal.Busyf("Getting commits...")()
+	startTime := gsos.HighresTime()
 	var commits []Commit
 	var i int
+
+	// Resuming needs "git log --skip"
+	checkpoint := missing == nil && work.Backend().Name() == "git"
+	var signature string
+	if checkpoint {
+		signature = work.checkpointSignature()
+		commits = work.db.checkpoint.Resume(work.db, signature, work.db.commits.hashes)
+		if len(commits) > 0 {
+			work.terminal.Printf("Resuming after %d commits\n", len(commits))
+		}
+	}
+	resumed := len(commits)
+
+	streamStats := work.stats && !work.firstParentStats
 	outCb := func(line string) {
-		if strings.HasPrefix(line, "|Commit|") {
+		if strings.HasPrefix(line, vcs.LogRecordSep) {
+			if len(commits) > resumed {
+				work.finishCommit(&commits[i], streamStats)
+			}
+			// Everything so far is complete, so it can go in a batch
+			if checkpoint && len(commits)-work.db.checkpoint.fetched >= checkpointBatch {
+				if err := work.db.checkpoint.AddBatch(work.db, signature, commits); err != nil {
+					work.terminal.Warnf("Could not save checkpoint: %s", err)
+				}
+			}
 			i = len(commits)
 			commits = append(commits, Commit{})
 		}
@@ -142,62 +571,252 @@ func (work *Analyzer) FetchMissingCommits() {
 		if work.verbose {
 			fmt.Printf("%s\n", line)
 		}
-		if work.terminal.Ready() {
-			work.terminal.Progressf("Getting commits (%d)...", len(commits))
+		work.terminal.Report(gsos.Progress{Phase: "commits", Current: len(commits), Total: total})
+	}
+
+	if !work.noCommits() {
+		args := work.logArgs()
+		if missing != nil {
+			spec := work.scope.revSpec()
+			spec.Exclude = work.oldTips()
+			args = work.Backend().LogArgs(spec)
+		}
+		if resumed > 0 {
+			args = append(args, fmt.Sprintf("--skip=%d", resumed))
 		}
+		work.Backend().LogIncremental(outCb, streamStats, args...)
+	}
+	if len(commits) > resumed && !gsos.IsInterrupted() {
+		work.finishCommit(&commits[i], streamStats)
 	}
 
-	prettyFormat := "--pretty=format:|Commit| %H |Timestamp| %at |AuthorName| %aN |AuthorEmail| %aE |Parents| %P"
-	cmd := []string{"log", "-c", "--numstat", "--summary", prettyFormat, "--all"}
-	vcs.RunGitCommandIncremental(outCb, nil, work.db.hdr.repoPath, nil, cmd...)
+	if work.stats && work.firstParentStats && len(commits) > 0 && !gsos.IsInterrupted() {
+		work.FetchFirstParentStats(commits)
+	}
+	work.finishStatStream()
+	work.finishCommitStream()
+	elapsed := (gsos.HighresTime() - startTime).Duration()
+
+	// Keep what an interrupted fetch got for next time; the last commit may
+	// have been cut off
+	if gsos.IsInterrupted() {
+		if checkpoint && len(commits)-1 > work.db.checkpoint.fetched {
+			if err := work.db.checkpoint.AddBatch(work.db, signature, commits[:len(commits)-1]); err != nil {
+				work.terminal.Warnf("Could not save checkpoint: %s", err)
+			} else {
+				work.terminal.Printf("Saved %d commits to carry on from\n", len(commits)-1)
+			}
+		}
+		return len(commits) - resumed, elapsed
+	}
+	count := len(commits) - resumed
+	work.terminal.Printf("Got %d commits in %.2f sec\n", count, elapsed.Seconds())
 
+	if missing != nil {
+		work.mergeCommits(commits)
+		return count, elapsed
+	}
 	work.db.commits.commits = commits
 	work.db.commits.dirty = true
+	return count, elapsed
+}
+
+// oldTips returns the commits we already have that have no children among
+// them, and are still in db.commits.hashes. Everything reachable from them
+// was fetched before.
+func (work *Analyzer) oldTips() []vcs.Hash {
+	current := make(map[vcs.Hash]bool, len(work.db.commits.hashes))
+	for _, hash := range work.db.commits.hashes {
+		current[hash] = true
+	}
+	hasChild := make(map[vcs.Hash]bool, len(work.db.commits.commits))
+	for i := range work.db.commits.commits {
+		for _, parent := range work.db.commits.commits[i].parents {
+			hasChild[parent] = true
+		}
+	}
 
-	work.terminal.Printf("Got %d commits\n", len(commits))
+	var tips []vcs.Hash
+	for i := range work.db.commits.commits {
+		hash := work.db.commits.commits[i].hash
+		if !hasChild[hash] && current[hash] {
+			tips = append(tips, hash)
+		}
+	}
+	return tips
+}
+
+// mergeCommits merges newly fetched commits with the ones we already have,
+// putting them in the order of db.commits.hashes, and applies the current
+// mailmap to all of them. Commits that aren't in it
+// any more are pruned. If a commit is still missing after the merge, all
+// the commits are fetched again.
+func (work *Analyzer) mergeCommits(fetched []Commit) {
+	byHash := make(map[vcs.Hash]*Commit, len(work.db.commits.commits)+len(fetched))
+	for i := range work.db.commits.commits {
+		byHash[work.db.commits.commits[i].hash] = &work.db.commits.commits[i]
+	}
+	for i := range fetched {
+		byHash[fetched[i].hash] = &fetched[i]
+	}
+
+	commits := make([]Commit, 0, len(work.db.commits.hashes))
+	for _, hash := range work.db.commits.hashes {
+		c, ok := byHash[hash]
+		if !ok {
+			work.terminal.Printf("Commit %s was not fetched, fetching all commits\n", hash)
+			work.FetchMissingCommits(nil, len(work.db.commits.hashes))
+			return
+		}
+		work.applyMailmap(c) // the mailmap may have changed
+		commits = append(commits, *c)
+		delete(byHash, hash)
+	}
+
+	if len(byHash) > 0 {
+		work.terminal.Printf("Pruned %d commits no longer in the repo\n", len(byHash))
+	}
+	work.db.commits.commits = commits
+	work.db.commits.dirty = true
+}
+
+// FetchFirstParentStats fills in the changes of the commits on the
+// first-parent spine of the refs in scope, each diffed against its first
+// parent. See SetFirstParentStats. This is git only, like the stats.
+func (work *Analyzer) FetchFirstParentStats(commits []Commit) {
+	defer work.terminal.Busyf("Getting mainline stats...")()
+	index := make(map[vcs.Hash]int, len(commits))
+	for i := range commits {
+		index[commits[i].hash] = i
+	}
+
+	var c *Commit
+	var count int
+	outCb := func(line string) {
+		if strings.HasPrefix(line, "|Stats| ") {
+			if c != nil {
+				work.finishCommitStats(c)
+			}
+			c = nil
+			if i, ok := index[vcs.Hash(line[8:])]; ok {
+				c = &commits[i]
+				c.changes = nil
+			}
+			count += 1
+			work.terminal.Report(gsos.Progress{Phase: "mainline stats", Current: count})
+			return
+		}
+		if c != nil {
+			work.ParseStatLine(line, c)
+		}
+	}
+
+	cmd := []string{"log", "--pretty=format:|Stats| %H", "--first-parent", "-m", "--numstat", "--summary"}
+	cmd = append(cmd, work.logArgs()...)
+	vcs.RunGitCommandIncremental(outCb, nil, work.db.hdr.repoPath, nil, cmd...)
+	if c != nil {
+		work.finishCommitStats(c)
+	}
+
+	work.terminal.Printf("Got stats for %d mainline commits\n", count)
 }
 
 // ParseCommitLine reads the commit log (our specific format) and writes
 // commit data
 func (work *Analyzer) ParseCommitLine(line string, c *Commit) {
 	// If this is the first line of a commit, parse out the commit header info
-	if cPos := strings.Index(line, "|Commit| "); cPos != -1 {
-		cPos := strings.Index(line, "|Commit| ")
-		tPos := strings.Index(line, "|Timestamp| ")
-		anPos := strings.Index(line, "|AuthorName| ")
-		aePos := strings.Index(line, "|AuthorEmail| ")
-		pPos := strings.Index(line, "|Parents| ")
-		if cPos == -1  || tPos == -1 || anPos == -1 || aePos == -1 || pPos == -1 {
-			work.terminal.Fatalf("Bad log: %s\n", line)
-		}
-
-		commitHash := line[cPos+9:tPos-1]
-		timestampS := line[tPos+12:anPos-1]
-		authorName := line[anPos+13:aePos-1]
-		authorEmail := line[aePos+14:pPos-1]
-		parentS := strings.TrimSpace(line[pPos+10:])
-		var parentHashes []string
-		if parentS == "" {
-			parentHashes = nil
-		} else {
-			parentHashes = strings.Split(line[pPos+10:], " ")
+	if strings.HasPrefix(line, vcs.LogRecordSep) {
+		if err := parseCommitHeader(line, c); err != nil {
+			work.terminal.Fatalf("Bad log (%s): %q\n", err, line)
 		}
-
-		timestamp, err := strconv.Atoi(timestampS)
-		if err != nil {
-			work.terminal.Fatalf("Bad log (timestamp): %s\n", line)
+		if work.scope.FirstParent && len(c.parents) > 1 {
+			c.parents = c.parents[:1]
 		}
+		work.applyMailmap(c)
+		work.inBody = true
+		return
+	}
+	if work.inBody {
+		work.inBody = addBodyLine(line, c)
+		return
+	}
 
-		c.hash = commitHash
-		c.timestamp = timestamp
-		c.authorName = authorName
-		c.authorEmail = authorEmail
-		c.parents = parentHashes
-		c.children = nil // filled in by graph traversal
+	work.ParseStatLine(line, c)
+}
 
-		return
+// parseTzOffset turns a "+hhmm" or "-hhmm" timezone into minutes east of UTC.
+func parseTzOffset(tz string) (int, error) {
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return 0, fmt.Errorf("timezone '%s'", tz)
+	}
+	hh, err1 := strconv.Atoi(tz[1:3])
+	mm, err2 := strconv.Atoi(tz[3:5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("timezone '%s'", tz)
 	}
+	offset := hh*60 + mm
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
 
+// addBodyLine adds a line of the commit message body to c. It's false for
+// the last line, the one ending in vcs.LogBodyEnd; the end marker on a line
+// of its own isn't part of the body.
+func addBodyLine(line string, c *Commit) bool {
+	text, end := strings.CutSuffix(line, vcs.LogBodyEnd)
+	if !end || text != "" {
+		c.body += text + "\n"
+	}
+	if end {
+		c.body = strings.TrimRight(c.body, "\n")
+	}
+	return !end
+}
+
+// parseCommitHeader reads a commit header line (see vcs.VcsBackend's
+// LogIncremental) into c. The fields are split on vcs.LogFieldSep, so names
+// and subjects can hold anything, including text that looks like a field.
+func parseCommitHeader(line string, c *Commit) error {
+	fields := strings.SplitN(strings.TrimPrefix(line, vcs.LogRecordSep), vcs.LogFieldSep, 10)
+	if len(fields) != 10 {
+		return fmt.Errorf("%d fields, wanted 10", len(fields))
+	}
+
+	timestamp, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("timestamp '%s'", fields[1])
+	}
+	committerTimestamp, err := strconv.Atoi(fields[7])
+	if err != nil {
+		return fmt.Errorf("committer timestamp '%s'", fields[7])
+	}
+	tzOffset, err := parseTzOffset(fields[2])
+	if err != nil {
+		return err
+	}
+
+	c.hash = vcs.Hash(fields[0])
+	c.timestamp = timestamp
+	c.tzOffset = tzOffset
+	c.authorName = fields[3]
+	c.authorEmail = fields[4]
+	c.markNoAuthor()
+	c.committerName = fields[5]
+	c.committerEmail = fields[6]
+	c.committerTimestamp = committerTimestamp
+	c.parents = vcs.ParseHashList(fields[8])
+	c.subject = fields[9]
+	c.children = nil // filled in by graph traversal
+	return nil
+}
+
+// ParseStatLine reads a --numstat or --summary line of the commit log into c.
+// Each numstat line adds a Change, and the summary lines that follow mark
+// those changes as creates, deletes or renames. A merge logged with -c has
+// one combined block, with only the files its merge resolution changed.
+func (work *Analyzer) ParseStatLine(line string, c *Commit) {
 	// ignore blank line
 	if line == "" {
 		return
@@ -208,12 +827,115 @@ func (work *Analyzer) ParseCommitLine(line string, c *Commit) {
 	// (we count on the fact that no random line will have precisely two tabs)
 	tokens := strings.Split(line, "\t")
 	if len(tokens) == 3 {
-		// do work
+		var ch Change
+		if tokens[0] == "-" && tokens[1] == "-" {
+			ch.binary = true
+		} else {
+			var err1, err2 error
+			ch.add, err1 = strconv.Atoi(tokens[0])
+			ch.remove, err2 = strconv.Atoi(tokens[1])
+			if err1 != nil || err2 != nil {
+				work.terminal.Warnf("%s: ignoring bad numstat line '%s'", c.hash, line)
+				return
+			}
+		}
+
+		// A rename is "<old> => <new>"
+		if oldPath, path, ok := splitRename(tokens[2]); ok {
+			ch.rename = true
+			ch.oldPath, ch.path = oldPath, path
+		} else {
+			ch.path = vcs.GitUnquotePath(tokens[2])
+		}
+		c.changes = append(c.changes, ch)
 		return
 	}
 
 	// Otherwise, it must be a summary line, which refers back to
 	// one of the files we have from numstat
+	switch {
+	case strings.HasPrefix(line, " create mode "), strings.HasPrefix(line, " delete mode "):
+		//  examplar line: " create mode 100644 .gitattributes"
+		fields := strings.SplitN(line[1:], " ", 4)
+		if len(fields) != 4 {
+			work.terminal.Warnf("%s: ignoring bad summary line '%s'", c.hash, line)
+			return
+		}
+		ch := c.change(vcs.GitUnquotePath(fields[3]))
+		ch.create = fields[0] == "create"
+		ch.delete = fields[0] == "delete"
+	case strings.HasPrefix(line, " rename "):
+		//  examplar line: " rename test.sh => t/test.sh (100%)"
+		text := line[8:]
+		if pos := strings.LastIndex(text, " ("); pos != -1 {
+			text = text[:pos]
+		}
+		oldPath, path, ok := splitRename(text)
+		if !ok {
+			work.terminal.Warnf("%s: ignoring bad summary line '%s'", c.hash, line)
+			return
+		}
+		ch := c.change(path)
+		ch.rename = true
+		ch.oldPath = oldPath
+	case strings.HasPrefix(line, " mode change "), strings.HasPrefix(line, " copy "):
+		// We don't care
+	default:
+		work.terminal.Warnf("%s: ignoring unknown log line '%s'", c.hash, line)
+	}
+}
+
+// splitRename splits a rename in numstat or summary output, "<old> => <new>",
+// into its paths. Either path can be quoted (see vcs.GitUnquotePath), so a
+// quoted old path is skipped over whole in looking for the arrow. Git
+// compacts a rename that keeps the start or end of the path, writing only
+// the part that changed in braces, e.g. "src/{old => new}/file.go" or
+// "src/{ => sub}/file.go"; those are expanded to the full paths. It's false
+// if text isn't a rename.
+func splitRename(text string) (string, string, bool) {
+	start := 0
+	if quoted, err := strconv.QuotedPrefix(text); err == nil && strings.HasPrefix(text, `"`) {
+		start = len(quoted)
+	}
+	pos := strings.Index(text[start:], " => ")
+	if pos == -1 {
+		return "", "", false
+	}
+	pos += start
+	oldPath, path := text[:pos], text[pos+4:]
+
+	// The braces are always around whole path segments; a path that needs
+	// quoting is never compacted
+	open, close := strings.LastIndex(oldPath, "{"), strings.Index(path, "}")
+	if start == 0 && open != -1 && close != -1 {
+		prefix, suffix := oldPath[:open], path[close+1:]
+		if (prefix == "" || strings.HasSuffix(prefix, "/")) && (suffix == "" || strings.HasPrefix(suffix, "/")) {
+			return joinRenamed(prefix, oldPath[open+1:], suffix), joinRenamed(prefix, path[:close], suffix), true
+		}
+	}
+	return vcs.GitUnquotePath(oldPath), vcs.GitUnquotePath(path), true
+}
+
+// joinRenamed puts together one side of a compacted rename. The part in
+// braces can be empty, for a file moved up or down a directory, and then
+// the suffix's "/" goes too.
+func joinRenamed(prefix, middle, suffix string) string {
+	if middle == "" {
+		return prefix + strings.TrimPrefix(suffix, "/")
+	}
+	return prefix + middle + suffix
+}
+
+// (*Commit).change returns the change to path, adding one if numstat didn't
+// list it.
+func (c *Commit) change(path string) *Change {
+	for i := len(c.changes) - 1; i >= 0; i-- {
+		if c.changes[i].path == path {
+			return &c.changes[i]
+		}
+	}
+	c.changes = append(c.changes, Change{path: path})
+	return &c.changes[len(c.changes)-1]
 }
 
 
@@ -272,54 +994,47 @@ func (db *VcsDb) GetRepoInfo() {
 	var roots []string
 	db.terminal.Force().Progressf("Fetch root commits...")
 	roots, elapsed = vcs.GitRootCommits(db.repoPath)
-	db.roots = roots
+	db.roots = nil
+	for _, root := range roots {
+		db.roots = append(db.roots, vcs.Hash(root))
+	}
 	db.rootsDirty = true
 	db.terminal.Printf("Found %d roots in %.2f sec", len(roots), elapsed)
 
 	// Get all the commits and their parents
 	var logs []string
 	db.terminal.Force().Progressf("Fetch commits...")
-	logs, elapsed = vcs.GitLogAll(db.repoPath, "|Commit| %H |Timestamp| %at |AuthorName| %aN |AuthorEmail| %aE |Parents| %P")
+	logs, elapsed = vcs.GitLogAll(db.repoPath, "%H%x1f%at%x1f%aN%x1f%aE%x1f%P")
 	db.terminal.Printf("Got %d commits in %.2f sec", len(logs), elapsed)
 
 	// Put all the commits in a graph
 	db.terminal.Force().Progressf("Make graph...")
 	startTime := gsos.HighresTime()
 
-	graph := make(map[string]Commit)
+	graph := make(map[vcs.Hash]Commit)
 	for _, L := range logs {
-		cPos := strings.Index(L, "|Commit| ")
-		tPos := strings.Index(L, "|Timestamp| ")
-		anPos := strings.Index(L, "|AuthorName| ")
-		aePos := strings.Index(L, "|AuthorEmail| ")
-		pPos := strings.Index(L, "|Parents| ")
-		if cPos == -1  || tPos == -1 || anPos == -1 || aePos == -1 || pPos == -1 {
-			db.terminal.Fatalf("Bad log: %s\n", L)
-		}
-		commitHash := L[cPos+9:tPos-1]
-		timestampS := L[tPos+12:anPos-1]
-		authorName := L[anPos+13:aePos-1]
-		authorEmail := L[aePos+14:pPos-1]
-		parentS := strings.TrimSpace(L[pPos+10:])
-		var parentHashes []string
-		if parentS == "" {
-			parentHashes = nil
-		} else {
-			parentHashes = strings.Split(L[pPos+10:], " ")
+		fields := strings.Split(L, vcs.LogFieldSep)
+		if len(fields) != 5 {
+			db.terminal.Fatalf("Bad log: %q\n", L)
 		}
+		commitHash := fields[0]
+		timestampS := fields[1]
+		authorName := fields[2]
+		authorEmail := fields[3]
+		parentHashes := vcs.ParseHashList(fields[4])
 
 		timestamp, err := strconv.Atoi(timestampS)
 		if err != nil {
-			db.terminal.Fatalf("Bad log (timestamp): %s\n", L)
+			db.terminal.Fatalf("Bad log (timestamp): %q\n", L)
 		}
 
-		commit := Commit{hash: commitHash, timestamp: timestamp, authorName: authorName, authorEmail: authorEmail, parents: parentHashes}
-		graph[commitHash] = commit
+		commit := Commit{hash: vcs.Hash(commitHash), timestamp: timestamp, authorName: authorName, authorEmail: authorEmail, parents: parentHashes}
+		graph[commit.hash] = commit
 	}
 
 	if SAVE_RAW_GRAPH {
 		// Save raw graph
-		rawgraph := make(map[string]Commit)
+		rawgraph := make(map[vcs.Hash]Commit)
 		for k, v := range graph {
 			rawgraph[k] = v
 		}
@@ -332,55 +1047,58 @@ func (db *VcsDb) GetRepoInfo() {
 	// graphTips is all the refs; every visible commit can be reached from
 	// one of these, and these also are what's "published". We'll use the ref names
 	// to decorate output.
-	var missingRefs []string
-	graphTips := make(map[string]string)
+	var missingRefs []vcs.Hash
+	graphTips := make(map[vcs.Hash]string)
 	for _, ref := range refs {
 
 		// Evidently not all the refs point to commits in the repo. Not sure
 		// how this is possible.
 		refname := ref.Refname
-		ref := string(ref.RefHash)
+		ref := ref.RefHash
 		if _, ok := graph[ref]; !ok {
-			db.terminal.Printf("%s missing: %s", ref, refname)
-			db.terminal.Force().Progressf("Make graph (2)...")
+			db.terminal.Warnf("ref %s missing from repo: %s", refname, ref)
 			missingRefs = append(missingRefs, ref)
 			continue
 		}
 		graphTips[ref] = refname
 	}
 	if len(missingRefs) > 0 {
-		db.terminal.Printf("%d refs missing from repo\n", len(missingRefs))
-		for _, ref := range missingRefs {
-			db.terminal.Printf("    %s\n", ref)
-		}
 		db.terminal.Force().Progressf("Make graph (2)...")
 	}
 
 	// Now visit all the refs one by one, to compute children (we only have parents
-	// at the moment)
-	var walkRefs []string
+	// at the moment). Each commit is walked at most once: visited is what has
+	// been walked, and enqueued is what is (or was) waiting in the worklist, so
+	// that a commit reached from many merges - e.g. a wide octopus - isn't queued
+	// again and again. That bounds the worklist by the number of commits.
+	walkRefs := make([]vcs.Hash, 0, len(graph))
+	enqueued := make(map[vcs.Hash]bool)
 	for ref, _ := range graphTips {
 		walkRefs = append(walkRefs, ref)
+		enqueued[ref] = true
 	}
 
 	// Repeat until we've followed every commit to the end
-	visited := make(map[string]bool)
+	visited := make(map[vcs.Hash]bool)
 	count := 2
-	for len(walkRefs) > 0 {
+	for next := 0; next < len(walkRefs); next++ {
 		count += 1
 		db.terminal.Progressf("Make graph (%d)...", count)
 
-		hash := walkRefs[0]
-		walkRefs = walkRefs[1:]
+		hash := walkRefs[next]
 
 		// Follow this commit to the end of the parent chain
-		for hash != "" {
+		for !visited[hash] {
+			visited[hash] = true
 
 			// Add hash as children of each parent of hash, but only once
 			commit := graph[hash]
 			for _, parentHash := range commit.parents {
 				if _, ok := graph[parentHash]; !ok {
-					db.terminal.Fatalf("wtf %s not in graph?", parentHash)
+					// A shallow clone's history stops short; this is its edge
+					commit.shallowBoundary = true
+					graph[hash] = commit
+					continue
 				}
 				parent := graph[parentHash]
 				var hasChild bool
@@ -395,24 +1113,19 @@ func (db *VcsDb) GetRepoInfo() {
 				}
 			}
 
-			// Now that we've done children, if we already visited this
-			// node, we're done
-			if visited[hash] {
-				break
-			}
-
-			visited[hash] = true
-
 			// If there are no parents to follow, we can stop
 			if len(commit.parents) == 0 {
 				break
 			}
 
-			// Now follow parents. If we have more than one parent, push
-			// the other parents onto the queue and walk them later
+			// Now follow parents. If we have more than one parent, queue
+			// the other parents and walk them later
 			hash = commit.parents[0]
 			for _, parent := range commit.parents[1:] {
-				walkRefs = append(walkRefs, parent)
+				if !visited[parent] && !enqueued[parent] {
+					walkRefs = append(walkRefs, parent)
+					enqueued[parent] = true
+				}
 			}
 		}
 	}
@@ -424,7 +1137,7 @@ func (db *VcsDb) GetRepoInfo() {
 	// Now go back and examine the graph tips. If any of them have
 	// children, they aren't really tips, so trim it down to refs
 	// that really are tips
-	var tips []string
+	var tips []vcs.Hash
 	for ref, _ := range graphTips {
 		commit := graph[ref]
 		if len(commit.children) == 0 {
@@ -441,7 +1154,7 @@ func (db *VcsDb) GetRepoInfo() {
 	if len(visited) != len(graph) {
 		for hash, _ := range graph {
 			if _, ok := visited[hash]; !ok {
-				db.terminal.Printf("Didn't visit %s\n", hash)
+				db.terminal.Warnf("didn't visit %s", hash)
 			}
 		}
 	}
@@ -0,0 +1,188 @@
+// vcsloc/loc/run_test.go
+
+package loc
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"vcsloc/gsos"
+	"vcsloc/vcs"
+)
+
+// header makes a commit header line from its fields (see vcs.VcsBackend's
+// LogIncremental).
+func header(fields ...string) string {
+	return vcs.LogRecordSep + strings.Join(fields, vcs.LogFieldSep)
+}
+
+// Names, emails and subjects are split on the separators only, so text that
+// looks like the old |Field| markers, pipes and angle brackets are kept as is.
+func TestParseCommitHeader(t *testing.T) {
+	const h1 = "1111111111111111111111111111111111111111"
+	const h2 = "2222222222222222222222222222222222222222"
+	const h3 = "3333333333333333333333333333333333333333"
+
+	tests := []struct {
+		line string
+		want Commit
+	}{
+		{
+			header(h1, "1700000000", "+0100", "Ann |Parents| Smith", "ann|AuthorName|@example.com",
+				"C|Committer|", "c@example.com", "1700000100", h2+" "+h3, "Fix |Subject| parsing"),
+			Commit{hash: vcs.Hash(h1), timestamp: 1700000000, tzOffset: 60,
+				authorName: "Ann |Parents| Smith", authorEmail: "ann|AuthorName|@example.com",
+				committerName: "C|Committer|", committerEmail: "c@example.com", committerTimestamp: 1700000100,
+				parents: []vcs.Hash{vcs.Hash(h2), vcs.Hash(h3)}, subject: "Fix |Subject| parsing"},
+		},
+		{
+			header(h1, "1700000000", "-0530", "<Bob> | <bob@example.com>", "<b|o|b>", "a|b", "<>", "0", "", "a | b | c"),
+			Commit{hash: vcs.Hash(h1), timestamp: 1700000000, tzOffset: -330,
+				authorName: "<Bob> | <bob@example.com>", authorEmail: "<b|o|b>",
+				committerName: "a|b", committerEmail: "<>", subject: "a | b | c"},
+		},
+		{
+			// No author, an empty committer and no subject or parents
+			header(h1, "0", "+0000", "", "", "", "", "0", "", ""),
+			Commit{hash: vcs.Hash(h1), authorName: unknownAuthorName, authorEmail: unknownAuthorEmail, noAuthor: true},
+		},
+		{
+			// Only the first nine separators split fields; the subject keeps the rest
+			header(h1, "5", "+0000", "|", "||", "|||", "||||", "6", h2, "x"+vcs.LogFieldSep+"y"),
+			Commit{hash: vcs.Hash(h1), timestamp: 5, authorName: "|", authorEmail: "||",
+				committerName: "|||", committerEmail: "||||", committerTimestamp: 6,
+				parents: []vcs.Hash{vcs.Hash(h2)}, subject: "x" + vcs.LogFieldSep + "y"},
+		},
+	}
+	for i, test := range tests {
+		var c Commit
+		if err := parseCommitHeader(test.line, &c); err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, test.want) {
+			t.Errorf("%d: got %+v\nwant %+v", i, c, test.want)
+		}
+	}
+
+	bad := []string{
+		header(h1, "1700000000", "+0100", "Ann", "ann@example.com"),
+		header(h1, "soon", "+0100", "Ann", "a", "C", "c", "0", "", "s"),
+		header(h1, "0", "+01", "Ann", "a", "C", "c", "0", "", "s"),
+		header(h1, "0", "+0100", "Ann", "a", "C", "c", "later", "", "s"),
+	}
+	for i, line := range bad {
+		var c Commit
+		if err := parseCommitHeader(line, &c); err == nil {
+			t.Errorf("bad %d: no error for %q", i, line)
+		}
+	}
+}
+
+// A header line is followed by the message body, up to the end marker, and
+// then the stats; body lines that look like stats aren't taken for them.
+func TestParseCommitLine(t *testing.T) {
+	const h1 = "1111111111111111111111111111111111111111"
+	work := NewAnalyzer(time.Now(), false, gsos.NewNullTerminal(), nil)
+
+	var c Commit
+	lines := []string{
+		header(h1, "1700000000", "+0000", "Pat |Parents| Lee", "pat@example.com", "Pat |Parents| Lee", "pat@example.com", "1700000000", "", "Subject"),
+		"1\t2\tnot/a/change",
+		"end" + vcs.LogBodyEnd,
+		"3\t4\tsrc/main.go",
+		" create mode 100644 src/main.go",
+	}
+	for _, line := range lines {
+		work.ParseCommitLine(line, &c)
+	}
+
+	if c.authorName != "Pat |Parents| Lee" || c.subject != "Subject" {
+		t.Errorf("header: got %q, %q", c.authorName, c.subject)
+	}
+	if want := "1\t2\tnot/a/change\nend"; c.body != want {
+		t.Errorf("body: got %q, want %q", c.body, want)
+	}
+	want := []Change{{path: "src/main.go", add: 3, remove: 4, create: true}}
+	if !reflect.DeepEqual(c.changes, want) {
+		t.Errorf("changes: got %+v, want %+v", c.changes, want)
+	}
+}
+
+// benchRepo makes a repo with vcs.GenerateGitRepo, for benchmarks.
+func benchRepo(b *testing.B, opts vcs.GenOpts) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		b.Skip("no git")
+	}
+	dir := b.TempDir()
+	if err := vcs.GenerateGitRepo(dir, opts); err != nil {
+		b.Fatal(err)
+	}
+	return dir
+}
+
+// benchAnalyzer makes an analyzer for repo with an in-memory database.
+func benchAnalyzer(b *testing.B, repo string) *Analyzer {
+	db, err := NewMemDb(repo, "git")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return NewAnalyzer(time.Now(), false, gsos.NewNullTerminal(), db)
+}
+
+// The fetches report their own rates, which leave out starting up.
+func BenchmarkFetchAllCommitHashes(b *testing.B) {
+	work := benchAnalyzer(b, benchRepo(b, vcs.GenOpts{Commits: 5000, Branches: 8, MergeEvery: 10}))
+	work.UpdateRepo()
+	b.ResetTimer()
+
+	var hashes int
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		h, d := work.FetchAllCommitHashes()
+		hashes += len(h)
+		elapsed += d
+	}
+	b.ReportMetric(float64(hashes)/elapsed.Seconds(), "hashes/s")
+}
+
+func BenchmarkFetchMissingCommits(b *testing.B) {
+	work := benchAnalyzer(b, benchRepo(b, vcs.GenOpts{Commits: 2000, Branches: 8, MergeEvery: 10}))
+	work.UpdateRepo()
+	total := len(work.db.commits.hashes)
+	b.ResetTimer()
+
+	var commits int
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		n, d := work.FetchMissingCommits(nil, total)
+		commits += n
+		elapsed += d
+	}
+	b.ReportMetric(float64(commits)/elapsed.Seconds(), "commits/s")
+}
+
+// UpdateRepo from an empty database, on a deep history and on a wide one
+// with octopus merges.
+func BenchmarkUpdateRepoDeep(b *testing.B) {
+	benchmarkUpdateRepo(b, vcs.GenOpts{Commits: 5000})
+}
+
+func BenchmarkUpdateRepoWide(b *testing.B) {
+	benchmarkUpdateRepo(b, vcs.GenOpts{Commits: 2000, Branches: 32, MergeEvery: 4, Octopus: 8})
+}
+
+func benchmarkUpdateRepo(b *testing.B, opts vcs.GenOpts) {
+	repo := benchRepo(b, opts)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		work := benchAnalyzer(b, repo)
+		work.UpdateRepo()
+		if n := len(work.db.commits.commits); n != opts.Commits {
+			b.Fatalf("got %d commits, wanted %d", n, opts.Commits)
+		}
+	}
+}
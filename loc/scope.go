@@ -0,0 +1,149 @@
+// vcsloc/loc/scope.go
+
+package loc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"vcsloc/vcs"
+)
+
+// Scope is the part of the repo history being analyzed. The zero Scope
+// is the whole history of every ref. The scope a database was built with
+// is recorded in its header, and analyzing with a different scope causes
+// a re-fetch rather than mixing data from both.
+type Scope struct {
+	// Range limits history to a commit range instead of all refs. "A..B"
+	// is the commits reachable from B but not from A, as in git. The
+	// open-ended forms are relative to all refs rather than HEAD: "A.." is
+	// every commit not reachable from A, and "..B" is every commit reachable
+	// from B. Commits whose parents fall outside the range are boundaries of
+	// the sub-graph; those parents are kept in the commit data but aren't
+	// in the database.
+	Range string
+
+	// Refs limits history to what these refs lead to, instead of every
+	// ref, like "git log <refs>": just a release branch and its ancestry,
+	// say, in a repo full of stale branches. They're named as the vcs
+	// takes them ("refs/heads/release-5.x" or "release-5.x" for git). With
+	// a Range, it has to be the "A.." form, which is then relative to these
+	// refs.
+	Refs []string
+
+	// Since and Until limit history to commits in a date window, like
+	// "git log --since/--until". They can be RFC3339 times or anything
+	// git's approxidate understands ("2 weeks ago"). As with a range,
+	// parents from outside the window aren't in the database.
+	Since string
+	Until string
+
+	// Paths limits history to commits touching these paths, like
+	// "git log -- <paths>". History is simplified the way git does it
+	// with parent rewriting: a commit's parents are its nearest ancestors
+	// that also touch the paths, so the graph stays connected even though
+	// the commits in between are left out.
+	Paths []string
+
+	// FirstParent limits history to the first-parent chains of the refs,
+	// like "git log --first-parent": the mainline, without the commits that
+	// merges brought in. Each commit keeps only its first parent, so a merge
+	// becomes one more commit on the chain. Use it with SetFirstParentStats,
+	// so that merges get the changes they made to the mainline.
+	FirstParent bool
+}
+
+// IsWhole is true if the scope is the whole history.
+func (s Scope) IsWhole() bool {
+	return s.Range == "" && len(s.Refs) == 0 && s.Since == "" && s.Until == "" && len(s.Paths) == 0 && !s.FirstParent
+}
+
+// IsEmptyWindow is true if Since and Until are both explicit dates and
+// the window between them is empty, so no commits are in scope. (Dates that
+// only git understands can't be checked here, but git itself then returns
+// no commits for an empty window.)
+func (s Scope) IsEmptyWindow() bool {
+	if s.Since == "" || s.Until == "" {
+		return false
+	}
+	since, err1 := parseScopeDate(s.Since)
+	until, err2 := parseScopeDate(s.Until)
+	return err1 == nil && err2 == nil && !since.Before(until)
+}
+
+// parseScopeDate parses an RFC3339 time or a plain date (as UTC).
+func parseScopeDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// Validate checks that the range is one of the forms we understand, and
+// doesn't say where history ends when the refs do.
+func (s Scope) Validate() error {
+	if s.Range == "" {
+		return nil
+	}
+	pos := strings.Index(s.Range, "..")
+	if pos == -1 || s.Range == ".." || strings.Contains(s.Range, "...") ||
+		strings.Contains(s.Range[pos+2:], "..") {
+		return fmt.Errorf("bad range '%s': want A..B, A.. or ..B", s.Range)
+	}
+	if len(s.Refs) > 0 && !strings.HasSuffix(s.Range, "..") {
+		return fmt.Errorf("range '%s' can't be used with refs, which are where history ends; use A..", s.Range)
+	}
+	return nil
+}
+
+// Equal compares two scopes.
+func (s Scope) Equal(o Scope) bool {
+	if s.Range != o.Range || s.Since != o.Since || s.Until != o.Until || len(s.Paths) != len(o.Paths) ||
+		s.FirstParent != o.FirstParent || len(s.Refs) != len(o.Refs) {
+		return false
+	}
+	for i := range s.Refs {
+		if s.Refs[i] != o.Refs[i] {
+			return false
+		}
+	}
+	for i := range s.Paths {
+		if s.Paths[i] != o.Paths[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the scope for status output.
+func (s Scope) String() string {
+	if s.IsWhole() {
+		return "entire history"
+	}
+	var parts []string
+	if s.Range != "" {
+		parts = append(parts, fmt.Sprintf("range %s", s.Range))
+	}
+	if len(s.Refs) > 0 {
+		parts = append(parts, fmt.Sprintf("refs %s", strings.Join(s.Refs, " ")))
+	}
+	if s.Since != "" {
+		parts = append(parts, fmt.Sprintf("since %s", s.Since))
+	}
+	if s.Until != "" {
+		parts = append(parts, fmt.Sprintf("until %s", s.Until))
+	}
+	if len(s.Paths) > 0 {
+		parts = append(parts, fmt.Sprintf("paths %s", strings.Join(s.Paths, " ")))
+	}
+	if s.FirstParent {
+		parts = append(parts, "first parents")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// revSpec returns the scope as a revision selection for a VcsBackend.
+func (s Scope) revSpec() vcs.RevSpec {
+	return vcs.RevSpec{Range: s.Range, Refs: s.Refs, Since: s.Since, Until: s.Until, Paths: s.Paths, FirstParent: s.FirstParent}
+}
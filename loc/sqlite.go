@@ -0,0 +1,84 @@
+// vcsloc/loc/sqlite.go
+
+// +build sqlite
+
+package loc
+
+import (
+	"database/sql"
+
+	_ "modernc.org/sqlite" // pure Go, so no cgo
+)
+
+// sqliteSchema is dropped and recreated on every export, so exporting again
+// replaces what was there.
+var sqliteSchema = []string{
+	"DROP TABLE IF EXISTS commits",
+	"DROP TABLE IF EXISTS edges",
+	"DROP TABLE IF EXISTS refs",
+	"CREATE TABLE commits (hash TEXT PRIMARY KEY, timestamp INTEGER, author_name TEXT, author_email TEXT)",
+	"CREATE TABLE edges (child TEXT NOT NULL, parent TEXT NOT NULL)",
+	"CREATE TABLE refs (hash TEXT NOT NULL, name TEXT PRIMARY KEY)",
+	"CREATE INDEX edges_child ON edges (child)",
+	"CREATE INDEX edges_parent ON edges (parent)",
+	"CREATE INDEX refs_hash ON refs (hash)",
+}
+
+// ExportSQLite writes the commits, their parent edges and the refs to an
+// SQLite database at path, for ad-hoc queries. The tables are recreated each
+// time. This needs a build with "-tags sqlite".
+func (db *VcsDb2) ExportSQLite(path string) error {
+	if err := db.refs.Load(db); err != nil {
+		return err
+	}
+
+	sqldb, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer sqldb.Close()
+
+	// One transaction, so a failed export leaves the old tables alone
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range sqliteSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	commitStmt, err := tx.Prepare("INSERT INTO commits (hash, timestamp, author_name, author_email) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	edgeStmt, err := tx.Prepare("INSERT INTO edges (child, parent) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	err = db.commits.ScanCommits(db, func(c *Commit) error {
+		if _, err := commitStmt.Exec(string(c.hash), c.timestamp, c.authorName, c.authorEmail); err != nil {
+			return err
+		}
+		for _, parent := range c.parents {
+			if _, err := edgeStmt.Exec(string(c.hash), string(parent)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range db.refs.refs {
+		if _, err := tx.Exec("INSERT INTO refs (hash, name) VALUES (?, ?)", string(ref.RefHash), ref.Refname); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
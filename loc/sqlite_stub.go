@@ -0,0 +1,11 @@
+// vcsloc/loc/sqlite_stub.go
+
+// +build !sqlite
+
+package loc
+
+// ExportSQLite needs a build with "-tags sqlite"; without it, it always
+// returns ErrNoSQLite.
+func (db *VcsDb2) ExportSQLite(path string) error {
+	return ErrNoSQLite
+}
@@ -0,0 +1,184 @@
+// vcsloc/loc/store.go
+
+package loc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store holds the named data files of a database. FileStore keeps them in a
+// directory on disk; MemStore keeps them in memory, for tests and for one-off
+// runs that don't need to keep anything.
+type Store interface {
+	// Reader opens a data file. A file that isn't there gives an error that
+	// os.IsNotExist recognizes.
+	Reader(name string) (io.ReadCloser, error)
+
+	// Writer starts a new version of a data file. It replaces the old one
+	// when the writer is closed, so a save that fails part way (the writer
+	// is aborted) leaves the old file intact.
+	Writer(name string) (io.WriteCloser, error)
+
+	// Remove removes a data file. It's not an error if there isn't one.
+	Remove(name string) error
+}
+
+// storeWriter is a Writer that can be dropped without replacing its file.
+// Writers from both FileStore and MemStore are storeWriters.
+type storeWriter interface {
+	io.WriteCloser
+	Abort()
+}
+
+// storePath names a data file (or the store, for "") in messages: its path
+// for a FileStore.
+func storePath(store Store, name string) string {
+	if fs, ok := store.(*FileStore); ok {
+		return filepath.Join(fs.dir, name)
+	}
+	if name == "" {
+		return "(memory)"
+	}
+	return "(memory)/" + name
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// FileStore keeps the data files in a directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Dir is the directory holding the data files.
+func (fs *FileStore) Dir() string {
+	return fs.dir
+}
+
+// Reader opens the data file. The file is an *os.File, so it can also be
+// read at random with ReadAt.
+func (fs *FileStore) Reader(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.dir, name))
+}
+
+// Writer writes to "<name>.tmp", which is synced and renamed over the file
+// on Close, so an interrupted save leaves the old file intact rather than a
+// truncated one.
+func (fs *FileStore) Writer(name string) (io.WriteCloser, error) {
+	path := filepath.Join(fs.dir, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{f: f, path: path}, nil
+}
+
+func (fs *FileStore) Remove(name string) error {
+	err := os.Remove(filepath.Join(fs.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type fileWriter struct {
+	f *os.File
+	path string
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	return fw.f.Write(p)
+}
+
+func (fw *fileWriter) Close() error {
+	err := fw.f.Sync()
+	if cerr := fw.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fw.f.Name(), fw.path)
+	}
+	if err != nil {
+		os.Remove(fw.f.Name())
+	}
+	return err
+}
+
+func (fw *fileWriter) Abort() {
+	fw.f.Close()
+	os.Remove(fw.f.Name())
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// MemStore keeps the data files in memory; they're gone when it is. It's
+// safe for concurrent use.
+type MemStore struct {
+	mu sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{files: make(map[string][]byte)}
+}
+
+// Reader reads a copy of the file as it was when it was opened. The reader
+// also has ReadAt, like a file from a FileStore.
+func (ms *MemStore) Reader(name string) (io.ReadCloser, error) {
+	ms.mu.Lock()
+	data, ok := ms.files[name]
+	ms.mu.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return memReader{bytes.NewReader(data)}, nil
+}
+
+func (ms *MemStore) Writer(name string) (io.WriteCloser, error) {
+	return &memWriter{store: ms, name: name}, nil
+}
+
+func (ms *MemStore) Remove(name string) error {
+	ms.mu.Lock()
+	delete(ms.files, name)
+	ms.mu.Unlock()
+	return nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	store *MemStore
+	name string
+	buf bytes.Buffer
+}
+
+func (mw *memWriter) Write(p []byte) (int, error) {
+	return mw.buf.Write(p)
+}
+
+// Close stores the data. Readers already open keep the old data, since a
+// stored file is never changed in place.
+func (mw *memWriter) Close() error {
+	mw.store.mu.Lock()
+	mw.store.files[mw.name] = mw.buf.Bytes()
+	mw.store.mu.Unlock()
+	return nil
+}
+
+func (mw *memWriter) Abort() {
+	mw.buf.Reset()
+}
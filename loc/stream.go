@@ -0,0 +1,169 @@
+// vcsloc/loc/stream.go
+
+package loc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// commitStatRecord is one commit and its file changes in the stat stream.
+type commitStatRecord struct {
+	Commit string `json:"commit"`
+	Parents []string `json:"parents"`
+	Timestamp int `json:"timestamp"`
+	Author string `json:"author"`
+	Committer string `json:"committer"`
+	CommitTimestamp int `json:"commitTimestamp"`
+	Changes []commitStatChange `json:"changes"`
+}
+
+// commitStatChange is one file change of a commitStatRecord.
+type commitStatChange struct {
+	Path string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+	Add int `json:"add"`
+	Remove int `json:"remove"`
+	Binary bool `json:"binary"`
+	Change string `json:"change"`
+}
+
+// StatStream writes each commit's change stats as JSON Lines as soon as the
+// commit has been read, so that a consumer can start before the fetch is done.
+// The first write error stops the stream; it's returned by Err.
+type StatStream struct {
+	enc *json.Encoder
+	count int
+	err error
+}
+
+// NewStatStream creates a StatStream writing to w.
+func NewStatStream(w io.Writer) *StatStream {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &StatStream{enc: enc}
+}
+
+// Write writes one commit to the stream.
+func (s *StatStream) Write(c *Commit) {
+	if s.err != nil {
+		return
+	}
+
+	rec := commitStatRecord{
+		Commit: string(c.hash),
+		Parents: make([]string, len(c.parents)),
+		Timestamp: c.timestamp,
+		Author: fmt.Sprintf("%s <%s>", c.authorName, c.authorEmail),
+		Committer: fmt.Sprintf("%s <%s>", c.committerName, c.committerEmail),
+		CommitTimestamp: c.committerTimestamp,
+		Changes: make([]commitStatChange, len(c.changes)),
+	}
+	for i, parent := range c.parents {
+		rec.Parents[i] = string(parent)
+	}
+	for i := range c.changes {
+		ch := &c.changes[i]
+		rec.Changes[i] = commitStatChange{
+			Path: ch.path,
+			OldPath: ch.oldPath,
+			Add: ch.add,
+			Remove: ch.remove,
+			Binary: ch.binary,
+			Change: ch.kind(),
+		}
+	}
+
+	s.err = s.enc.Encode(&rec)
+	if s.err == nil {
+		s.count += 1
+	}
+}
+
+// Count is the number of commits written.
+func (s *StatStream) Count() int {
+	return s.count
+}
+
+// Err is the error that stopped the stream, if any.
+func (s *StatStream) Err() error {
+	return s.err
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// SetStatStream streams each commit's change stats to w as JSON Lines while
+// the commits are fetched. Only commits fetched in this run are written, so
+// nothing is written if the database is already up to date.
+func (work *Analyzer) SetStatStream(w io.Writer) {
+	work.statStream = NewStatStream(w)
+}
+
+// SetCommitStream streams each commit to w as JSON Lines as soon as it's been
+// read from the log, in the same form as the stat stream, while the commits
+// are fetched and saved as usual. Unlike the stat stream, every commit is
+// written, with its changes if they're read with it; with FirstParentStats,
+// they're read afterwards, so the commits go without them.
+func (work *Analyzer) SetCommitStream(w io.Writer) {
+	work.commitStream = NewStatStream(w)
+}
+
+// SetStoreStats controls whether change stats are kept in the database (the
+// default). Streaming without storing keeps memory use bounded, since each
+// commit's changes are dropped once they're written.
+func (work *Analyzer) SetStoreStats(store bool) {
+	work.storeStats = store
+}
+
+// finishCommit is called once a commit has been read from the log; withStats
+// if its stats were read along with it, and are complete too.
+func (work *Analyzer) finishCommit(c *Commit, withStats bool) {
+	if withStats {
+		work.streamCommitStats(c)
+	}
+	if work.commitStream != nil {
+		work.commitStream.Write(c)
+	}
+	if withStats && !work.storeStats {
+		c.changes = nil
+	}
+}
+
+// finishCommitStats is called once a commit's stats are complete.
+func (work *Analyzer) finishCommitStats(c *Commit) {
+	work.streamCommitStats(c)
+	if !work.storeStats {
+		c.changes = nil
+	}
+}
+
+// streamCommitStats filters a commit's finished stats, and streams them.
+func (work *Analyzer) streamCommitStats(c *Commit) {
+	c.changes = work.exclude.filterChanges(c.changes)
+	if work.statStream != nil {
+		work.statStream.Write(c)
+	}
+}
+
+// finishStatStream reports on the stream at the end of a fetch.
+func (work *Analyzer) finishStatStream() {
+	if work.statStream == nil {
+		return
+	}
+	if err := work.statStream.Err(); err != nil {
+		work.terminal.Fatalf("Could not write stat stream: %s\n", err)
+	}
+	work.terminal.Printf("Streamed stats for %d commits\n", work.statStream.Count())
+}
+
+// finishCommitStream reports on the commit stream at the end of a fetch.
+func (work *Analyzer) finishCommitStream() {
+	if work.commitStream == nil {
+		return
+	}
+	if err := work.commitStream.Err(); err != nil {
+		work.terminal.Fatalf("Could not write commit stream: %s\n", err)
+	}
+	work.terminal.Printf("Emitted %d commits\n", work.commitStream.Count())
+}
@@ -0,0 +1,29 @@
+// vcsloc/loc/submodules.go
+
+package loc
+
+import (
+	"path/filepath"
+)
+
+// A superproject's submodules are analyzed into databases of their own,
+// under the superproject's in "submodules/<path>", and its header lists them.
+
+// SubmoduleDbPath is where the database of the submodule at path (relative
+// to the repo) goes, under the database directory dbPath.
+func SubmoduleDbPath(dbPath string, path string) string {
+	return filepath.Join(dbPath, "submodules", filepath.FromSlash(path))
+}
+
+// Submodules returns the paths of the submodules that have databases under
+// this one, as recorded by SetSubmodules.
+func (db *VcsDb2) Submodules() []string {
+	return db.hdr.submodules
+}
+
+// SetSubmodules records the submodules that have databases under this one
+// (see SubmoduleDbPath) in the header.
+func (db *VcsDb2) SetSubmodules(paths []string) error {
+	db.hdr.submodules = paths
+	return db.hdr.Save(db)
+}
@@ -0,0 +1,88 @@
+// vcsloc/loc/timeseries.go
+
+package loc
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Bucket is the commits in one period of a time series.
+type Bucket struct {
+	Start time.Time // start of the period, in UTC
+	Count int
+}
+
+// bucketStart returns the start of the period of kind bucket ("week", an
+// ISO week starting on Monday, or "month") that t is in, in UTC.
+func bucketStart(bucket string, t time.Time) (time.Time, error) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bucket {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7), nil
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day()), nil
+	}
+	return time.Time{}, fmt.Errorf("bad bucket '%s': want week or month", bucket)
+}
+
+// nextBucket returns the start of the period after the one starting at start.
+func nextBucket(bucket string, start time.Time) time.Time {
+	if bucket == "month" {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 7)
+}
+
+// CommitTimeSeries counts the commits in each week or month (bucket is
+// "week" or "month") by author time, in UTC, from the oldest commit's period
+// to the newest's. Periods without commits are there with a count of 0, so
+// the series has no gaps. It's empty if there are no commits.
+func (db *VcsDb2) CommitTimeSeries(bucket string) ([]Bucket, error) {
+	if _, err := bucketStart(bucket, time.Time{}); err != nil {
+		return nil, err
+	}
+	counts := make(map[time.Time]int)
+	var first, last time.Time
+	err := db.commits.ScanCommits(db, func(c *Commit) error {
+		start, _ := bucketStart(bucket, time.Unix(int64(c.timestamp), 0))
+		if len(counts) == 0 || start.Before(first) {
+			first = start
+		}
+		if len(counts) == 0 || start.After(last) {
+			last = start
+		}
+		counts[start] += 1
+		return nil
+	})
+	if err != nil || len(counts) == 0 {
+		return nil, err
+	}
+
+	var series []Bucket
+	for start := first; !start.After(last); start = nextBucket(bucket, start) {
+		series = append(series, Bucket{Start: start, Count: counts[start]})
+	}
+	return series, nil
+}
+
+// WriteTimeSeriesCSV writes the commit time series (see CommitTimeSeries) as
+// CSV: a "start,commits" header, then a line for each period, with its start
+// as YYYY-MM-DD.
+func (db *VcsDb2) WriteTimeSeriesCSV(w io.Writer, bucket string) error {
+	series, err := db.CommitTimeSeries(bucket)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "start,commits\n"); err != nil {
+		return err
+	}
+	for _, b := range series {
+		if _, err := fmt.Fprintf(w, "%s,%d\n", b.Start.Format("2006-01-02"), b.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
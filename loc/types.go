@@ -2,23 +2,54 @@
 
 package loc
 
+import (
+	"time"
+
+	"vcsloc/vcs"
+)
+
 type Commit struct {
 
 	// fetched from repo
-	hash string // should be vcs.Hash
+	hash vcs.Hash
 	date string
 	timestamp int
+	tzOffset int // the author's timezone, in minutes east of UTC
 	authorName string
 	authorEmail string
-	parents []string // should be []vcs.Hash
+	committerName string // who made the commit: the author, or whoever applied, cherry-picked or rebased it
+	committerEmail string
+	committerTimestamp int
+	parents []vcs.Hash
+	subject string
+	body string // the commit message after the subject
+	changes []Change
 
 	// computed
-	children []string // should be []vcs.Hash
+	children []vcs.Hash
+	rawAuthorName string // author before the mailmap, if it changed it
+	rawAuthorEmail string
+	rawCommitterName string // committer before the mailmap, if it changed it
+	rawCommitterEmail string
+	shallowBoundary bool // at the edge of a shallow clone: its parents weren't fetched
+	noAuthor bool // logged without an author name or email; see markNoAuthor
+}
+
+// AuthorTime is when the commit was authored, in the author's timezone, so
+// that e.g. the hour of day is the author's own.
+func (c *Commit) AuthorTime() time.Time {
+	return time.Unix(int64(c.timestamp), 0).In(time.FixedZone("", c.tzOffset*60))
+}
+
+// CommitterTime is when the commit was made, in UTC; only the author's
+// timezone is kept.
+func (c *Commit) CommitterTime() time.Time {
+	return time.Unix(int64(c.committerTimestamp), 0).UTC()
 }
 
 // NonmergeStat is the list of changes for a non-merge commit
 type NonmergeStat struct {
-	parent string // should be vcs.Hash
+	parent vcs.Hash
 	changes []Change
 }
 
@@ -33,3 +64,18 @@ type Change struct {
 	rename bool
 	oldPath string
 }
+
+// kind names the type of change: add, delete, rename, copy or modify.
+func (ch *Change) kind() string {
+	switch {
+	case ch.rename:
+		return "rename"
+	case ch.create && ch.oldPath != "":
+		return "copy"
+	case ch.create:
+		return "add"
+	case ch.delete:
+		return "delete"
+	}
+	return "modify"
+}
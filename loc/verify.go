@@ -0,0 +1,147 @@
+// vcsloc/loc/verify.go
+
+package loc
+
+import (
+	"fmt"
+
+	"vcsloc/vcs"
+)
+
+// Verify loads every part of the database and cross-checks them, returning
+// a description of each problem found; none means the database is sound.
+// It checks that
+//   - every component loads
+//   - the commit hashes and commits match, one for one and in order
+//   - every parent is a known commit (for a database of the whole history;
+//     ranges and windows have parents outside them)
+//   - the refs signature and commit count in the info match
+//   - the graph, the binary graph file and roots agree with the commits
+// A database whose last update was interrupted is reported as well.
+func (db *VcsDb2) Verify() []string {
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	load := func(what string, err error) bool {
+		if err != nil {
+			report("%s: %s", what, err)
+			return false
+		}
+		return true
+	}
+
+	infoOk := load("info", db.info.Load(db))
+	refsOk := load("refs", db.refs.Load(db))
+
+	commits := db.commits
+	commits.err = nil
+	baseOk := load("commits", commits.LoadBase(db).err)
+	commits.err = nil
+	hashesOk := baseOk && load("commit hashes", commits.LoadHashes(db).err)
+	commits.err = nil
+	commitsOk := baseOk && load("commit data", commits.LoadCommits(db).err)
+	commits.err = nil
+
+	if infoOk && !db.info.graphUpToDate && db.info.numRepoCommits > 0 {
+		report("info: the last update didn't finish; run analyze again")
+	}
+
+	if infoOk && refsOk {
+		signature := db.refs.Signature()
+		switch db.info.refsSignature {
+		case signature:
+		case "":
+			report("info: no refs signature (the database predates it; analyze will add it)")
+		default:
+			report("refs: signature is %s, but info has %s", signature, db.info.refsSignature)
+		}
+	}
+
+	if infoOk && hashesOk && db.info.numRepoCommits != len(commits.hashes) {
+		report("info: %d commits, but there are %d commit hashes", db.info.numRepoCommits, len(commits.hashes))
+	}
+
+	known := make(map[vcs.Hash]bool, len(commits.commits))
+	if commitsOk {
+		for i := range commits.commits {
+			hash := commits.commits[i].hash
+			if known[hash] {
+				report("commits: %s is there more than once", hash)
+			}
+			known[hash] = true
+		}
+	}
+
+	if hashesOk && commitsOk {
+		if len(commits.hashes) != len(commits.commits) {
+			report("commits: %d hashes but %d commits", len(commits.hashes), len(commits.commits))
+		}
+		inHashes := make(map[vcs.Hash]bool, len(commits.hashes))
+		inOrder := true
+		for i, hash := range commits.hashes {
+			inHashes[hash] = true
+			if !known[hash] {
+				report("commits: no commit for hash %d %s", i, hash)
+			} else if inOrder && i < len(commits.commits) && commits.commits[i].hash != hash {
+				// Once they're out of step, everything after is too
+				report("commits: commit %d is %s, but hash %d is %s", i, commits.commits[i].hash, i, hash)
+				inOrder = false
+			}
+		}
+		for i := range commits.commits {
+			if !inHashes[commits.commits[i].hash] {
+				report("commits: commit %s isn't in the hashes", commits.commits[i].hash)
+			}
+		}
+	}
+
+	if commitsOk && db.hdr.scope.IsWhole() {
+		for i := range commits.commits {
+			if commits.commits[i].shallowBoundary {
+				continue
+			}
+			for _, parent := range commits.commits[i].parents {
+				if !known[parent] {
+					report("commits: parent %s of %s isn't a known commit", parent, commits.commits[i].hash)
+				}
+			}
+		}
+	}
+
+	// The text graph is checked; Load would read the binary graph file
+	// instead when it can, which is checked below
+	if load("graph", db.graph.loadText(db)) && commitsOk && len(db.graph.graph) > 0 {
+		if len(db.graph.graph) != len(known) {
+			report("graph: %d commits, but there are %d commits", len(db.graph.graph), len(known))
+		}
+		for hash := range db.graph.graph {
+			if !known[hash] {
+				report("graph: %s isn't a known commit", hash)
+			}
+		}
+	}
+
+	if g, err := db.OpenGraphFile(); err == nil {
+		hashes, _, err := g.ReadAll()
+		g.Close()
+		if load("graph.bin", err) && commitsOk && len(hashes) != len(known) {
+			report("graph.bin: %d commits, but there are %d commits", len(hashes), len(known))
+		}
+		for _, hash := range hashes {
+			if commitsOk && !known[hash] {
+				report("graph.bin: %s isn't a known commit", hash)
+			}
+		}
+	}
+
+	if load("roots", db.roots.Load(db)) && commitsOk && len(db.roots.roots) > 0 {
+		for _, hash := range db.roots.roots {
+			if !known[hash] {
+				report("roots: %s isn't a known commit", hash)
+			}
+		}
+	}
+
+	return problems
+}
@@ -8,26 +8,838 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
+	"vcsloc/gsos"
 	"vcsloc/loc"
+	"vcsloc/vcs"
 )
 
 func main() {
-	cmd := &Command{args: os.Args[1:]}
+	cmd := &Command{args: os.Args[1:], Interval: 30*time.Second, ProgressInterval: 100*time.Millisecond, Top: 20, MaxObjects: 5000000, AbbrevLen: loc.DefaultAbbrevLen, Bucket: "week"}
 	cmd.StartTime = time.Now()
-	cmd.parse().Run()
+	cmd.parse()
+	vcs.SetGitBinary(cmd.GitBinary)
+	vcs.SetGitArgs(cmd.GitArgs)
+	loc.SetAbbrevLen(cmd.AbbrevLen)
+
+	stopProfiling := cmd.StartProfiling()
+	cmd.openOutput()
+	cmd.Run()
+	cmd.closeOutput()
+	stopProfiling()
+	if cmd.status != 0 {
+		os.Exit(cmd.status)
+	}
+}
+
+// openOutput opens the file reports are written to, --output, or stdout.
+// Progress and messages are kept apart from it, on the terminal (stderr),
+// so the file only has the report in it.
+func (cmd *Command) openOutput() {
+	cmd.out = os.Stdout
+	if cmd.Output == "" {
+		return
+	}
+	f, err := os.Create(cmd.Output)
+	if err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	cmd.out = f
+}
+
+// closeOutput closes the --output file; an error writing it is only
+// certain to show up here.
+func (cmd *Command) closeOutput() {
+	if cmd.out == os.Stdout {
+		return
+	}
+	if err := cmd.out.Close(); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
 }
 
+// StartProfiling starts the CPU profile if requested, and returns a function
+// that stops it and writes the memory profile. The stop function is also run
+// if the program exits through gsos.Fatalf, so profiles of failed runs are
+// still written.
+func (cmd *Command) StartProfiling() func() {
+	var cpuFile *os.File
+	if cmd.CpuProfile != "" {
+		var err error
+		if cpuFile, err = os.Create(cmd.CpuProfile); err != nil {
+			gsos.Fatalf("Could not create CPU profile: %s\n", err)
+		}
+		if err = pprof.StartCPUProfile(cpuFile); err != nil {
+			gsos.Fatalf("Could not start CPU profile: %s\n", err)
+		}
+	}
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+			if cmd.MemProfile != "" {
+				f, err := os.Create(cmd.MemProfile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Could not create memory profile: %s\n", err)
+					return
+				}
+				defer f.Close()
+				runtime.GC() // get up-to-date statistics
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					fmt.Fprintf(os.Stderr, "Could not write memory profile: %s\n", err)
+				}
+			}
+		})
+	}
+	gsos.OnFatal(stop)
+	return stop
+}
+
+// commandNames is the verbs shown in usage; analyze is the default.
+var commandNames = []string{"analyze", "watch", "grep <pattern>", "log", "authors", "changes", "merges", "empty", "count [ref]", "roots", "dangling", "components", "verify", "sqlite <file>", "churn", "binary", "stats", "timeseries", "domains", "dot [ref]", "rawlog [file]"}
+
+// Run dispatches on the verb; no verb means "analyze".
 func (cmd *Command) Run() {
-	db := loc.OpenDb(cmd.Db, cmd.Repo, cmd.Vcs)
-	analyzer := loc.NewAnalyzer(cmd.StartTime, cmd.Verbose, db)
+	defer cmd.closeDbs()
+	if cmd.MergeBase != "" {
+		cmd.RunMergeBase()
+		return
+	}
+
+	switch cmd.Verb {
+	case "", "analyze":
+		cmd.RunAnalyze()
+	case "watch":
+		cmd.RunWatch()
+	case "grep":
+		cmd.RunGrep()
+	case "log":
+		cmd.RunLog()
+	case "authors":
+		cmd.RunAuthors()
+	case "changes":
+		cmd.RunChanges()
+	case "merges":
+		cmd.RunMerges()
+	case "empty":
+		cmd.RunEmpty()
+	case "count":
+		cmd.RunCount()
+	case "roots":
+		cmd.RunRoots()
+	case "dangling":
+		cmd.RunDangling()
+	case "components":
+		cmd.RunComponents()
+	case "verify":
+		cmd.RunVerify()
+	case "sqlite":
+		cmd.RunSQLite()
+	case "churn":
+		cmd.RunChurn()
+	case "binary":
+		cmd.RunBinary()
+	case "stats":
+		cmd.RunStats()
+	case "timeseries":
+		cmd.RunTimeSeries()
+	case "domains":
+		cmd.RunDomains()
+	case "dot":
+		cmd.RunDot()
+	case "rawlog":
+		cmd.RunRawLog()
+	default:
+		fmt.Printf("unknown command: '%s'\n", cmd.Verb)
+		cmd.Usage(1)
+	}
+}
+
+// RunAnalyze brings the database up to date with the repo, or builds it
+// from a fast-export stream or a raw log if one was given.
+func (cmd *Command) RunAnalyze() {
+	if cmd.FromFastExport != "" {
+		cmd.RunImportFastExport()
+		return
+	}
+	if cmd.FromRawLog != "" {
+		cmd.RunImportRawLog()
+		return
+	}
+
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	catchInterrupt()
 	analyzer.Run()
-	db.Save()
+	saveDb(db)
+	if cmd.RecurseSubmodules {
+		cmd.eachSubmodule(db, func(path string, analyzer *loc.Analyzer) {
+			analyzer.Run()
+		})
+	}
+	cmd.stopIfInterrupted()
+}
+
+// eachSubmodule brings the database of each checked-out submodule of db's
+// repo up to date with fn (see loc.SubmoduleDbPath), and records them in
+// db's header. The submodules get the options from the command line, but
+// not --range, --ref or --path, which are about the superproject's history.
+func (cmd *Command) eachSubmodule(db *loc.VcsDb2, fn func(path string, analyzer *loc.Analyzer)) {
+	if db.IsBare() {
+		return // nothing checked out
+	}
+	paths, uninitialized, err := vcs.GitSubmodules(db.RepoPath())
+	if err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	for _, path := range uninitialized {
+		fmt.Fprintf(os.Stderr, "Skipping submodule %s: not checked out\n", path)
+	}
+
+	var done []string
+	for _, path := range paths {
+		if gsos.IsInterrupted() {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Submodule %s\n", path)
+		sub, err := loc.OpenDb(loc.SubmoduleDbPath(cmd.Db, path), filepath.Join(db.RepoPath(), path), "git")
+		if err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		analyzer, closeAnalyzer := cmd.NewAnalyzer(sub)
+		analyzer.SetScope(loc.Scope{Since: cmd.Since, Until: cmd.Until, FirstParent: cmd.FirstParent})
+		fn(path, analyzer)
+		closeAnalyzer()
+		if err := sub.Close(); err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		done = append(done, path)
+	}
+	if gsos.IsInterrupted() {
+		return // the list is only for a finished run
+	}
+	if err := db.SetSubmodules(done); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+}
+
+// NewAnalyzer creates an analyzer for db set up from the command line. The
+// returned function closes anything it opened.
+func (cmd *Command) NewAnalyzer(db *loc.VcsDb2) (*loc.Analyzer, func()) {
+	opts, done := cmd.Options()
+	analyzer := loc.NewAnalyzer(cmd.StartTime, cmd.Verbose, cmd.Terminal(), db)
+	if err := analyzer.SetOptions(opts); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	if cmd.NoCompress {
+		if err := db.SetCompressed(false); err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+	}
+	return analyzer, done
+}
+
+// Options turns the command line into analysis options. The returned
+// function closes anything it opened.
+func (cmd *Command) Options() (loc.Options, func()) {
+	opts := loc.Options{
+		Repo: cmd.Repo,
+		Vcs: cmd.Vcs,
+		Db: cmd.Db,
+		Scope: cmd.Scope(),
+		NoStats: cmd.NoStat,
+		FirstParentStats: cmd.FirstParent,
+		NoStoreStats: cmd.NoStoreStats,
+		ExcludePaths: cmd.ExcludePaths,
+		Jobs: cmd.Jobs,
+		Compress: cmd.Compress,
+		MaxObjects: cmd.MaxObjects,
+		ConfirmLarge: cmd.confirmLarge,
+		Verbose: cmd.Verbose,
+	}
+	if cmd.Yes {
+		opts.MaxObjects = 0
+	}
+	if cmd.Mailmap != "" {
+		mailmap, err := loc.LoadMailmap(cmd.Mailmap)
+		if err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		opts.Mailmap = mailmap
+	}
+
+	done := func() {}
+	switch cmd.StreamStats {
+	case "":
+	case "-":
+		opts.StatStream = cmd.out
+	default:
+		f, err := os.Create(cmd.StreamStats)
+		if err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		opts.StatStream = f
+		done = func() { f.Close() }
+	}
+
+	switch cmd.Emit {
+	case "":
+	case "jsonl":
+		opts.CommitStream = cmd.out
+	default:
+		gsos.Fatalf("Unknown --emit format '%s'; there's only jsonl\n", cmd.Emit)
+	}
+	return opts, done
+}
+
+// confirmLarge asks whether to go ahead with a repo of more than
+// --max-objects objects. It's asked on the terminal; without one, the answer
+// is no, and --yes is needed.
+func (cmd *Command) confirmLarge(objects int) bool {
+	fmt.Fprintf(os.Stderr, "\nThe repo has %d objects to analyze, more than --max-objects=%d; that can take hours\n", objects, cmd.MaxObjects)
+	if !gsos.IsTerminal(os.Stdin) {
+		fmt.Fprintf(os.Stderr, "Use --yes to go ahead\n")
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Go ahead? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// RunCount brings the database up to date, then counts the lines of code at
+// the tip of each ref.
+func (cmd *Command) RunCount() {
+	if len(cmd.Args) > 1 || (len(cmd.Args) == 1 && !cmd.ByExtension) {
+		fmt.Printf("count takes a ref only with --by-extension\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	catchInterrupt()
+	analyzer.UpdateRepo()
+	if gsos.IsInterrupted() {
+		saveDb(db)
+		cmd.stopIfInterrupted()
+		return
+	}
+	counts := analyzer.Count()
+	saveDb(db)
+
+	if cmd.ByExtension {
+		cmd.printLocByExtension(db, counts)
+		return
+	}
+	if len(counts) == 0 {
+		fmt.Fprintf(cmd.out, "no refs to count\n")
+	}
+	printCounts(cmd.out, counts, "")
+	if cmd.RecurseSubmodules {
+		cmd.eachSubmodule(db, func(path string, analyzer *loc.Analyzer) {
+			analyzer.UpdateRepo()
+			if !gsos.IsInterrupted() {
+				printCounts(cmd.out, analyzer.Count(), path+": ")
+			}
+		})
+		cmd.stopIfInterrupted()
+	}
+}
+
+// printCounts prints the line counts of the refs, with prefix (a submodule)
+// in front of each refname.
+func printCounts(w io.Writer, counts []loc.LocCount, prefix string) {
+	for _, lc := range counts {
+		fmt.Fprintf(w, "%10d lines %7d files", lc.Lines, lc.Files)
+		if lc.BinaryFiles > 0 {
+			fmt.Fprintf(w, " (+%d binary)", lc.BinaryFiles)
+		}
+		fmt.Fprintf(w, "  %s%s\n", prefix, lc.Refname)
+		if lc.Stats != (loc.LineStats{}) {
+			fmt.Fprintf(w, "%10d code %8d comment %8d blank\n", lc.Stats.Code, lc.Stats.Comment, lc.Stats.Blank)
+		}
+	}
+}
+
+// printLocByExtension prints the lines of the ref named on the command line,
+// or of the default branch, by file extension, most code first.
+func (cmd *Command) printLocByExtension(db *loc.VcsDb2, counts []loc.LocCount) {
+	name, _ := db.DefaultBranch()
+	if len(cmd.Args) == 1 {
+		name = cmd.Args[0]
+	} else if name == "" {
+		gsos.Fatalf("count: no default branch; name the ref to count\n")
+	}
+	lc := loc.FindCount(counts, name)
+	if lc == nil {
+		gsos.Fatalf("count: no ref '%s'\n", name)
+	}
+	byExt, err := db.LocByExtension(lc.Hash)
+	if err != nil {
+		gsos.Fatalf("count: %s\n", err)
+	}
+
+	exts := make([]string, 0, len(byExt))
+	for ext := range byExt {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if byExt[exts[i]].Code != byExt[exts[j]].Code {
+			return byExt[exts[i]].Code > byExt[exts[j]].Code
+		}
+		return exts[i] < exts[j]
+	})
+	for _, ext := range exts {
+		stats := byExt[ext]
+		fmt.Fprintf(cmd.out, "%10d code %8d comment %8d blank  %s\n", stats.Code, stats.Comment, stats.Blank, ext)
+	}
+}
+
+// Scope is the part of the history selected by --range, --ref, --since, --until
+// and --path.
+func (cmd *Command) Scope() loc.Scope {
+	scope := loc.Scope{Range: cmd.Range, Refs: cmd.Refs, Since: cmd.Since, Until: cmd.Until, Paths: cmd.Paths, FirstParent: cmd.FirstParent}
+	if err := scope.Validate(); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	return scope
+}
+
+// RunWatch keeps the database up to date with the repo until interrupted.
+// On SIGINT it saves and exits.
+func (cmd *Command) RunWatch() {
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+
+	catchInterrupt()
+	analyzer.Watch(cmd.Interval, gsos.Interrupted())
+	saveDb(db)
+	fmt.Fprintf(os.Stderr, "Stopped watching\n")
+}
+
+// RunImportFastExport builds the database from a "git fast-export" stream
+// in a file (or stdin, for "-"). The stream is recorded as the repo.
+func (cmd *Command) RunImportFastExport() {
+	r := os.Stdin
+	if cmd.FromFastExport != "-" {
+		f, err := os.Open(cmd.FromFastExport)
+		if err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := cmd.OpenDb(cmd.FromFastExport, "fast-export")
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	if err := analyzer.ImportFastExport(r); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	saveDb(db)
+}
+
+// RunImportRawLog builds the database from a log written by the rawlog verb,
+// in a file (or stdin, for "-"). The log is recorded as the repo.
+func (cmd *Command) RunImportRawLog() {
+	r := os.Stdin
+	if cmd.FromRawLog != "-" {
+		f, err := os.Open(cmd.FromRawLog)
+		if err != nil {
+			gsos.Fatalf("%s\n", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := cmd.OpenDb(cmd.FromRawLog, "rawlog")
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	if err := analyzer.ImportRawLog(r); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	saveDb(db)
+}
+
+// RunRawLog writes the repo's log, as analyze reads it, to a file (or the
+// output), so that --from-rawlog can analyze it later without the repo.
+func (cmd *Command) RunRawLog() {
+	if len(cmd.Args) > 1 {
+		fmt.Printf("rawlog takes at most one file\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	if len(cmd.Args) == 0 {
+		if err := analyzer.DumpRawLog(cmd.out); err != nil {
+			gsos.Fatalf("rawlog: %s\n", err)
+		}
+		return
+	}
+	f, err := os.Create(cmd.Args[0])
+	if err != nil {
+		gsos.Fatalf("rawlog: %s\n", err)
+	}
+	err = analyzer.DumpRawLog(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		gsos.Fatalf("rawlog: %s\n", err)
+	}
+}
+
+// Terminal returns the terminal for progress and messages: nothing with
+// --quiet, otherwise stderr.
+func (cmd *Command) Terminal() gsos.Terminal {
+	if cmd.Quiet {
+		return gsos.NewNullTerminal()
+	}
+	return gsos.NewThrottleTerminal(cmd.ProgressInterval).SetWidth(cmd.Width).SetHeartbeat(heartbeatPeriod)
+}
+
+// heartbeatPeriod is how long a slow phase can go without showing anything
+// before the terminal shows it's still working.
+const heartbeatPeriod = time.Second
+
+// OpenDb opens or creates the database, exiting on failure. It's closed
+// when the command is done (see closeDbs).
+func (cmd *Command) OpenDb(repoPath string, vcs string) *loc.VcsDb2 {
+	db, err := loc.OpenDb(cmd.Db, repoPath, vcs)
+	if err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+	if len(cmd.dbs) == 0 {
+		gsos.OnFatal(cmd.unlockDbs)
+	}
+	cmd.dbs = append(cmd.dbs, db)
+	return db
+}
+
+// closeDbs closes the databases opened by OpenDb, saving whatever the
+// command didn't. They're all closed even if one fails.
+func (cmd *Command) closeDbs() {
+	var firstErr error
+	for _, db := range cmd.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	cmd.dbs = nil
+	if firstErr != nil {
+		gsos.Fatalf("%s\n", firstErr)
+	}
+}
+
+// unlockDbs unlocks the databases opened by OpenDb without saving them, as
+// on a fatal error. A lock left behind by exiting some other way is taken
+// over by the next run, since its process is gone.
+func (cmd *Command) unlockDbs() {
+	for _, db := range cmd.dbs {
+		db.Unlock()
+	}
+	cmd.dbs = nil
+}
+
+// catchInterrupt makes the first Ctrl-C stop the run cleanly (see
+// gsos.Interrupt), so that what it did so far can be saved. A second one
+// kills the process as usual.
+func catchInterrupt() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		fmt.Fprintf(os.Stderr, "\nInterrupted, saving (Ctrl-C again to quit now)...\n")
+		gsos.Interrupt()
+	}()
+}
+
+// stopIfInterrupted is true if the run was interrupted; it's called once the
+// database is saved. The command should then return, and main exits with the
+// usual status for SIGINT after the databases are closed.
+func (cmd *Command) stopIfInterrupted() bool {
+	if !gsos.IsInterrupted() {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Stopped; progress was saved, analyze again to carry on\n")
+	cmd.status = 130
+	return true
+}
+
+// saveDb saves the database, exiting on failure.
+func saveDb(db *loc.VcsDb2) {
+	if err := db.Save(); err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
+}
+
+// openReportDb opens the database for a report. If the database only holds
+// part of the history, that's noted on stderr so it isn't mistaken for the
+// whole repo.
+func (cmd *Command) openReportDb() *loc.VcsDb2 {
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	if scope := db.Scope(); !scope.IsWhole() {
+		fmt.Fprintf(os.Stderr, "note: database is limited to %s\n", scope)
+	}
+	return db
+}
+
+// RunGrep searches commit messages in the database with a regexp.
+func (cmd *Command) RunGrep() {
+	if len(cmd.Args) != 1 {
+		fmt.Printf("grep takes exactly one pattern\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.openReportDb()
+	opts := loc.GrepOptions{IgnoreCase: cmd.IgnoreCase, Author: cmd.Author, AllFields: cmd.AllFields}
+	if _, err := db.Grep(cmd.out, cmd.Args[0], opts); err != nil {
+		gsos.Fatalf("grep: %s\n", err)
+	}
+}
+
+// RunLog prints the commits in the database, newest first (or in topological
+// order), filtered by --author and --grep; see loc.VcsDb2.Log for the format.
+func (cmd *Command) RunLog() {
+	db := cmd.openReportDb()
+	opts := loc.LogOptions{TopoOrder: cmd.TopoOrder, Limit: cmd.Limit, Author: cmd.Author, Grep: cmd.Grep, IgnoreCase: cmd.IgnoreCase}
+	if _, err := db.Log(cmd.out, opts); err != nil {
+		gsos.Fatalf("log: %s\n", err)
+	}
+}
+
+// role is whose identity the author reports go by.
+func (cmd *Command) role() loc.Role {
+	if cmd.Committer {
+		return loc.ByCommitter
+	}
+	return loc.ByAuthor
+}
+
+// RunAuthors lists author (or committer) identities, or suggests a mailmap
+// that merges identities that look like the same person.
+func (cmd *Command) RunAuthors() {
+	db := cmd.openReportDb()
+	if cmd.SuggestMailmap {
+		if err := db.SuggestMailmap(cmd.out); err != nil {
+			gsos.Fatalf("authors: %s\n", err)
+		}
+		return
+	}
+
+	idents, err := db.AuthorIdentities(cmd.role())
+	if err != nil {
+		gsos.Fatalf("authors: %s\n", err)
+	}
+	for _, id := range idents {
+		fmt.Fprintf(cmd.out, "%6d %s\n", id.Commits, id)
+	}
+}
+
+// RunChanges writes every file change in the database as JSON Lines.
+func (cmd *Command) RunChanges() {
+	db := cmd.openReportDb()
+	if _, err := db.ExportChangesJSONL(cmd.out); err != nil {
+		gsos.Fatalf("changes: %s\n", err)
+	}
+}
+
+// RunMerges reports merge frequency and size.
+func (cmd *Command) RunMerges() {
+	db := cmd.openReportDb()
+	if err := db.WriteMergeReport(cmd.out); err != nil {
+		gsos.Fatalf("merges: %s\n", err)
+	}
+}
+
+// RunEmpty reports non-merge commits that change no files.
+func (cmd *Command) RunEmpty() {
+	db := cmd.openReportDb()
+	if err := db.WriteEmptyReport(cmd.out); err != nil {
+		gsos.Fatalf("empty: %s\n", err)
+	}
+}
+
+// RunChurn lists the files with the most lines added and removed.
+func (cmd *Command) RunChurn() {
+	db := cmd.openReportDb()
+	if err := db.WriteChurnReport(cmd.out, cmd.Top); err != nil {
+		gsos.Fatalf("churn: %s\n", err)
+	}
+}
+
+// RunBinary lists the commits that added the most bytes of binary files,
+// with the sizes from the repo.
+func (cmd *Command) RunBinary() {
+	db := cmd.openReportDb()
+	analyzer, done := cmd.NewAnalyzer(db)
+	defer done()
+	if err := analyzer.WriteBinaryReport(cmd.out, cmd.Top); err != nil {
+		gsos.Fatalf("binary: %s\n", err)
+	}
+}
+
+// RunStats lists each author's (or committer's) commits, active days and
+// first and last commit dates.
+func (cmd *Command) RunStats() {
+	db := cmd.openReportDb()
+	if err := db.WriteAuthorStats(cmd.out, cmd.role()); err != nil {
+		gsos.Fatalf("stats: %s\n", err)
+	}
+}
+
+// RunTimeSeries writes the commits per week (or --bucket=month) as CSV.
+func (cmd *Command) RunTimeSeries() {
+	db := cmd.openReportDb()
+	if err := db.WriteTimeSeriesCSV(cmd.out, cmd.Bucket); err != nil {
+		gsos.Fatalf("timeseries: %s\n", err)
+	}
+}
+
+// RunDomains counts the commits from each author (or committer) email
+// domain, folded with --domain-map.
+func (cmd *Command) RunDomains() {
+	var domains *loc.DomainMap
+	if cmd.DomainMap != "" {
+		var err error
+		if domains, err = loc.LoadDomainMap(cmd.DomainMap); err != nil {
+			gsos.Fatalf("domains: %s\n", err)
+		}
+	}
+
+	db := cmd.openReportDb()
+	if err := db.WriteDomainStats(cmd.out, cmd.role(), domains); err != nil {
+		gsos.Fatalf("domains: %s\n", err)
+	}
+}
+
+// RunDot writes the commit graph in Graphviz DOT form, optionally just one
+// ref's history, or the newest --last commits.
+func (cmd *Command) RunDot() {
+	if len(cmd.Args) > 1 {
+		fmt.Printf("dot takes at most one ref\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.openReportDb()
+	opts := loc.DotOpts{Last: cmd.Last}
+	if len(cmd.Args) == 1 {
+		opts.Ref = cmd.Args[0]
+	}
+	if err := db.WriteDOT(cmd.out, opts); err != nil {
+		gsos.Fatalf("dot: %s\n", err)
+	}
+}
+
+// RunRoots lists the root commits, one hash per line.
+func (cmd *Command) RunRoots() {
+	db := cmd.openReportDb()
+	roots, err := db.Roots()
+	if err != nil {
+		gsos.Fatalf("roots: %s\n", err)
+	}
+	for _, hash := range roots {
+		fmt.Fprintf(cmd.out, "%s\n", hash)
+	}
+}
+
+// RunDangling prints the commits that no ref leads to, newest first.
+func (cmd *Command) RunDangling() {
+	db := cmd.openReportDb()
+	hashes, err := db.UnreachableCommits()
+	if err != nil {
+		gsos.Fatalf("dangling: %s\n", err)
+	}
+	for _, hash := range hashes {
+		fmt.Fprintf(cmd.out, "%s\n", hash)
+	}
+}
+
+// RunComponents reports the independent histories in the commit graph.
+func (cmd *Command) RunComponents() {
+	db := cmd.openReportDb()
+	if err := db.WriteComponentsReport(cmd.out); err != nil {
+		gsos.Fatalf("components: %s\n", err)
+	}
+}
+
+// RunMergeBase prints the lowest common ancestor of the two commits in
+// --merge-base, found from the database's graph.
+func (cmd *Command) RunMergeBase() {
+	names := strings.Split(cmd.MergeBase, ",")
+	if len(names) != 2 {
+		fmt.Printf("--merge-base takes two commits: 'a,b'\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.openReportDb()
+	var hashes [2]vcs.Hash
+	for i, name := range names {
+		hash, err := db.ResolvePrefix(strings.TrimSpace(name))
+		if err != nil {
+			gsos.Fatalf("merge-base: %s\n", err)
+		}
+		hashes[i] = hash
+	}
+	base, err := db.MergeBase(hashes[0], hashes[1])
+	if err != nil {
+		gsos.Fatalf("merge-base: %s\n", err)
+	}
+	fmt.Fprintf(cmd.out, "%s\n", base)
+}
+
+// RunSQLite exports the commit graph and refs to an SQLite database.
+func (cmd *Command) RunSQLite() {
+	if len(cmd.Args) != 1 {
+		fmt.Printf("sqlite takes exactly one file\n")
+		cmd.Usage(1)
+	}
+
+	db := cmd.openReportDb()
+	if err := db.ExportSQLite(cmd.Args[0]); err != nil {
+		gsos.Fatalf("sqlite: %s\n", err)
+	}
+}
+
+// RunVerify checks the database for corruption, listing every problem found.
+// It exits with status 1 if there are any, so it can be used in scripts; the
+// exit waits until the database is closed (see main).
+func (cmd *Command) RunVerify() {
+	db := cmd.OpenDb(cmd.Repo, cmd.Vcs)
+	problems := db.Verify()
+	for _, problem := range problems {
+		fmt.Fprintf(cmd.out, "%s\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems in %s\n", len(problems), cmd.Db)
+		cmd.status = 1
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s is ok\n", cmd.Db)
 }
 
 // ----------------------------------------------------------------------------------------------
@@ -35,21 +847,171 @@ func (cmd *Command) Run() {
 type Command struct {
 	StartTime time.Time
 
+	// Verb is the command to run (analyze, grep); Args are its positional arguments
+	Verb string
+	Args []string
+
 	// Repo is the path to the repository to analyze
 	Repo string
 
+	// GitDir is a git directory to analyze (a bare repo, or a .git), in
+	// place of Repo; it implies --vcs=git
+	GitDir string
+
 	// Vcs is the Repo type - git, hg, svn
 	Vcs string
 
+	// GitBinary is the git executable to run, in place of "git" from PATH;
+	// GitArgs are global options for every git command, one argument each,
+	// e.g. --git-arg=-c --git-arg=core.quotepath=false
+	GitBinary string
+	GitArgs []string
+
+	// Range limits the analysis to a commit range (A..B, A.., ..B)
+	Range string
+
+	// Since and Until limit the analysis to a date window
+	Since string
+	Until string
+
+	// Refs limits the analysis to the history of these refs, instead of
+	// every ref
+	Refs []string
+
+	// Paths limits the analysis to history touching these paths
+	Paths []string
+
+	// ExcludePaths are globs for paths to leave out of the change stats
+	ExcludePaths []string
+
+	// IncludeStat and NoStat turn the (slow) gathering of per-file change
+	// stats on or off; it's on by default. Either on the command line
+	// overrides the other from the config file. IncludeStat doesn't force
+	// a refetch: stats already in the database are kept, and missing ones
+	// are fetched with or without it.
+	IncludeStat bool
+	NoStat bool
+
+	// FirstParent limits the analysis, commits and change stats, to the
+	// first-parent mainline
+	FirstParent bool
+
+	// StreamStats is a file ("-" for stdout) to stream per-commit stats to
+	// as JSON Lines while they're fetched; NoStoreStats keeps them out of the db
+	StreamStats string
+	NoStoreStats bool
+
+	// Emit is a format ("jsonl") to write each commit to stdout in as soon as
+	// it's fetched, alongside saving it to the db
+	Emit string
+
+	// Compress and NoCompress turn gzipping of the db's large files on or
+	// off; it's remembered in the db, so it's only needed once
+	Compress bool
+	NoCompress bool
+
+	// MaxObjects is how many objects analyze takes on without asking, so a
+	// huge repo isn't analyzed by mistake (0 for no limit); Yes goes ahead
+	// without asking
+	MaxObjects int
+	Yes bool
+
+	// RecurseSubmodules makes analyze and count do the repo's submodules too,
+	// each with its own database under Db
+	RecurseSubmodules bool
+
+	// ByExtension makes count print the lines of one ref (the default branch
+	// unless named) by file extension, rather than the totals of each ref
+	ByExtension bool
+
+	// Jobs is how many external commands to run at once where work can be
+	// split up; 0 means one per CPU
+	Jobs int
+
+	// FromFastExport is a "git fast-export" stream to read instead of a repo
+	FromFastExport string
+
+	// FromRawLog is a log written by the rawlog verb to read instead of a repo
+	FromRawLog string
+
+	// Config is a file of options to use before the command line's; see
+	// parseConfig
+	Config string
+
 	// Db is the location of the database used to save analysis results and temporaries.
 	// This is a directory, not a single file.
 	Db string
 
+	// Grep options: case-insensitive match, author filter, also match author fields
+	IgnoreCase bool
+	Author string
+	AllFields bool
+
+	// Log options: topological order, at most Limit commits (0 for all),
+	// message filter; Author and IgnoreCase apply too
+	TopoOrder bool
+	Limit int
+	Grep string
+
+	// SuggestMailmap makes the authors command print a suggested mailmap
+	SuggestMailmap bool
+
+	// Committer makes authors and stats go by who committed each commit,
+	// rather than who wrote it
+	Committer bool
+
+	// Top limits reports that rank things (churn, binary) to the first N; 0 means all
+	Top int
+
+	// Bucket is the period the timeseries report counts commits by, "week"
+	// or "month"
+	Bucket string
+
+	// Last limits the dot graph to the newest N commits; 0 means all
+	Last int
+
+	// MergeBase is two commits, "a,b", to print the common ancestor of
+	// instead of running a verb
+	MergeBase string
+
+	// Mailmap is a .mailmap-style file used to canonicalize commit authors
+	Mailmap string
+
+	// DomainMap is a file of rules folding email domains together for the
+	// domains report, see loc.DomainMap
+	DomainMap string
+
+	// CpuProfile and MemProfile are files to write pprof profiles to
+	CpuProfile string
+	MemProfile string
+
+	// Interval is how long watch waits between checks of the repo
+	Interval time.Duration
+
+	// ProgressInterval is the least time between progress messages
+	ProgressInterval time.Duration
+
+	// Width overrides the terminal width for progress output (0 means detect it)
+	Width int
+
+	// AbbrevLen is how long hashes are where output abbreviates them (longer
+	// if needed to tell commits apart); 0 for whole hashes
+	AbbrevLen int
+
+	// Output is a file to write reports to instead of stdout
+	Output string
+
+	// Quiet turns off progress and other messages on stderr
+	Quiet bool
+
 	Help    bool
 	Verbose bool
 
 	i int
 	args []string
+	dbs []*loc.VcsDb2 // databases opened, to close when done
+	status int // exit status, for a command that fails without being fatal
+	out *os.File // where reports go, see openOutput
 
 	u *CommandUsage
 }
@@ -59,6 +1021,14 @@ type Command struct {
 func (cmd *Command) parse() *Command {
 	cmd.u = NewCommandUsage()
 
+	// The config file comes first, so the command line overrides it
+	cmd.parseConfig(cmd.configPath())
+
+	// --include-stat and --no-stat on the command line override either one
+	// from the config file, rather than clashing with it
+	configIncludeStat, configNoStat := cmd.IncludeStat, cmd.NoStat
+	cmd.IncludeStat, cmd.NoStat = false, false
+
 	// Iterate through arglist by hand, because some argument parsing can consume
 	// multiple arguments
 	cmd.i = 0
@@ -66,29 +1036,227 @@ func (cmd *Command) parse() *Command {
 		arg := cmd.args[cmd.i]
 		cmd.i += 1
 
-		parsebool := func(opt string, val *bool) bool { return cmd.ParseBoolArg(arg, opt, val) }
-		parsestr := func(opt string, val *string, tag string) bool { return cmd.ParseStrArg(arg, opt, val, tag) }
-
-		if true &&
-			!parsestr("--repo", &cmd.Repo, "path") &&
-			!parsestr("--vcs", &cmd.Vcs, "vcs-name") &&
-			!parsestr("--db", &cmd.Db, "path") &&
-			!parsebool("-v", &cmd.Verbose) &&
-			!parsebool("--verbose", &cmd.Verbose) &&
-			!parsebool("-h", &cmd.Help) &&
-			!parsebool("--help", &cmd.Help) {
+		// Positional arguments are the verb followed by its arguments
+		if !strings.HasPrefix(arg, "-") {
+			if cmd.Verb == "" {
+				cmd.Verb = arg
+			} else {
+				cmd.Args = append(cmd.Args, arg)
+			}
+			continue
+		}
+
+		if !cmd.parseOption(arg) {
 			fmt.Printf("unknown option: '%s'\n", arg)
 			cmd.Usage(1)
 		}
 	}
 
+	if !cmd.IncludeStat && !cmd.NoStat {
+		cmd.IncludeStat, cmd.NoStat = configIncludeStat, configNoStat
+	}
+
 	if cmd.Help {
 		cmd.Usage(0)
 	}
 
+	if cmd.GitDir != "" {
+		if cmd.Repo != "" {
+			fmt.Printf("--repo and --git-dir can't be used together\n")
+			cmd.Usage(1)
+		}
+		if cmd.Vcs != "" && cmd.Vcs != "git" {
+			fmt.Printf("--git-dir is only for git repos\n")
+			cmd.Usage(1)
+		}
+		cmd.Repo = cmd.GitDir
+		cmd.Vcs = "git"
+	}
+
+	if cmd.Jobs < 0 {
+		fmt.Printf("--jobs can't be negative\n")
+		cmd.Usage(1)
+	}
+
+	if cmd.FromFastExport != "" && cmd.FromRawLog != "" {
+		fmt.Printf("--from-fast-export and --from-rawlog can't be used together\n")
+		cmd.Usage(1)
+	}
+	if cmd.Compress && cmd.NoCompress {
+		fmt.Printf("--compress and --no-compress can't be used together\n")
+		cmd.Usage(1)
+	}
+	if cmd.IncludeStat && cmd.NoStat {
+		fmt.Printf("--include-stat and --no-stat can't be used together\n")
+		cmd.Usage(1)
+	}
+	if cmd.ByExtension && cmd.RecurseSubmodules {
+		fmt.Printf("--by-extension and --recurse-submodules can't be used together\n")
+		cmd.Usage(1)
+	}
+
 	return cmd
 }
 
+// parseOption parses one option from the command line or the config file. It's
+// false if arg isn't an option we know.
+func (cmd *Command) parseOption(arg string) bool {
+	parsebool := func(opt string, val *bool) bool { return cmd.ParseBoolArg(arg, opt, val) }
+	parsestr := func(opt string, val *string, tag string) bool { return cmd.ParseStrArg(arg, opt, val, tag) }
+	parsestrs := func(opt string, val *[]string, tag string) bool { return cmd.ParseStrListArg(arg, opt, val, tag) }
+	parseint := func(opt string, val *int, tag string) bool { return cmd.ParseIntArg(arg, opt, val, tag) }
+	parsedur := func(opt string, val *time.Duration, tag string) bool { return cmd.ParseDurationArg(arg, opt, val, tag) }
+
+	return !(true &&
+		!parsestr("--repo", &cmd.Repo, "path") &&
+		!parsestr("--git-dir", &cmd.GitDir, "path") &&
+		!parsestr("--vcs", &cmd.Vcs, "vcs-name") &&
+		!parsestr("--git-bin", &cmd.GitBinary, "path") &&
+		!parsestrs("--git-arg", &cmd.GitArgs, "arg") &&
+		!parsestr("--db", &cmd.Db, "path") &&
+		!parsestr("--config", &cmd.Config, "file") &&
+		!parsestr("--range", &cmd.Range, "A..B") &&
+		!parsestrs("--ref", &cmd.Refs, "ref") &&
+		!parsestr("--since", &cmd.Since, "date") &&
+		!parsestr("--until", &cmd.Until, "date") &&
+		!parsestrs("--path", &cmd.Paths, "dir") &&
+		!parsestrs("--exclude-path", &cmd.ExcludePaths, "glob") &&
+		!parsebool("--include-stat", &cmd.IncludeStat) &&
+		!parsebool("--no-stat", &cmd.NoStat) &&
+		!parsebool("--first-parent", &cmd.FirstParent) &&
+		!parsestr("--stream-stats", &cmd.StreamStats, "file") &&
+		!parsebool("--no-store-stats", &cmd.NoStoreStats) &&
+		!parsestr("--emit", &cmd.Emit, "format") &&
+		!parsebool("--compress", &cmd.Compress) &&
+		!parsebool("--no-compress", &cmd.NoCompress) &&
+		!parseint("--jobs", &cmd.Jobs, "N") &&
+		!parsebool("--recurse-submodules", &cmd.RecurseSubmodules) &&
+		!parsebool("--by-extension", &cmd.ByExtension) &&
+		!parseint("--max-objects", &cmd.MaxObjects, "N") &&
+		!parsebool("--yes", &cmd.Yes) &&
+		!parsestr("--from-fast-export", &cmd.FromFastExport, "file") &&
+		!parsestr("--from-rawlog", &cmd.FromRawLog, "file") &&
+		!parsebool("-i", &cmd.IgnoreCase) &&
+		!parsebool("--ignore-case", &cmd.IgnoreCase) &&
+		!parsestr("--author", &cmd.Author, "regexp") &&
+		!parsebool("--all-fields", &cmd.AllFields) &&
+		!parsebool("--topo-order", &cmd.TopoOrder) &&
+		!parseint("--limit", &cmd.Limit, "N") &&
+		!parsestr("--grep", &cmd.Grep, "regexp") &&
+		!parsebool("--suggest-mailmap", &cmd.SuggestMailmap) &&
+		!parsebool("--committer", &cmd.Committer) &&
+		!parsestr("--mailmap", &cmd.Mailmap, "file") &&
+		!parsestr("--domain-map", &cmd.DomainMap, "file") &&
+		!parsestr("--merge-base", &cmd.MergeBase, "a,b") &&
+		!parseint("--top", &cmd.Top, "N") &&
+		!parsestr("--bucket", &cmd.Bucket, "week|month") &&
+		!parseint("--last", &cmd.Last, "N") &&
+		!parsedur("--interval", &cmd.Interval, "duration") &&
+		!parsedur("--progress-interval", &cmd.ProgressInterval, "duration") &&
+		!parseint("--width", &cmd.Width, "columns") &&
+		!parseint("--abbrev", &cmd.AbbrevLen, "N") &&
+		!parsestr("--output", &cmd.Output, "file") &&
+		!parsestr("--cpuprofile", &cmd.CpuProfile, "file") &&
+		!parsestr("--memprofile", &cmd.MemProfile, "file") &&
+		!parsebool("-q", &cmd.Quiet) &&
+		!parsebool("--quiet", &cmd.Quiet) &&
+		!parsebool("-v", &cmd.Verbose) &&
+		!parsebool("--verbose", &cmd.Verbose) &&
+		!parsebool("-h", &cmd.Help) &&
+		!parsebool("--help", &cmd.Help))
+}
+
+// configPath is the config file to read: the --config option, or .vcsloc in
+// the current directory if there is one. It's "" for none.
+func (cmd *Command) configPath() string {
+	for i, arg := range cmd.args {
+		if strings.HasPrefix(arg, "--config=") {
+			return arg[len("--config="):]
+		}
+		if arg == "--config" && i+1 < len(cmd.args) {
+			return cmd.args[i+1]
+		}
+	}
+	if _, err := os.Stat(defaultConfig); err == nil {
+		return defaultConfig
+	}
+	return ""
+}
+
+// defaultConfig is the config file used when there's no --config.
+const defaultConfig = ".vcsloc"
+
+// parseConfig reads options from a config file. Each line is "option=value",
+// where option is a long option without the leading "--", e.g.
+//
+//	repo=/src/project
+//	vcs=git
+//	db=/var/cache/vcsloc/project
+//	no-stat=true
+//
+// Blank lines and lines starting with "#" are skipped, and values can be
+// quoted. Unknown options are warned about and skipped. Repeatable options
+// (--path) given on the command line add to the ones from the config file.
+func (cmd *Command) parseConfig(path string) {
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		gsos.Fatalf("config: %s\n", err)
+	}
+	defer f.Close()
+
+	// Matching nothing declares every option, so their tags are known
+	cmd.parseOption("")
+
+	var lineno int
+	err = gsos.ScanLines(f, func(line string) error {
+		lineno += 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+		warn := func(format string, a ...interface{}) {
+			fmt.Fprintf(os.Stderr, "warning: %s:%d: %s\n", path, lineno, fmt.Sprintf(format, a...))
+		}
+
+		pos := strings.Index(line, "=")
+		if pos == -1 {
+			warn("not option=value: '%s'", line)
+			return nil
+		}
+		opt := "--" + strings.TrimSpace(line[:pos])
+		value := strings.TrimSpace(line[pos+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if opt == "--config" {
+			warn("config can't be set in a config file")
+			return nil
+		}
+
+		// Bool options take no value on the command line
+		if tag, ok := cmd.u.Tag(opt); ok && tag == "bool" {
+			switch value {
+			case "true":
+				cmd.parseOption(opt)
+			case "false":
+			default:
+				warn("%s needs true or false: '%s'", opt[2:], value)
+			}
+			return nil
+		}
+		if !cmd.parseOption(opt + "=" + value) {
+			warn("unknown option: '%s'", opt[2:])
+		}
+		return nil
+	})
+	if err != nil {
+		gsos.Fatalf("config: %s: %s\n", path, err)
+	}
+}
+
 // ParseBoolArg auto-creates usage and checks the current arg against a
 // specific boolean option.
 func (cmd *Command) ParseBoolArg(arg string, opt string, val *bool) bool {
@@ -125,9 +1293,61 @@ func (cmd *Command) ParseStrArg(arg string, opt string, val *string, tag string)
 	return false
 }
 
+// ParseStrListArg auto-creates usage and checks the current arg against a
+// specific repeatable string option; each use appends to the list.
+func (cmd *Command) ParseStrListArg(arg string, opt string, val *[]string, tag string) bool {
+	cmd.u.MakeUsage(opt, tag, uintptr(unsafe.Pointer(val)))
+
+	var str string
+	if !cmd.ParseStrArg(arg, opt, &str, tag) {
+		return false
+	}
+	*val = append(*val, str)
+	return true
+}
+
+// ParseIntArg auto-creates usage and checks the current arg against a
+// specific integer option, in the same forms as ParseStrArg.
+func (cmd *Command) ParseIntArg(arg string, opt string, val *int, tag string) bool {
+	cmd.u.MakeUsage(opt, tag, uintptr(unsafe.Pointer(val)))
+
+	var str string
+	if !cmd.ParseStrArg(arg, opt, &str, tag) {
+		return false
+	}
+
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		fmt.Printf("%s needs a number: '%s'\n", opt, str)
+		cmd.Usage(1)
+	}
+	*val = n
+	return true
+}
+
+// ParseDurationArg auto-creates usage and checks the current arg against a
+// specific duration option (e.g. "30s", "5m"), in the same forms as ParseStrArg.
+func (cmd *Command) ParseDurationArg(arg string, opt string, val *time.Duration, tag string) bool {
+	cmd.u.MakeUsage(opt, tag, uintptr(unsafe.Pointer(val)))
+
+	var str string
+	if !cmd.ParseStrArg(arg, opt, &str, tag) {
+		return false
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		fmt.Printf("%s needs a duration: '%s'\n", opt, str)
+		cmd.Usage(1)
+	}
+	*val = d
+	return true
+}
+
 // Usage shows command-line usage gleaned from the command-line declarations.
 func (cmd *Command) Usage(fail int) {
-	fmt.Fprintf(os.Stderr, "%s\n", cmd.u.Usage("usage: vcsloc"))
+	fmt.Fprintf(os.Stderr, "%s\n", cmd.u.Usage("usage: vcsloc [<command>]"))
+	fmt.Fprintf(os.Stderr, "commands: %s\n", strings.Join(commandNames, ", "))
 	os.Exit(fail)
 }
 
@@ -173,6 +1393,22 @@ func (u *CommandUsage) MakeUsage(opt string, tag string, pval uintptr) {
 	u.usage[n].tag = tag
 }
 
+// Tag returns the tag an option was declared with ("bool" for bool options),
+// and false if there's no such option.
+func (u *CommandUsage) Tag(opt string) (string, bool) {
+	if !u.seen[opt] {
+		return "", false
+	}
+	for _, v := range u.usage {
+		for _, o := range v.opt {
+			if o == opt {
+				return v.tag, true
+			}
+		}
+	}
+	return "", false
+}
+
 // Usage shows short command-line usage and then exits.
 // It groups aliases together, and shows output in the order
 // that the command-line was defined by the programmer.
@@ -0,0 +1,152 @@
+// vcsloc/vcs/backend.go
+
+package vcs
+
+import (
+	"fmt"
+)
+
+// VcsBackend is the version control operations the analyzer needs, so that
+// it can work on more than one kind of repo.
+type VcsBackend interface {
+	// Name is the vcs name as stored in a database header ("git", "hg").
+	Name() string
+
+	// Refs returns the refs, with tags resolved to the commits they point at.
+	Refs() []Ref
+
+	// IsBare is true if the repo has no working tree. Nothing the analyzer
+	// does needs one.
+	IsBare() bool
+
+	// ShallowCommits returns the commits at the edge of a shallow clone,
+	// whose parents aren't in the repo; nil for a full repo.
+	ShallowCommits() []Hash
+
+	// CountObjects returns a number that changes when the repo gets new
+	// history; it's a cheap check for being out of date.
+	CountObjects() int
+
+	// LogArgs turns a revision selection into arguments for AllCommitHashes
+	// and LogIncremental.
+	LogArgs(spec RevSpec) []string
+
+	// AllCommitHashes returns the hashes of the selected commits, newest
+	// first. If progress isn't nil, it's called with the count so far.
+	AllCommitHashes(progress func(n int), args ...string) []Hash
+
+	// LogIncremental runs a log of the selected commits, calling outCb with
+	// each line. Each commit starts with a header line of the form
+	//	RS <hash> US <unix> US <tz> US <name> US <email> US <cname> US <cemail> US <cunix> US <hashes> US <subject>
+	// where RS is LogRecordSep and US is LogFieldSep (without the spaces),
+	// and tz is the author's offset from UTC as "+hhmm" or "-hhmm". The
+	// c fields are the committer's; a backend without committers repeats
+	// the author.
+	// Then comes the rest of the commit message, the body, as is; the last
+	// line of the body ends with LogBodyEnd, on a line of its own if the body
+	// is empty or ends in a newline. It's followed, if stats is true and the
+	// backend supports it, by "git log --numstat --summary" style lines.
+	// Names and messages are UTF-8, whatever encoding the commits were made
+	// with, where the backend can convert them.
+	LogIncremental(outCb func(string), stats bool, args ...string)
+
+	// SupportsStats is true if LogIncremental can produce change stats.
+	SupportsStats() bool
+
+	// DefaultBranch returns the refname of the repo's default branch, the
+	// mainline, which is one of refs; "" if it can't tell.
+	DefaultBranch(refs []Ref) string
+
+	// MissingCommits returns those of hashes that aren't in the repo, as
+	// happens to old tips once history is rewritten. If it can't tell, it
+	// returns nil.
+	MissingCommits(hashes []Hash) []Hash
+
+	// RefsSignature returns a short signature of the refs, one that changes
+	// whenever any ref does and is cheaper to get than Refs; "" if the
+	// backend has no cheaper way than Refs.
+	RefsSignature() string
+}
+
+// LogRecordSep starts each commit header line from LogIncremental, and
+// LogFieldSep separates its fields. They're the ASCII record and unit
+// separators, which don't turn up in names, emails or subjects, so a field
+// can hold anything else. LogBodyEnd, the group separator, ends the message
+// body.
+const (
+	LogRecordSep = "\x1e"
+	LogFieldSep = "\x1f"
+	LogBodyEnd = "\x1d"
+)
+
+// RevSpec selects part of a repo's history.
+type RevSpec struct {
+	Range string // "A..B", "A.." or "..B"; empty for everything
+	Refs []string // the refs to start from instead of all of them, if any; Range can only be "A.." with them
+	Since string // only commits after this date
+	Until string // only commits before this date
+	Paths []string // only commits touching these paths
+	Exclude []Hash // leave out these commits and their ancestors
+	FirstParent bool // only follow first parents from the refs (or the range's end)
+}
+
+// CheckRepo makes sure that repodir is a repo that the vcs can work on, so
+// that a mistyped path gets a clear error up front rather than a failed
+// command later.
+func CheckRepo(vcs string, repodir string) error {
+	var ok bool
+	switch vcs {
+	case "git":
+		if _, err := lookupPath(gitBinary); err != nil {
+			return err
+		}
+		ok = IsGitRepo(repodir)
+	case "hg":
+		if _, err := lookupPath("hg"); err != nil {
+			return err
+		}
+		ok = IsHgRepo(repodir)
+	case "fast-export", "rawlog":
+		return nil // built from a stream; repodir is the stream file
+	default:
+		return fmt.Errorf("unsupported version control system '%s'", vcs)
+	}
+	if !ok {
+		return fmt.Errorf("not a %s repository: %s", vcs, repodir)
+	}
+	return nil
+}
+
+// NewBackend returns the backend for a vcs name and repo.
+func NewBackend(vcs string, repodir string) (VcsBackend, error) {
+	switch vcs {
+	case "git":
+		return &GitBackend{repodir: repodir}, nil
+	case "hg":
+		return &HgBackend{repodir: repodir}, nil
+	default:
+		return nil, fmt.Errorf("unsupported version control system '%s'", vcs)
+	}
+}
+
+// GuessDefaultBranch picks the default branch from the refs alone, for a repo
+// whose HEAD doesn't say (a mirror with a detached HEAD, or a stream): main,
+// or else master. It's "" if there's neither.
+func GuessDefaultBranch(refs []Ref) string {
+	for _, name := range []string{"refs/heads/main", "refs/heads/master"} {
+		if hasRef(refs, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasRef is true if refs has a commit ref named refname.
+func hasRef(refs []Ref, refname string) bool {
+	for _, ref := range refs {
+		if ref.Refname == refname && ref.IsCommit() {
+			return true
+		}
+	}
+	return false
+}
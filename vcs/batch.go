@@ -0,0 +1,200 @@
+// vcsloc/vcs/batch.go
+
+package vcs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"vcsloc/gsos"
+)
+
+// ErrObjectMissing is returned by (*BatchReader).Open for a name that isn't
+// an object in the repo.
+var ErrObjectMissing = errors.New("object missing")
+
+// BatchReader reads objects from a repo through one long-lived
+// "git cat-file --batch", so that reading thousands of blobs doesn't start
+// thousands of processes. Objects are asked for one at a time, and each one
+// is streamed; it isn't safe for concurrent use.
+type BatchReader struct {
+	repodir string
+	cmd *exec.Cmd
+	stdin io.WriteCloser
+	stdout *bufio.Reader
+	object *BatchObject // the object being read, if any
+	err error // what broke the reader; it's stuck once there's one
+
+	stderr strings.Builder
+	stderrDone chan struct{}
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+// BatchObject is one object from a BatchReader. Its contents are read from
+// it as an io.Reader, and are only good until the next Open (which skips
+// over whatever wasn't read).
+type BatchObject struct {
+	Hash Hash
+	Type string // blob, tree, commit or tag
+	Size int64
+	r *io.LimitedReader
+}
+
+func (o *BatchObject) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+// BatchCatFile starts a "git cat-file --batch" in repodir. It's stopped by
+// Close, or by gsos.Interrupt.
+func BatchCatFile(repodir string) (*BatchReader, error) {
+	exePath, err := lookupPath(gitBinary)
+	if err != nil {
+		return nil, err
+	}
+	c := exec.Command(exePath, gitCommand([]string{"cat-file", "--batch"})...)
+	c.Dir = repodir
+	c.Env = os.Environ()
+	ownProcessGroup(c)
+
+	b := &BatchReader{repodir: repodir, cmd: c, stderrDone: make(chan struct{}), closed: make(chan struct{})}
+	if b.stdin, err = c.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdoutPipe, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrPipe, err := c.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	b.stdout = bufio.NewReaderSize(stdoutPipe, 64*1024)
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("%s cat-file --batch failed to start: %s", gitBinary, err)
+	}
+
+	go func() {
+		io.Copy(&b.stderr, stderrPipe)
+		close(b.stderrDone)
+	}()
+	go func() {
+		select {
+		case <-gsos.Interrupted():
+			c.Process.Kill()
+		case <-b.closed:
+		}
+	}()
+	return b, nil
+}
+
+// Open asks for an object by name: a hash, or anything else cat-file takes,
+// like "<commit>:<path>" (which can't have a newline in it). A name that
+// isn't an object is ErrObjectMissing, and the reader can go on; any other
+// error means the cat-file is gone, and every later call fails too.
+func (b *BatchReader) Open(name string) (*BatchObject, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if strings.Contains(name, "\n") {
+		return nil, fmt.Errorf("can't ask cat-file for a name with a newline in it: %q", name)
+	}
+
+	// Skip the rest of the last object, and its newline
+	if b.object != nil {
+		if _, err := io.Copy(io.Discard, b.object.r); err != nil {
+			return nil, b.fail(err)
+		}
+		if _, err := b.stdout.Discard(1); err != nil {
+			return nil, b.fail(err)
+		}
+		b.object = nil
+	}
+
+	if _, err := io.WriteString(b.stdin, name + "\n"); err != nil {
+		return nil, b.fail(err)
+	}
+
+	// "<hash> <type> <size>", or "<name> missing" (or ambiguous)
+	header, err := b.stdout.ReadString('\n')
+	if err != nil {
+		return nil, b.fail(err)
+	}
+	header = strings.TrimSuffix(header, "\n")
+	if strings.HasSuffix(header, " missing") || strings.HasSuffix(header, " ambiguous") {
+		return nil, fmt.Errorf("%w: %s", ErrObjectMissing, name)
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) != 3 {
+		return nil, b.fail(fmt.Errorf("bad cat-file header for %s: %q", name, header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, b.fail(fmt.Errorf("bad cat-file header for %s: %q", name, header))
+	}
+
+	b.object = &BatchObject{Hash: Hash(fields[0]), Type: fields[1], Size: size, r: &io.LimitedReader{R: b.stdout, N: size}}
+	return b.object, nil
+}
+
+// ReadAll reads a whole object. For a big one, reading it from Open as a
+// stream doesn't hold it all in memory.
+func (b *BatchReader) ReadAll(name string) (*BatchObject, []byte, error) {
+	obj, err := b.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, obj.Size)
+	if _, err := io.ReadFull(obj, data); err != nil {
+		return nil, nil, b.fail(err)
+	}
+	return obj, data, nil
+}
+
+// Err is what broke the reader, or that it's closed; nil while it works. A
+// missing object doesn't break it.
+func (b *BatchReader) Err() error {
+	return b.err
+}
+
+// fail records what broke the reader, with what cat-file had to say.
+func (b *BatchReader) fail(err error) error {
+	if gsos.IsInterrupted() {
+		b.err = fmt.Errorf("cat-file stopped: interrupted")
+		return b.err
+	}
+	b.Close()
+	b.err = fmt.Errorf("cat-file in %s failed: %s\nstderr: %s", b.repodir, err, b.stderr.String())
+	return b.err
+}
+
+// Close ends the cat-file, and waits for it to exit. It's safe to call more
+// than once.
+func (b *BatchReader) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		// cat-file exits at the end of its input, once it's written what it
+		// has; that has to be read, or it could be stuck writing it
+		b.stdin.Close()
+		io.Copy(io.Discard, b.stdout)
+		<-b.stderrDone
+		err = b.cmd.Wait()
+		close(b.closed)
+		if b.err == nil {
+			b.err = errors.New("cat-file is closed")
+		}
+		if err != nil && !gsos.IsInterrupted() {
+			err = fmt.Errorf("cat-file in %s failed: %s\nstderr: %s", b.repodir, err, b.stderr.String())
+		} else {
+			err = nil
+		}
+	})
+	return err
+}
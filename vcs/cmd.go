@@ -3,12 +3,14 @@
 package vcs
 
 import (
-	"bufio"
 	"bytes"
-	"log"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"vcsloc/gsos"
 )
@@ -17,83 +19,220 @@ import (
 // This is a non-interactive version and is best used for commands that should
 // finish quickly (e.g in under 1 second). For interactive use or for feeding
 // commands stdin, use operateExternal
-func RunExternal(exe string, workingDir string, env []string, params ...string) (float64, []byte, []byte) {
+// A command that can't be run or exits non-zero is an error, with its stderr
+// in the message; git commands that fail on a lock held by another git
+// process are retried a few times first.
+func RunExternal(exe string, workingDir string, env []string, params ...string) (float64, []byte, []byte, error) {
+	return RunExternalStdin(nil, exe, workingDir, env, params...)
+}
+
+// MustRunExternal is RunExternal for the command-line tool: any failure is fatal.
+func MustRunExternal(exe string, workingDir string, env []string, params ...string) (float64, []byte, []byte) {
+	elapsed, stdout, stderr, err := RunExternal(exe, workingDir, env, params...)
+	if err != nil {
+		gsos.Fatalf("\n%s\n", err)
+	}
+	return elapsed, stdout, stderr
+}
+
+// lockRetryDelays are the waits between attempts at a command that failed on
+// a lock; the total is about what a git operation holding the index takes.
+var lockRetryDelays = []time.Duration{100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second}
+
+// isLockError is true if stderr is git failing to take a lock file that
+// another git process holds, e.g. "Unable to create '.../index.lock': File exists."
+func isLockError(exe string, stderr []byte) bool {
+	return exe == gitBinary && bytes.Contains(stderr, []byte(".lock': File exists"))
+}
+
+// RunExternalStdin is RunExternal with stdin read from a reader, e.g. for
+// "git cat-file --batch-check". A nil stdin is empty.
+func RunExternalStdin(stdin io.Reader, exe string, workingDir string, env []string, params ...string) (float64, []byte, []byte, error) {
 
 	// Do one-time find of the executable
-	exePath := lookupPath(exe)
+	exePath, err := lookupPath(exe)
+	if err != nil {
+		return 0, nil, nil, err
+	}
 
+	// Retries need the same stdin again
+	var input []byte
+	if stdin != nil {
+		if input, err = io.ReadAll(stdin); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	var cmdTime float64
 	var stdout, stderr bytes.Buffer
-	cmdEnv := append(os.Environ(), env...)
+	for attempt := 0; ; attempt++ {
+		stdout.Reset()
+		stderr.Reset()
 
-	c := exec.Command(exePath, params...)
+		c := exec.Command(exePath, params...)
 
-	c.Dir = workingDir
-	c.Env = cmdEnv
-	c.Stdout = &stdout
-	c.Stderr = &stderr
+		c.Dir = workingDir
+		c.Env = append(os.Environ(), env...)
+		c.Stdin = bytes.NewReader(input)
+		c.Stdout = &stdout
+		c.Stderr = &stderr
 
-	startTime := gsos.HighresTime()
-	err := c.Run()
-	cmdTime := (gsos.HighresTime() - startTime).Duration().Seconds() // TBD just return HighresTimestamp
+		startTime := gsos.HighresTime()
+		err = c.Run()
+		cmdTime += (gsos.HighresTime() - startTime).Duration().Seconds() // TBD just return HighresTimestamp
+
+		if err == nil || attempt == len(lockRetryDelays) || !isLockError(exe, stderr.Bytes()) {
+			break
+		}
+		time.Sleep(lockRetryDelays[attempt])
+	}
 
 	if err != nil {
-		log.Fatalf("\n%s %s failed: %s\nstdout: %s\nstderr: %s\n",
+		return cmdTime, stdout.Bytes(), stderr.Bytes(), fmt.Errorf("%s %s failed: %w\nstdout: %s\nstderr: %s",
 			exe, strings.Join(params, " "), err, string(stdout.Bytes()), string(stderr.Bytes()))
 	}
 
-	return cmdTime, stdout.Bytes(), stderr.Bytes()
+	return cmdTime, stdout.Bytes(), stderr.Bytes(), nil
 }
 
 // RunExternalIncremental runs an external command incrementally, returning elapsed time.
 // The stdout and stderr are provided through a callback as individual lines. The stdout
-// callback is mandatory, but the stderr callback is optional.
-// TBD add stdin that gets fed to the external program
+// callback is mandatory, but the stderr callback is optional. Either way, stderr is
+// kept so that it can be shown if the command fails. If gsos.Interrupt is called, the
+// command is killed and this returns after the output so far; callers check
+// gsos.IsInterrupted to tell that from the whole output.
 func RunExternalIncremental(outCb, errCb func(string),
 	exe string, workingDir string, env []string, params ...string) float64 {
 
+	return RunExternalIncrementalStdin(nil, outCb, errCb, exe, workingDir, env, params...)
+}
+
+// RunExternalIncrementalStdin is RunExternalIncremental with stdin fed from a
+// reader, e.g. a list of hashes for "git log --stdin". It's written from a
+// goroutine of its own while stdout is read, so a command that writes as it
+// reads doesn't stall on a large input; stdin is closed at the end of the
+// reader, or once the command stops reading. A nil stdin is empty.
+func RunExternalIncrementalStdin(stdin io.Reader, outCb, errCb func(string),
+	exe string, workingDir string, env []string, params ...string) float64 {
+
 	// Do one-time find of the executable
-	exePath := lookupPath(exe)
+	exePath, err := lookupPath(exe)
+	if err != nil {
+		gsos.Fatalf("%s\n", err)
+	}
 
 	// Prepare the command
 	c := exec.Command(exePath, params...)
 	c.Dir = workingDir
 	c.Env = append(os.Environ(), env...)
+	ownProcessGroup(c)
 
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, _ = c.StdinPipe()
+	}
 	stdoutPipe, _ := c.StdoutPipe()
-	stdout := bufio.NewScanner(stdoutPipe)
-
 	stderrPipe, _ := c.StderrPipe()
-	stderr := bufio.NewScanner(stderrPipe)
+	var stderrText strings.Builder
 
-	done := make(chan struct{})
+	done := make(chan struct{}, 1)
 
 	// Start the command. We can fetch stdout in the current thread, and
 	// defer stderr to a goroutine. This should be performant.
 	startTime := gsos.HighresTime()
-	c.Start()
+	if err := c.Start(); err != nil {
+		gsos.Fatalf("\n%s %s failed to start: %s\n", exe, strings.Join(params, " "), err)
+	}
+
+	// On an interrupt, stop the command; the caller gets the output so far
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-gsos.Interrupted():
+			c.Process.Kill()
+		case <-finished:
+		}
+	}()
+
+	// A write fails once the command has exited (or closed its stdin), which
+	// isn't an error here; the exit status says whether it went wrong. Not
+	// being able to read stdin is.
+	var stdinErr error
+	stdinDone := make(chan struct{})
+	if stdin != nil {
+		go func() {
+			defer close(stdinDone)
+			defer stdinPipe.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 {
+					if _, werr := stdinPipe.Write(buf[:n]); werr != nil {
+						return
+					}
+				}
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					stdinErr = err
+					return
+				}
+			}
+		}()
+	} else {
+		close(stdinDone)
+	}
 
 	go func() {
-		for stderr.Scan() {
-			line := stderr.Text()
+		gsos.ScanLines(stderrPipe, func(line string) error {
+			stderrText.WriteString(line)
+			stderrText.WriteString("\n")
 			if errCb != nil {
 				errCb(line)
 			}
-		}
+			return nil
+		})
 		done <- struct{}{} // prevent race, although this could slow us down on really quick externals
 	}()
 
-	for stdout.Scan() {
-		outCb(stdout.Text())
+	// If outCb calls Fatalf (a panic inside gsos.CatchFatal), don't leave the
+	// command and the goroutines above running.
+	waited := false
+	defer func() {
+		if !waited {
+			c.Process.Kill()
+			<-done
+			c.Wait()
+			<-stdinDone
+		}
+	}()
+
+	scanErr := gsos.ScanLines(stdoutPipe, func(line string) error {
+		outCb(line)
+		return nil
+	})
+	if scanErr != nil {
+		c.Process.Kill() // its output can't be read, so it may never finish
 	}
 
 	// Now wait for all the output. Hopefully our stderr will be consumed before
 	// we exit.
 	<-done
-	err := c.Wait()
+	err = c.Wait()
+	<-stdinDone
+	waited = true
 	cmdTime := (gsos.HighresTime() - startTime).Duration().Seconds() // TBD just return HighresTimestamp
 
-	if err != nil {
-		log.Fatalf("\n%s %s failed: %s\n", exe, strings.Join(params, " "), err)
+	if scanErr != nil && !gsos.IsInterrupted() {
+		gsos.Fatalf("\n%s %s failed reading output: %s\n", exe, strings.Join(params, " "), scanErr)
+	}
+	if err != nil && !gsos.IsInterrupted() {
+		gsos.Fatalf("\n%s %s failed: %s\nstderr: %s\n", exe, strings.Join(params, " "), err, stderrText.String())
+	}
+	if stdinErr != nil && !gsos.IsInterrupted() {
+		gsos.Fatalf("\n%s %s failed reading input: %s\n", exe, strings.Join(params, " "), stdinErr)
 	}
 
 	return cmdTime
@@ -101,20 +240,26 @@ func RunExternalIncremental(outCb, errCb func(string),
 
 // lookupPath memoizes executable paths for better performance - some
 // operating systems are slow to find executables. I suppose
-// it's unreasonable to expect exec.LookPath to do this...
-func lookupPath(exe string) string {
+// it's unreasonable to expect exec.LookPath to do this... The paths are
+// keyed on the name as given, so a git picked with SetGitBinary is looked
+// up (or checked, for a path) on its own.
+func lookupPath(exe string) (string, error) {
+	commandPathsLock.Lock()
+	defer commandPathsLock.Unlock()
+
 	exePath, ok := commandPaths[exe]
 	if ok {
-		return exePath
+		return exePath, nil
 	}
 
 	var err error
 	exePath, err = exec.LookPath(exe)
 	if err != nil {
-		log.Fatalf("Not installed: %s\n", exe)
+		return "", fmt.Errorf("Not installed: %s", exe)
 	}
 	commandPaths[exe] = exePath
-	return exePath
+	return exePath, nil
 }
 
 var commandPaths map[string]string = make(map[string]string)
+var commandPathsLock sync.Mutex // commands can be run from several goroutines
@@ -0,0 +1,100 @@
+// vcsloc/vcs/cmd_test.go
+
+package vcs
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"vcsloc/gsos"
+)
+
+// fatalEnv is set in the child process a test runs to see a command fail;
+// failures are fatal, so they can only be seen from outside.
+const fatalEnv = "VCSLOC_TEST_FATAL"
+
+// runFatalChild runs the named test again in a child process, with fatalEnv
+// set to arg, and returns its output, which has to end in a failed exit.
+func runFatalChild(t *testing.T, name string, arg string) string {
+	c := exec.Command(os.Args[0], "-test.run=^"+name+"$")
+	c.Env = append(os.Environ(), fatalEnv+"="+arg)
+	out, err := c.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("child didn't fail (%v): %s", err, out)
+	}
+	return string(out)
+}
+
+// A git command that writes to stderr and then exits nonzero has to be
+// reported with what git said.
+func TestRunGitCommandIncrementalFailure(t *testing.T) {
+	if dir := os.Getenv(fatalEnv); dir != "" {
+		RunGitCommandIncremental(func(string) {}, nil, dir, nil, "log", "no-such-revision")
+		return
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s: %s", err, out)
+	}
+
+	out := runFatalChild(t, "TestRunGitCommandIncrementalFailure", dir)
+	if !strings.Contains(out, "unknown revision") {
+		t.Errorf("failure doesn't have git's stderr: %s", out)
+	}
+}
+
+// A command that writes to stderr and then fails has to be reported with
+// its stderr, after the output and the input it was fed are dealt with.
+func TestRunExternalIncrementalStdinFailure(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+
+	var out []string
+	stdin := strings.NewReader("a\nb\n")
+	err := gsos.CatchFatal(func() {
+		RunExternalIncrementalStdin(stdin, func(line string) { out = append(out, line) }, nil,
+			"sh", "", nil, "-c", "cat; echo 'fatal: bad object deadbeef' >&2; exit 1")
+	})
+	if err == nil {
+		t.Fatalf("no error from a command that exited 1")
+	}
+	if !strings.Contains(err.Error(), "fatal: bad object deadbeef") {
+		t.Errorf("error doesn't have the command's stderr: %s", err)
+	}
+	if strings.Join(out, ",") != "a,b" {
+		t.Errorf("stdout was %q, want the stdin fed to it", out)
+	}
+}
+
+// A Fatalf from the output callback stops the command before it gets out of
+// RunExternalIncremental; the command here would otherwise run for a minute.
+func TestRunExternalIncrementalCallbackFatal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+
+	var pid int
+	err := gsos.CatchFatal(func() {
+		RunExternalIncremental(func(line string) {
+			pid, _ = strconv.Atoi(line)
+			gsos.Fatalf("stop at %s\n", line)
+		}, nil, "sh", "", nil, "-c", "echo $$; exec sleep 60")
+	})
+	if err == nil || pid == 0 {
+		t.Fatalf("got error %v, pid %d", err, pid)
+	}
+	// Once it's been waited for, there's no process left to signal
+	if p, err := os.FindProcess(pid); err == nil && p.Signal(syscall.Signal(0)) == nil {
+		t.Errorf("command %d still running", pid)
+		p.Kill()
+	}
+}
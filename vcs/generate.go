@@ -0,0 +1,106 @@
+// vcsloc/vcs/generate.go
+
+package vcs
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// GenOpts shapes a repo made by GenerateGitRepo.
+type GenOpts struct {
+	Commits int // commits in all, merges included
+	Branches int // branches being worked on at once, master included; 0 or 1 is a straight line
+	MergeEvery int // a merge into master every this many commits; 0 for none
+	Octopus int // parents of each merge, 2 or more (more is an octopus merge); 0 means 2
+	Files int // files per branch that commits change; 0 means 10
+	Seed int64 // picks which branch each commit goes on; the same seed gives the same repo
+}
+
+// genEpoch is the author time of the first generated commit; each commit is a
+// minute after the last, so the history is the same on every run.
+const genEpoch = 1500000000
+
+// GenerateGitRepo creates a git repo in dir (which must not be a repo yet) with
+// synthetic history, for benchmarks and tests: a deep history is many commits
+// on one branch, and a wide one is many branches with octopus merges. Commits
+// are spread over master and branch1..branchN-1; every MergeEvery commits,
+// master merges in the tips of Octopus-1 other branches. Each commit rewrites
+// one file, so every commit has a change. The history goes in with one
+// "git fast-import", so large repos are quick to make.
+func GenerateGitRepo(dir string, opts GenOpts) error {
+	if opts.Commits <= 0 {
+		return fmt.Errorf("GenerateGitRepo: need at least one commit")
+	}
+	if opts.Branches < 1 {
+		opts.Branches = 1
+	}
+	if opts.Octopus < 2 {
+		opts.Octopus = 2
+	}
+	if opts.Files < 1 {
+		opts.Files = 10
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if _, _, _, err := RunGitCommand(dir, nil, "init", "-q"); err != nil {
+		return err
+	}
+
+	branches := make([]string, opts.Branches)
+	tips := make([]int, opts.Branches) // mark of each branch's last commit, 0 for none
+	for i := range branches {
+		branches[i] = fmt.Sprintf("branch%d", i)
+	}
+	branches[0] = "master"
+
+	var stream strings.Builder
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for n := 1; n <= opts.Commits; n++ {
+		var b int
+		var merge []int
+		if opts.MergeEvery > 0 && n%opts.MergeEvery == 0 && tips[0] != 0 {
+			// Merge the other branches with commits of their own into master
+			for _, i := range rng.Perm(opts.Branches - 1) {
+				if tip := tips[i+1]; tip != 0 && tip != tips[0] && len(merge) < opts.Octopus-1 {
+					merge = append(merge, tip)
+				}
+			}
+		} else {
+			b = rng.Intn(opts.Branches)
+		}
+
+		from := tips[b]
+		if from == 0 {
+			from = tips[0] // a new branch starts from master
+		}
+		msg := fmt.Sprintf("commit %d on %s\n", n, branches[b])
+		if len(merge) > 0 {
+			msg = fmt.Sprintf("merge %d into %s\n", n, branches[b])
+		}
+		ident := fmt.Sprintf("Gen %d <gen%d@example.com> %d +0000", b, b, genEpoch+60*n)
+
+		fmt.Fprintf(&stream, "commit refs/heads/%s\nmark :%d\n", branches[b], n)
+		fmt.Fprintf(&stream, "author %s\ncommitter %s\n", ident, ident)
+		fmt.Fprintf(&stream, "data %d\n%s", len(msg), msg)
+		if from != 0 {
+			fmt.Fprintf(&stream, "from :%d\n", from)
+		}
+		for _, mark := range merge {
+			fmt.Fprintf(&stream, "merge :%d\n", mark)
+		}
+		fmt.Fprintf(&stream, "M 100644 inline %s/file%d.txt\n", branches[b], n%opts.Files)
+		fmt.Fprintf(&stream, "data %d\n%s\n", len(msg), msg)
+		tips[b] = n
+	}
+
+	if _, _, _, err := RunGitCommandStdin(strings.NewReader(stream.String()), dir, nil, "fast-import", "--quiet"); err != nil {
+		return err
+	}
+	_, _, _, err := RunGitCommand(dir, nil, "symbolic-ref", "HEAD", "refs/heads/master")
+	return err
+}
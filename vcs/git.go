@@ -3,40 +3,208 @@
 package vcs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"strconv"
 
 	"vcsloc/gsos"
 )
 
+// Hash identifies a commit (or other object) in a repo. For git and hg it's
+// the object id in lowercase hex: 40 digits for SHA-1, 64 for SHA-256 git
+// repos. Revision numbers (as in svn) are decimal.
 type Hash string
 
+var ErrBadHash = errors.New("bad hash")
+
+// ParseHash checks that s is a hash: 40 or 64 hex digits, or a revision
+// number. Hex digits are lowercased, as git and hg print them.
+func ParseHash(s string) (Hash, error) {
+	switch {
+	case len(s) == 40 || len(s) == 64:
+		for i := 0; i < len(s); i++ {
+			if !isHexDigit(s[i]) {
+				return "", fmt.Errorf("%w: '%s'", ErrBadHash, s)
+			}
+		}
+		return Hash(strings.ToLower(s)), nil
+	case len(s) > 0 && len(s) < 40:
+		for i := 0; i < len(s); i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return "", fmt.Errorf("%w: '%s'", ErrBadHash, s)
+			}
+		}
+		return Hash(s), nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrBadHash, s)
+}
+
+// ParseHashLine splits a "<hash> <rest>" line, as in "git show-ref" output or
+// the refs file, checking the hash. It doesn't assume a hash length, so it
+// works for SHA-256 repos as well.
+func ParseHashLine(line string) (Hash, string, error) {
+	pos := strings.Index(line, " ")
+	if pos == -1 {
+		return "", "", fmt.Errorf("%w: no hash in '%s'", ErrBadHash, line)
+	}
+	hash, err := ParseHash(line[:pos])
+	if err != nil {
+		return "", "", err
+	}
+	return hash, line[pos+1:], nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// IsValid is true if h is a well-formed hash; see ParseHash.
+func (h Hash) IsValid() bool {
+	_, err := ParseHash(string(h))
+	return err == nil
+}
+
+// Abbrev is the first n characters of h, or all of it if it's shorter.
+func (h Hash) Abbrev(n int) string {
+	if n <= 0 || n >= len(h) {
+		return string(h)
+	}
+	return string(h[:n])
+}
+
+// GitEmptyTree is the hash of the empty tree in a SHA-1 repo. Diffing a
+// commit against it lists every file in the commit as added.
+const GitEmptyTree = Hash("4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+
+// GitEmptyTreeSHA256 is the empty tree in a SHA-256 repo.
+const GitEmptyTreeSHA256 = Hash("6ef19b41225c5369f1c104d45d8d85efa9b057b53b14b4b9b939dd74decc5321")
+
+// GitEmptyTreeFor is the empty tree in the same object format as hash.
+func GitEmptyTreeFor(hash Hash) Hash {
+	if len(hash) == len(GitEmptyTreeSHA256) {
+		return GitEmptyTreeSHA256
+	}
+	return GitEmptyTree
+}
+
+// ParseHashList turns a space-separated list of hashes (as in "%P" output)
+// into a []Hash.
+func ParseHashList(s string) []Hash {
+	var hashes []Hash
+	for _, h := range strings.Fields(s) {
+		hashes = append(hashes, Hash(h))
+	}
+	return hashes
+}
+
+// JoinHashes is strings.Join for hashes.
+func JoinHashes(hashes []Hash, sep string) string {
+	var sb strings.Builder
+	for i, h := range hashes {
+		if i > 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteString(string(h))
+	}
+	return sb.String()
+}
+
+// Ref is a named pointer into the repo. Tags are peeled, so RefHash is the
+// object at the end of any chain of annotated tags, usually a commit. Refs can
+// also point at trees and blobs; only commit refs are part of the history.
 type Ref struct {
 	RefHash Hash
 	Refname string
+	ObjectType string // type of the object the ref names: commit, tag, tree or blob
+	TargetType string // type of RefHash; not the same as ObjectType for tags
+}
+
+// IsCommit is true if the ref leads to a commit. A ref whose type isn't known
+// (e.g. from a backend that only has commit refs) is taken to be one.
+func (r Ref) IsCommit() bool {
+	return r.TargetType == "" || r.TargetType == "commit"
 }
 
 // ----------------------------------------------------------------------------------------------
 
+// gitBinary is the git executable that Git commands run, and gitArgs are
+// global options given to it ahead of each command.
+var (
+	gitBinary = "git"
+	gitArgs []string
+)
+
+// SetGitBinary picks the git executable to run, e.g. to pin one of several
+// installed versions: a name to look up in PATH, or a path. "" is "git".
+func SetGitBinary(exe string) {
+	if exe == "" {
+		exe = "git"
+	}
+	gitBinary = exe
+}
+
+// SetGitArgs sets global options to give git ahead of every command, e.g.
+// "-c", "core.quotepath=false".
+func SetGitArgs(args []string) {
+	gitArgs = args
+}
+
+// gitCommand is cmd with the global options in front of it.
+func gitCommand(cmd []string) []string {
+	if len(gitArgs) == 0 {
+		return cmd
+	}
+	return append(append([]string(nil), gitArgs...), cmd...)
+}
+
 // Run a Git command, returning elapsed time and stdout and stderr
-func RunGitCommand(repodir string, env []string, cmd ...string) (float64, []byte, []byte) {
+func RunGitCommand(repodir string, env []string, cmd ...string) (float64, []byte, []byte, error) {
+
+	return RunExternal(gitBinary, repodir, env, gitCommand(cmd)...)
+}
+
+// MustRunGitCommand is RunGitCommand where a failure is fatal.
+func MustRunGitCommand(repodir string, env []string, cmd ...string) (float64, []byte, []byte) {
 
-	return RunExternal("git", repodir, env, cmd...)
+	return MustRunExternal(gitBinary, repodir, env, gitCommand(cmd)...)
 }
 
 // Run a Git command incrementally
 func RunGitCommandIncremental(outCb, errCb func(string), repodir string, env []string, cmd ...string) float64 {
 
-	return RunExternalIncremental(outCb, errCb, "git", repodir, env, cmd...)
+	return RunExternalIncremental(outCb, errCb, gitBinary, repodir, env, gitCommand(cmd)...)
+}
+
+// RunGitCommandIncrementalStdin is RunGitCommandIncremental with stdin fed
+// from a reader, e.g. for "git log --stdin" or "git cat-file --batch-check".
+func RunGitCommandIncrementalStdin(stdin io.Reader, outCb, errCb func(string), repodir string, env []string, cmd ...string) float64 {
+
+	return RunExternalIncrementalStdin(stdin, outCb, errCb, gitBinary, repodir, env, gitCommand(cmd)...)
 }
 
 // ----------------------------------------------------------------------------------------------
 
+// gitLogEnv and gitLogEncoding make git log write names and messages as
+// UTF-8, which is what the log parsing takes them to be. git re-encodes each
+// commit from the encoding it was made with (a commit made with Latin-1
+// configured says so in its header) to the one asked for; without asking, it
+// goes by i18n.logOutputEncoding and the locale, and a non-UTF-8 one garbles
+// the names. A system without a C.UTF-8 locale falls back to C, which is fine.
+var gitLogEnv = []string{"LC_ALL=C.UTF-8"}
+
+const gitLogEncoding = "--encoding=UTF-8"
+
 // GitLog does "git log --all --pretty=format:<format>"
 func GitLogAll(repodir string, format string) ([]string, float64) {
 	prettyFormat := fmt.Sprintf("--pretty=format:%s", format)
-	elapsed, stdout, _ := RunGitCommand(repodir, nil, "log", "--all", "--full-history", prettyFormat)
+	elapsed, stdout, _ := MustRunGitCommand(repodir, gitLogEnv, "log", gitLogEncoding, "--all", "--full-history", prettyFormat)
 	return gsos.BytesToLines(stdout), elapsed
 }
 
@@ -47,7 +215,7 @@ func GitLogNumstat(repodir string, startHash, stopHash string, format string) ([
 	if stopHash != "" {
 		commitRange = stopHash + ".." + startHash
 	}
-	elapsed, stdout, _ := RunGitCommand(repodir, nil, "log", "--numstat", prettyFormat, commitRange)
+	elapsed, stdout, _ := MustRunGitCommand(repodir, gitLogEnv, "log", gitLogEncoding, "--numstat", prettyFormat, commitRange)
 	return gsos.BytesToLines(stdout), elapsed
 }
 
@@ -55,46 +223,240 @@ func GitLogNumstat(repodir string, startHash, stopHash string, format string) ([
 // Every Git repo has at least one root commit, but it can multiple
 // (the git repo itself has 9)
 func GitRootCommits(repodir string) ([]string, float64) {
-	elapsed, stdout, _ := RunGitCommand(repodir, nil, "rev-list", "--max-parents=0", "--all")
+	elapsed, stdout, _ := MustRunGitCommand(repodir, nil, "rev-list", "--max-parents=0", "--all")
 	return gsos.BytesToLines(stdout), elapsed
 }
 
+// GitUnquotePath decodes a path that git quoted in its output because of
+// unusual characters: git writes café.txt as "caf\303\251.txt", with C-style
+// escapes and each byte of non-ASCII characters in octal (core.quotepath=false
+// leaves those alone, but still quotes the rest). A path that isn't quoted is
+// returned as it is.
+func GitUnquotePath(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// RunGitCommandStdin runs a Git command with stdin read from a reader.
+func RunGitCommandStdin(stdin io.Reader, repodir string, env []string, cmd ...string) (float64, []byte, []byte, error) {
+
+	return RunExternalStdin(stdin, gitBinary, repodir, env, gitCommand(cmd)...)
+}
+
+// GitObjectTypes returns the type (commit, tag, tree, blob) of each of the
+// hashes, from one "git cat-file --batch-check". Missing objects aren't in
+// the map.
+func GitObjectTypes(repodir string, hashes []Hash) (map[Hash]string, float64) {
+	types := make(map[Hash]string, len(hashes))
+	if len(hashes) == 0 {
+		return types, 0
+	}
+	var input strings.Builder
+	for _, hash := range hashes {
+		input.WriteString(string(hash))
+		input.WriteString("\n")
+	}
+
+	// Each line is "<hash> <type> <size>", or "<hash> missing"
+	elapsed, stdout, _, err := RunGitCommandStdin(strings.NewReader(input.String()), repodir, nil,
+		"cat-file", "--batch-check=%(objectname) %(objecttype)")
+	if err != nil {
+		gsos.Fatalf("\n%s\n", err)
+	}
+	for _, L := range gsos.BytesToLines(stdout) {
+		fields := strings.Fields(L)
+		if len(fields) == 2 && fields[1] != "missing" {
+			types[Hash(fields[0])] = fields[1]
+		}
+	}
+	return types, elapsed
+}
+
+// GitObjectSizes returns the size in bytes of each of the hashes, from one
+// "git cat-file --batch-check". Missing objects aren't in the map. Unlike
+// GitObjectTypes, a failure is returned rather than fatal, so a report can
+// say its sizes are unknown instead of exiting.
+func GitObjectSizes(repodir string, hashes []Hash) (map[Hash]int64, float64, error) {
+	sizes := make(map[Hash]int64, len(hashes))
+	if len(hashes) == 0 {
+		return sizes, 0, nil
+	}
+	var input strings.Builder
+	for _, hash := range hashes {
+		input.WriteString(string(hash))
+		input.WriteString("\n")
+	}
+
+	// Each line is "<hash> <size>", or "<hash> missing"
+	elapsed, stdout, _, err := RunGitCommandStdin(strings.NewReader(input.String()), repodir, nil,
+		"cat-file", "--batch-check=%(objectname) %(objectsize)")
+	if err != nil {
+		return nil, elapsed, err
+	}
+	for _, L := range gsos.BytesToLines(stdout) {
+		fields := strings.Fields(L)
+		if len(fields) == 2 && fields[1] == "missing" {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, elapsed, fmt.Errorf("bad cat-file output: '%s'", L)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, elapsed, fmt.Errorf("bad cat-file size: '%s'", L)
+		}
+		sizes[Hash(fields[0])] = size
+	}
+	return sizes, elapsed, nil
+}
+
 // GitRefs collects all the refs from the repo, in pairs of
 // ref-name, ref-hash. We use --dereference to make tags show
 // their commits, because that's what we really care about.
+// Each ref gets the types of the object it names and the one it
+// peels to, so that refs to trees and blobs can be told apart.
 func GitRefs(repodir string) ([]Ref, float64) {
-	elapsed, stdout, _ := RunGitCommand(repodir, nil, "show-ref", "--dereference")
+	// show-ref fails if there are no refs (e.g. a new repo), so check first
+	elapsed, stdout, _ := MustRunGitCommand(repodir, nil, "for-each-ref", "--count=1", "--format=%(refname)")
+	if len(stdout) == 0 {
+		return nil, elapsed
+	}
 
 	// Turn output into refnames and hashes, collapsing tag refnames
 	// to their pointed-to commits
 	var refs []Ref
 	refnames := make(map[string]int)
-	for _, L := range gsos.BytesToLines(stdout) {
-		hash := L[:40]
-		refname := L[41:]
+	tagHashes := make(map[int]Hash) // hash of the tag itself, by refs index
+	elapsed = RunGitCommandIncremental(func(L string) {
+		hash, refname, err := ParseHashLine(L)
+		if err != nil {
+			return
+		}
 		if strings.HasSuffix(refname, "^{}") {
 			refname = refname[:len(refname)-3]
-			refs[refnames[refname]].RefHash = Hash(hash) // replace tag hash with commit hash
+			i := refnames[refname]
+			tagHashes[i] = refs[i].RefHash
+			refs[i].RefHash = Hash(hash) // replace tag hash with commit hash
 		} else {
 			refnames[refname] = len(refs)
-			refs = append(refs, Ref{Hash(hash), refname})
+			refs = append(refs, Ref{RefHash: Hash(hash), Refname: refname})
+		}
+	}, nil, repodir, nil, "show-ref", "--dereference")
+
+	// RefHash is the peeled object now; the type of the object the ref itself
+	// names only differs for tags, so only those need their own hash
+	var hashes []Hash
+	for _, ref := range refs {
+		hashes = append(hashes, ref.RefHash)
+	}
+	for i := range tagHashes {
+		hashes = append(hashes, tagHashes[i])
+	}
+	types, typesElapsed := GitObjectTypes(repodir, hashes)
+	for i := range refs {
+		refs[i].TargetType = types[refs[i].RefHash]
+		refs[i].ObjectType = refs[i].TargetType
+		if tagHash, ok := tagHashes[i]; ok {
+			refs[i].ObjectType = types[tagHash]
 		}
-		//refnames[refname] = hash
 	}
 
-	//for refname, hash := range refnames {
-	//	refs = append(refs, Ref{Hash(hash), refname})
-	//}
+	// show-ref happens to list refs sorted, but callers compare ref lists
+	// element by element, so don't count on it
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Refname < refs[j].Refname })
 
-	return refs, elapsed
+	return refs, elapsed + typesElapsed
+}
+
+// IsGitRepo is true if path is in a git repo, bare or not.
+func IsGitRepo(path string) bool {
+	_, _, _, err := RunGitCommand(path, nil, "rev-parse", "--git-dir")
+	return err == nil
+}
+
+// GitIsBareRepo is true if repodir is a bare repo, one without a working
+// tree, e.g. a server-side mirror.
+func GitIsBareRepo(repodir string) bool {
+	_, stdout, _, err := RunGitCommand(repodir, nil, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(stdout)) == "true"
+}
+
+// GitSubmodules returns the paths of the repo's submodules, and of theirs,
+// from "git submodule status --recursive". The paths are relative to
+// repodir. A submodule that isn't checked out has nothing to look at, so
+// it's in uninitialized instead.
+func GitSubmodules(repodir string) (paths []string, uninitialized []string, err error) {
+	_, stdout, _, err := RunGitCommand(repodir, nil, "submodule", "status", "--recursive")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each line is "<state><hash> <path>", then " (<describe>)" if it's
+	// checked out; the state is "-" for a submodule that isn't, and a space
+	// (which may be trimmed) if all is well
+	for _, line := range gsos.BytesToLines(stdout) {
+		var state byte
+		if line != "" && strings.IndexByte("-+U ", line[0]) != -1 {
+			state, line = line[0], line[1:]
+		}
+		space := strings.Index(line, " ")
+		if space == -1 {
+			if line == "" {
+				continue
+			}
+			return nil, nil, fmt.Errorf("bad submodule status line: %s", line)
+		}
+		path := line[space+1:]
+		if state == '-' {
+			uninitialized = append(uninitialized, path)
+			continue
+		}
+		if pos := strings.LastIndex(path, " ("); pos != -1 && strings.HasSuffix(path, ")") {
+			path = path[:pos]
+		}
+		paths = append(paths, path)
+	}
+	return paths, uninitialized, nil
+}
+
+// GitShallowCommits returns the commits listed in the shallow file of a
+// shallow clone, the ones whose parents weren't fetched. Git logs them
+// without parents. A full clone has no shallow file, and gets nil.
+func GitShallowCommits(repodir string) []Hash {
+	_, stdout, _, err := RunGitCommand(repodir, nil, "rev-parse", "--git-path", "shallow")
+	if err != nil {
+		return nil
+	}
+	path := strings.TrimSpace(string(stdout))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(repodir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var hashes []Hash
+	for _, L := range gsos.BytesToLines(data) {
+		if hash, err := ParseHash(strings.TrimSpace(L)); err == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
 }
 
 // GitCountObjects returns the number of objects in the repo
 // (useful to know if another Git command might take a long time)
 func GitCountObjects(repodir string) (int, float64) {
-	elapsed, stdout, _ := RunGitCommand(repodir, nil, "count-objects", "-v")
 	var numObjects int
-	for _, L := range gsos.BytesToLines(stdout) {
+	elapsed := RunGitCommandIncremental(func(L string) {
 		if strings.Index(L, "count: ") == 0 {
 			v, _ := strconv.Atoi(L[7:])
 			numObjects += v
@@ -102,6 +464,139 @@ func GitCountObjects(repodir string) (int, float64) {
 			v, _ := strconv.Atoi(L[9:])
 			numObjects += v
 		}
-	}
+	}, nil, repodir, nil, "count-objects", "-v")
 	return numObjects, elapsed
 }
+
+// ----------------------------------------------------------------------------------------------
+
+// GitBackend is the VcsBackend for Git repos.
+type GitBackend struct {
+	repodir string
+}
+
+func (g *GitBackend) Name() string {
+	return "git"
+}
+
+func (g *GitBackend) Refs() []Ref {
+	refs, _ := GitRefs(g.repodir)
+	return refs
+}
+
+// RefsSignature hashes the refs as listed by one for-each-ref, which
+// doesn't peel tags or look up object types, so it's much cheaper than Refs
+// on a repo with many tags. It's not the same as the signature of Refs.
+func (g *GitBackend) RefsSignature() string {
+	_, stdout, _, err := RunGitCommand(g.repodir, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(stdout)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (g *GitBackend) IsBare() bool {
+	return GitIsBareRepo(g.repodir)
+}
+
+func (g *GitBackend) ShallowCommits() []Hash {
+	return GitShallowCommits(g.repodir)
+}
+
+func (g *GitBackend) CountObjects() int {
+	numObjects, _ := GitCountObjects(g.repodir)
+	return numObjects
+}
+
+// LogArgs returns the revisions and paths for "git log". The open-ended
+// range forms are relative to all refs rather than HEAD: "A.." is every
+// commit not reachable from A, and "..B" is every commit reachable from B.
+// With paths, history is simplified with parent rewriting, so the graph
+// stays connected.
+func (g *GitBackend) LogArgs(spec RevSpec) []string {
+	var args []string
+	from := []string{"--all"}
+	if len(spec.Refs) > 0 {
+		from = spec.Refs
+	}
+	switch {
+	case spec.Range == "":
+		args = append(args, from...)
+	case strings.HasPrefix(spec.Range, ".."):
+		args = append(args, spec.Range[2:])
+	case strings.HasSuffix(spec.Range, ".."):
+		args = append(args, from...)
+		args = append(args, "^"+strings.TrimSuffix(spec.Range, ".."))
+	default:
+		args = append(args, spec.Range)
+	}
+	if spec.Since != "" {
+		args = append(args, "--since="+spec.Since)
+	}
+	if spec.Until != "" {
+		args = append(args, "--until="+spec.Until)
+	}
+	for _, hash := range spec.Exclude {
+		args = append(args, "^"+string(hash))
+	}
+	if spec.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	if len(spec.Paths) > 0 {
+		args = append(args, "--parents", "--")
+		args = append(args, spec.Paths...)
+	}
+	return args
+}
+
+func (g *GitBackend) AllCommitHashes(progress func(n int), args ...string) []Hash {
+	var hashes []Hash
+	cmd := append([]string{"log", "--pretty=%H"}, args...)
+	RunGitCommandIncremental(func(line string) {
+		hashes = append(hashes, Hash(line))
+		if progress != nil {
+			progress(len(hashes))
+		}
+	}, nil, g.repodir, nil, cmd...)
+	return hashes
+}
+
+// LogIncremental writes names and messages as UTF-8, whatever encoding the
+// commits were made with and whatever the locale (see gitLogEnv).
+func (g *GitBackend) LogIncremental(outCb func(string), stats bool, args ...string) {
+	prettyFormat := "--pretty=format:%x1e%H%x1f%at%x1f%ad%x1f%aN%x1f%aE%x1f%cN%x1f%cE%x1f%ct%x1f%P%x1f%s%n%b%x1d"
+	cmd := []string{"log", gitLogEncoding, prettyFormat, "--date=format:%z"}
+	if stats {
+		cmd = append(cmd, "-c", "--numstat", "--summary")
+	}
+	cmd = append(cmd, args...)
+	RunGitCommandIncremental(outCb, nil, g.repodir, gitLogEnv, cmd...)
+}
+
+func (g *GitBackend) SupportsStats() bool {
+	return true
+}
+
+// DefaultBranch is the branch HEAD points at. A detached HEAD, or one that
+// points at a branch with no commits yet, says nothing, and main or master
+// is guessed instead.
+func (g *GitBackend) DefaultBranch(refs []Ref) string {
+	_, stdout, _, err := RunGitCommand(g.repodir, nil, "symbolic-ref", "-q", "HEAD")
+	if head := strings.TrimSpace(string(stdout)); err == nil && hasRef(refs, head) {
+		return head
+	}
+	return GuessDefaultBranch(refs)
+}
+
+// MissingCommits checks all the hashes with one cat-file.
+func (g *GitBackend) MissingCommits(hashes []Hash) []Hash {
+	types, _ := GitObjectTypes(g.repodir, hashes)
+	var missing []Hash
+	for _, hash := range hashes {
+		if _, ok := types[hash]; !ok {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,229 @@
+// vcsloc/vcs/hg.go
+
+package vcs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"vcsloc/gsos"
+)
+
+// Run a Mercurial command, returning elapsed time and stdout and stderr
+func RunHgCommand(repodir string, env []string, cmd ...string) (float64, []byte, []byte, error) {
+
+	return RunExternal("hg", repodir, env, cmd...)
+}
+
+// MustRunHgCommand is RunHgCommand where a failure is fatal.
+func MustRunHgCommand(repodir string, env []string, cmd ...string) (float64, []byte, []byte) {
+
+	return MustRunExternal("hg", repodir, env, cmd...)
+}
+
+// Run a Mercurial command incrementally
+func RunHgCommandIncremental(outCb, errCb func(string), repodir string, env []string, cmd ...string) float64 {
+
+	return RunExternalIncremental(outCb, errCb, "hg", repodir, env, cmd...)
+}
+
+// IsHgRepo is true if path is in a Mercurial repo.
+func IsHgRepo(path string) bool {
+	_, _, _, err := RunHgCommand(path, nil, "root")
+	return err == nil
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// HgBackend is the VcsBackend for Mercurial repos. Bookmarks, branch heads
+// and tags are mapped to refs/bookmarks/, refs/branches/ and refs/tags/.
+// Mercurial has no numstat, so there are no change stats.
+type HgBackend struct {
+	repodir string
+}
+
+func (h *HgBackend) Name() string {
+	return "hg"
+}
+
+// Refs returns bookmarks, branches and tags, sorted by name like git's refs.
+func (h *HgBackend) Refs() []Ref {
+	var refs []Ref
+	add := func(prefix string, cmd ...string) {
+		_, stdout, _ := MustRunHgCommand(h.repodir, nil, cmd...)
+		for _, L := range gsos.BytesToLines(stdout) {
+			pos := strings.Index(L, " ")
+			if pos == -1 {
+				continue
+			}
+			name := L[pos+1:]
+			if prefix == "refs/tags/" && name == "tip" {
+				continue // tip moves with every commit, it's not a real tag
+			}
+			refs = append(refs, Ref{RefHash: Hash(L[:pos]), Refname: prefix + name})
+		}
+	}
+	add("refs/bookmarks/", "bookmarks", "-T", "{node} {bookmark}\n")
+	add("refs/branches/", "branches", "-T", "{node} {branch}\n")
+	add("refs/tags/", "tags", "-T", "{node} {tag}\n")
+	return refs
+}
+
+// IsBare is always false; an hg repo without a checkout still has its
+// working directory.
+func (h *HgBackend) IsBare() bool {
+	return false
+}
+
+// ShallowCommits is always nil; hg clones are complete.
+func (h *HgBackend) ShallowCommits() []Hash {
+	return nil
+}
+
+// CountObjects returns the number of revisions, which only grows as history
+// is added.
+func (h *HgBackend) CountObjects() int {
+	_, stdout, _, err := RunHgCommand(h.repodir, nil, "log", "-r", "tip", "-T", "{rev}")
+	if err != nil {
+		return 0
+	}
+	rev, err := strconv.Atoi(strings.TrimSpace(string(stdout)))
+	if err != nil {
+		return 0
+	}
+	return rev + 1
+}
+
+// LogArgs turns a revision selection into a revset, with the same meaning as
+// for git: "A..B" is ancestors of B that aren't ancestors of A, "A.." is
+// everything that isn't an ancestor of A, and "..B" is the ancestors of B.
+// Excluded commits and their ancestors are subtracted from that. First
+// parents are followed from the heads, or from B.
+func (h *HgBackend) LogArgs(spec RevSpec) []string {
+	var args []string
+	var revset string
+	var refs string // the refs to start from, if not all of them
+	if len(spec.Refs) > 0 {
+		refs = strings.Join(spec.Refs, " + ")
+	}
+	switch {
+	case spec.Range == "" && refs != "":
+		revset = "::(" + refs + ")"
+	case spec.Range == "":
+	case strings.HasPrefix(spec.Range, ".."):
+		revset = "::" + spec.Range[2:]
+	case strings.HasSuffix(spec.Range, "..") && refs != "":
+		revset = "only(" + refs + ", " + strings.TrimSuffix(spec.Range, "..") + ")"
+	case strings.HasSuffix(spec.Range, ".."):
+		revset = "not ::" + strings.TrimSuffix(spec.Range, "..")
+	default:
+		ends := strings.SplitN(spec.Range, "..", 2)
+		revset = "only(" + ends[1] + ", " + ends[0] + ")"
+	}
+	if spec.FirstParent {
+		from := "heads(all())"
+		if refs != "" {
+			from = refs
+		}
+		if pos := strings.Index(spec.Range, ".."); pos != -1 && spec.Range[pos+2:] != "" {
+			from = spec.Range[pos+2:]
+		}
+		chain := "_firstancestors(" + from + ")"
+		if revset != "" {
+			chain = "(" + revset + ") and " + chain
+		}
+		revset = chain
+	}
+	if len(spec.Exclude) > 0 {
+		if revset == "" {
+			revset = "all()"
+		}
+		revset = "(" + revset + ") and not ::(" + JoinHashes(spec.Exclude, " + ") + ")"
+	}
+	if revset != "" {
+		args = append(args, "-r", "reverse(" + revset + ")")
+	}
+	switch {
+	case spec.Since != "" && spec.Until != "":
+		args = append(args, "-d", spec.Since + " to " + spec.Until)
+	case spec.Since != "":
+		args = append(args, "-d", ">" + spec.Since)
+	case spec.Until != "":
+		args = append(args, "-d", "<" + spec.Until)
+	}
+	if len(spec.Paths) > 0 {
+		args = append(args, "--")
+		args = append(args, spec.Paths...)
+	}
+	return args
+}
+
+func (h *HgBackend) AllCommitHashes(progress func(n int), args ...string) []Hash {
+	var hashes []Hash
+	cmd := append([]string{"log", "-T", "{node}\n"}, args...)
+	RunHgCommandIncremental(func(line string) {
+		hashes = append(hashes, Hash(line))
+		if progress != nil {
+			progress(len(hashes))
+		}
+	}, nil, h.repodir, nil, cmd...)
+	return hashes
+}
+
+// LogIncremental ignores stats, since hg has nothing like numstat. hg only
+// records one identity, so the committer is the author.
+func (h *HgBackend) LogIncremental(outCb func(string), stats bool, args ...string) {
+	template := LogRecordSep + "{node}" + LogFieldSep + "{word(0, date|hgdate)}" +
+		LogFieldSep + "{word(2, date|isodatesec)}" + LogFieldSep + "{author|person}" + LogFieldSep + "{author|email}" +
+		LogFieldSep + "{author|person}" + LogFieldSep + "{author|email}" + LogFieldSep + "{word(0, date|hgdate)}" +
+		LogFieldSep + "{ifeq(p1rev, '-1', '', p1node)} {ifeq(p2rev, '-1', '', p2node)}" +
+		LogFieldSep + "{desc|firstline}\n{sub(r'^[^\\n]*\\n*', '', desc)}" + LogBodyEnd + "\n"
+	cmd := append([]string{"log", "-T", template}, args...)
+	RunHgCommandIncremental(outCb, nil, h.repodir, nil, cmd...)
+}
+
+func (h *HgBackend) SupportsStats() bool {
+	return false
+}
+
+// DefaultBranch is hg's default branch, the one commits go on unless they're
+// put on a named branch.
+func (h *HgBackend) DefaultBranch(refs []Ref) string {
+	if hasRef(refs, "refs/branches/default") {
+		return "refs/branches/default"
+	}
+	return ""
+}
+
+// MissingCommits checks all the hashes with one log; id() is empty for a
+// node that isn't there, rather than an error.
+func (h *HgBackend) MissingCommits(hashes []Hash) []Hash {
+	if len(hashes) == 0 {
+		return nil
+	}
+	ids := make([]string, len(hashes))
+	for i, hash := range hashes {
+		ids[i] = fmt.Sprintf("id(%s)", hash)
+	}
+	_, stdout, _, err := RunHgCommand(h.repodir, nil, "log", "-r", strings.Join(ids, " or "), "-T", "{node}\n")
+	if err != nil {
+		return nil
+	}
+	found := make(map[Hash]bool, len(hashes))
+	for _, L := range gsos.BytesToLines(stdout) {
+		found[Hash(L)] = true
+	}
+	var missing []Hash
+	for _, hash := range hashes {
+		if !found[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// RefsSignature has no cheaper way than Refs for hg.
+func (h *HgBackend) RefsSignature() string {
+	return ""
+}
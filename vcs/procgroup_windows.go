@@ -0,0 +1,17 @@
+// vcsloc/vcs/procgroup_windows.go
+
+// +build windows
+
+package vcs
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ownProcessGroup puts c in a process group of its own, so that Ctrl-C in
+// the console goes to vcsloc alone, and it can stop the command itself
+// once it's ready to (see gsos.Interrupt).
+func ownProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}